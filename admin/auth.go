@@ -0,0 +1,63 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gandalfmagic/go-token-handler/zlogger"
+)
+
+var (
+	ErrInvalidClientCA = errors.New("the client CA file doesn't contain any valid certificate")
+)
+
+// TokenMiddleware only accepts the requests with the static admin token in the
+// Authorization header, using the Bearer scheme. An empty token disables the
+// check, and must only be used when the client certificates are required.
+func TokenMiddleware(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="token-handler-admin"`)
+			zlogger.FromContext(r.Context()).JsonError(w, http.StatusUnauthorized, "missing the admin token", nil)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(header[7:]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="token-handler-admin", error="invalid_token"`)
+			zlogger.FromContext(r.Context()).JsonError(w, http.StatusUnauthorized, "the admin token is not valid", nil)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientCertTLSConfig returns a TLS configuration that requires a client
+// certificate, signed by one of the CAs in the clientCAFile.
+func ClientCertTLSConfig(clientCAFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrInvalidClientCA
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
@@ -0,0 +1,149 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gandalfmagic/go-token-handler/database"
+	"github.com/gandalfmagic/go-token-handler/zlogger"
+
+	"go.uber.org/zap"
+)
+
+const (
+	sessionsPath = "/sessions"
+	countPath    = "/sessions/count"
+)
+
+// NewHandler returns the handler of the admin API, used by the operators to
+// inspect and revoke the user sessions:
+//
+//	GET    /sessions?subject=<subject>  lists the sessions of a user
+//	DELETE /sessions?subject=<subject>  revokes all the sessions of a user
+//	GET    /sessions/count              returns the number of sessions
+//	DELETE /sessions/<id>               revokes a single session
+//
+// The handler must always be protected by the TokenMiddleware, or by a
+// listener requiring a client certificate.
+func NewHandler(sessionImpl database.SessionImpl) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(sessionsPath, sessionsHandler(sessionImpl))
+	mux.Handle(countPath, countHandler(sessionImpl))
+	mux.Handle(sessionsPath+"/", sessionHandler(sessionImpl))
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zlogger.FromContext(r.Context()).JsonError(w, http.StatusNotFound, "", nil)
+	}))
+
+	return noStore(mux)
+}
+
+func sessionsHandler(sessionImpl database.SessionImpl) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		zlog := zlogger.FromContext(ctx)
+
+		subject := r.URL.Query().Get("subject")
+		if subject == "" {
+			zlog.JsonError(w, http.StatusBadRequest, "missing the subject parameter", nil)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			sessions, err := sessionImpl.ListBySubject(ctx, subject)
+			if err != nil {
+				zlog.JsonError(w, http.StatusInternalServerError, "cannot list the sessions of the user", err)
+				return
+			}
+
+			writeJSON(w, http.StatusOK, struct {
+				Sessions []database.SessionInfo `json:"sessions"`
+			}{Sessions: sessions})
+		case http.MethodDelete:
+			count, err := sessionImpl.DeleteBySubject(ctx, subject)
+			if err != nil {
+				zlog.JsonError(w, http.StatusInternalServerError, "cannot revoke the sessions of the user", err)
+				return
+			}
+
+			zlog.Info("revoked all the sessions of a user", zap.String("subject", subject), zap.Int64("count", count))
+
+			writeJSON(w, http.StatusOK, struct {
+				Revoked int64 `json:"revoked"`
+			}{Revoked: count})
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			zlog.JsonError(w, http.StatusMethodNotAllowed, "", nil)
+		}
+	})
+}
+
+func countHandler(sessionImpl database.SessionImpl) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		zlog := zlogger.FromContext(ctx)
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			zlog.JsonError(w, http.StatusMethodNotAllowed, "", nil)
+			return
+		}
+
+		count, err := sessionImpl.Count(ctx)
+		if err != nil {
+			zlog.JsonError(w, http.StatusInternalServerError, "cannot count the sessions", err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, struct {
+			Count int64 `json:"count"`
+		}{Count: count})
+	})
+}
+
+func sessionHandler(sessionImpl database.SessionImpl) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		zlog := zlogger.FromContext(ctx)
+
+		id := strings.TrimPrefix(r.URL.Path, sessionsPath+"/")
+		if id == "" || strings.Contains(id, "/") {
+			zlog.JsonError(w, http.StatusNotFound, "", nil)
+			return
+		}
+
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			zlog.JsonError(w, http.StatusMethodNotAllowed, "", nil)
+			return
+		}
+
+		// The delete is idempotent, a missing session is not an error
+		if err := sessionImpl.Delete(ctx, id); err != nil {
+			zlog.JsonError(w, http.StatusInternalServerError, "cannot revoke the session", err)
+			return
+		}
+
+		zlog.Info("revoked a session", zap.String("session_id", id))
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// noStore prevents the caching of the admin responses, that contain the
+// details of the user sessions.
+func noStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	_ = json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,221 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gandalfmagic/go-token-handler/database"
+	"github.com/gandalfmagic/go-token-handler/zlogger"
+)
+
+const testToken = "0123456789abcdef0123456789abcdef"
+
+func newTestHandler(t *testing.T) (http.Handler, database.SessionImpl, map[string]string) {
+	t.Helper()
+
+	sessionImpl, err := database.NewMemorySessionImpl(context.TODO(), nil, 30*time.Minute)
+	if err != nil {
+		t.Fatalf("NewMemorySessionImpl() fatal error = %v", err)
+	}
+
+	ids := make(map[string]string)
+	for _, s := range []database.SessionData{
+		{Subject: "user_01", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: time.Now().Add(5 * time.Minute), SID: "sid_01", SessionExpiresAt: time.Now().Add(20 * time.Minute)},
+		{Subject: "user_01", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: time.Now().Add(5 * time.Minute), SID: "sid_02", SessionExpiresAt: time.Now().Add(30 * time.Minute)},
+		{Subject: "user_02", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: time.Now().Add(5 * time.Minute), SID: "sid_03", SessionExpiresAt: time.Now().Add(30 * time.Minute)},
+	} {
+		id, err := sessionImpl.Add(context.TODO(), s)
+		if err != nil {
+			t.Fatalf("Add() fatal error = %v", err)
+		}
+
+		ids[s.SID] = id
+	}
+
+	zlog, err := zlogger.NewLogger("error", false)
+	if err != nil {
+		t.Fatalf("NewLogger() fatal error = %v", err)
+	}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		TokenMiddleware(testToken, NewHandler(sessionImpl)).ServeHTTP(w, r.WithContext(zlogger.NewContext(r.Context(), zlog)))
+	})
+
+	return h, sessionImpl, ids
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		target    string
+		token     string
+		wantCode  int
+		wantBody  string
+		wantCount int64
+	}{
+		{
+			name:      "missing_token",
+			method:    http.MethodGet,
+			target:    "/sessions/count",
+			wantCode:  http.StatusUnauthorized,
+			wantCount: 3,
+		},
+		{
+			name:      "wrong_token",
+			method:    http.MethodDelete,
+			target:    "/sessions?subject=user_01",
+			token:     "wrong",
+			wantCode:  http.StatusUnauthorized,
+			wantCount: 3,
+		},
+		{
+			name:      "count",
+			method:    http.MethodGet,
+			target:    "/sessions/count",
+			token:     testToken,
+			wantCode:  http.StatusOK,
+			wantBody:  `{"count":3}`,
+			wantCount: 3,
+		},
+		{
+			name:      "list_missing_subject",
+			method:    http.MethodGet,
+			target:    "/sessions",
+			token:     testToken,
+			wantCode:  http.StatusBadRequest,
+			wantCount: 3,
+		},
+		{
+			name:      "list_not_found",
+			method:    http.MethodGet,
+			target:    "/sessions?subject=user_03",
+			token:     testToken,
+			wantCode:  http.StatusOK,
+			wantBody:  `{"sessions":[]}`,
+			wantCount: 3,
+		},
+		{
+			name:      "revoke_subject",
+			method:    http.MethodDelete,
+			target:    "/sessions?subject=user_01",
+			token:     testToken,
+			wantCode:  http.StatusOK,
+			wantBody:  `{"revoked":2}`,
+			wantCount: 1,
+		},
+		{
+			name:      "revoke_session",
+			method:    http.MethodDelete,
+			target:    "/sessions/{sid_03}",
+			token:     testToken,
+			wantCode:  http.StatusNoContent,
+			wantCount: 2,
+		},
+		{
+			name:      "revoke_missing_session",
+			method:    http.MethodDelete,
+			target:    "/sessions/NOT_VALID",
+			token:     testToken,
+			wantCode:  http.StatusNoContent,
+			wantCount: 3,
+		},
+		{
+			name:      "wrong_method",
+			method:    http.MethodPost,
+			target:    "/sessions/count",
+			token:     testToken,
+			wantCode:  http.StatusMethodNotAllowed,
+			wantCount: 3,
+		},
+		{
+			name:      "not_found",
+			method:    http.MethodGet,
+			target:    "/users",
+			token:     testToken,
+			wantCode:  http.StatusNotFound,
+			wantCount: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, sessionImpl, ids := newTestHandler(t)
+
+			target := tt.target
+			if target == "/sessions/{sid_03}" {
+				target = "/sessions/" + ids["sid_03"]
+			}
+
+			r := httptest.NewRequest(tt.method, target, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("ServeHTTP() code = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody+"\n" {
+				t.Errorf("ServeHTTP() body = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+
+			if got := w.Header().Get("Cache-Control"); tt.token == testToken && got != "no-store" {
+				t.Errorf("ServeHTTP() Cache-Control = %s, want no-store", got)
+			}
+
+			count, err := sessionImpl.Count(context.TODO())
+			if err != nil {
+				t.Fatalf("Count() error = %v", err)
+			}
+
+			if count != tt.wantCount {
+				t.Errorf("Count() got = %d, want %d", count, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestHandler_List(t *testing.T) {
+	h, _, ids := newTestHandler(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/sessions?subject=user_01", nil)
+	r.Header.Set("Authorization", "Bearer "+testToken)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() code = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var body struct {
+		Sessions []map[string]interface{} `json:"sessions"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("cannot decode the response: %v", err)
+	}
+
+	if len(body.Sessions) != 2 {
+		t.Fatalf("ServeHTTP() sessions = %d, want 2", len(body.Sessions))
+	}
+
+	if body.Sessions[0]["id"] != ids["sid_01"] || body.Sessions[1]["id"] != ids["sid_02"] {
+		t.Errorf("ServeHTTP() the sessions are not sorted by expiration: %v", body.Sessions)
+	}
+
+	// The tokens must never be returned
+	for _, s := range body.Sessions {
+		for _, key := range []string{"AccessToken", "access_token", "RefreshToken", "refresh_token", "IDToken", "id_token"} {
+			if _, ok := s[key]; ok {
+				t.Errorf("ServeHTTP() the response contains the %s field", key)
+			}
+		}
+	}
+}
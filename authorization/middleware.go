@@ -0,0 +1,50 @@
+package authorization
+
+import (
+	"net/http"
+
+	"github.com/gandalfmagic/go-token-handler/oidc"
+	"github.com/gandalfmagic/go-token-handler/sessions"
+	"github.com/gandalfmagic/go-token-handler/zlogger"
+)
+
+// Middleware verifies that the tokens of the current session satisfy the
+// rules before calling the next handler. It must be wrapped by the
+// sessions.Manager AuthenticationMiddleware, that saves the tokens into the
+// request context.
+func Middleware(config *oidc.Config, rules Rules, next http.Handler) http.Handler {
+	if rules.IsEmpty() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		zlog := zlogger.FromContext(ctx)
+
+		// A request without the tokens is not authenticated
+		accessToken, _ := ctx.Value(sessions.ContextKeyAccessTokenName).(string)
+		if accessToken == "" {
+			zlog.JsonError(w, http.StatusUnauthorized, "cannot retrieve the access token from the context", nil)
+			return
+		}
+
+		idToken, _ := ctx.Value(sessions.ContextKeyIDTokenName).(string)
+		if idToken == "" {
+			zlog.JsonError(w, http.StatusUnauthorized, "cannot retrieve the id token from the context", nil)
+			return
+		}
+
+		claims, err := config.GetClaims(ctx, idToken, accessToken)
+		if err != nil {
+			zlog.JsonError(w, http.StatusUnauthorized, "cannot verify the token claims", err)
+			return
+		}
+
+		if err = rules.Evaluate(claims); err != nil {
+			zlog.JsonError(w, http.StatusForbidden, "access denied", err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,219 @@
+package authorization
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gandalfmagic/go-token-handler/oidc"
+	"github.com/gandalfmagic/go-token-handler/opentelemetry"
+	"github.com/gandalfmagic/go-token-handler/sessions"
+	"github.com/gandalfmagic/go-token-handler/zlogger"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+const (
+	testClientID = "token-handler"
+	testKeyID    = "test-key"
+)
+
+// testIssuer is an in-process auth server, that only publishes the discovery
+// document and the keys used to sign the tokens.
+type testIssuer struct {
+	server *httptest.Server
+	signer jose.Signer
+}
+
+func newTestSigner(t *testing.T) (jose.Signer, *rsa.PublicKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate the issuer key: %v", err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", testKeyID))
+	if err != nil {
+		t.Fatalf("cannot create the issuer signer: %v", err)
+	}
+
+	return signer, &key.PublicKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	signer, publicKey := newTestSigner(t)
+	keySet := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: publicKey, KeyID: testKeyID, Algorithm: string(jose.RS256), Use: "sig"}}}
+
+	i := &testIssuer{signer: signer}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                i.server.URL,
+			"authorization_endpoint":                i.server.URL + "/auth",
+			"token_endpoint":                        i.server.URL + "/token",
+			"jwks_uri":                              i.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(keySet)
+	})
+
+	i.server = httptest.NewServer(mux)
+	t.Cleanup(i.server.Close)
+
+	return i
+}
+
+// token returns a token signed by signer, with the standard claims of the
+// issuer and the additional claims.
+func (i *testIssuer) token(t *testing.T, signer jose.Signer, extra map[string]interface{}) string {
+	t.Helper()
+
+	claims := map[string]interface{}{
+		"iss": i.server.URL,
+		"sub": "user-01",
+		"aud": testClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatalf("cannot sign the token: %v", err)
+	}
+
+	return token
+}
+
+func TestMiddleware(t *testing.T) {
+	issuer := newTestIssuer(t)
+	otherSigner, _ := newTestSigner(t)
+
+	config, err := oidc.NewConfiguration(testClientID, "secret", issuer.server.URL, "https://token-handler.local/callback")
+	if err != nil {
+		t.Fatalf("NewConfiguration() fatal error = %v", err)
+	}
+
+	zlog, err := zlogger.NewLogger("fatal", false)
+	if err != nil {
+		t.Fatalf("NewLogger() fatal error = %v", err)
+	}
+
+	adminIDToken := issuer.token(t, issuer.signer, map[string]interface{}{"realm_access": map[string]interface{}{"roles": []string{"admin"}}})
+	userIDToken := issuer.token(t, issuer.signer, map[string]interface{}{"realm_access": map[string]interface{}{"roles": []string{"user"}}})
+
+	tests := []struct {
+		name        string
+		rules       Rules
+		accessToken string
+		idToken     string
+		wantStatus  int
+	}{
+		{
+			name:        "allowed",
+			rules:       Rules{Roles: []string{"admin"}},
+			accessToken: "opaque-access-token",
+			idToken:     adminIDToken,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "allowed_by_access_token",
+			rules:       Rules{Scopes: []string{"orders"}},
+			accessToken: issuer.token(t, issuer.signer, map[string]interface{}{"scope": "openid orders"}),
+			idToken:     userIDToken,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:       "empty_rules",
+			rules:      Rules{},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "missing_access_token",
+			rules:      Rules{Roles: []string{"admin"}},
+			idToken:    adminIDToken,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:        "missing_id_token",
+			rules:       Rules{Roles: []string{"admin"}},
+			accessToken: "opaque-access-token",
+			wantStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:        "unverifiable_id_token",
+			rules:       Rules{Roles: []string{"admin"}},
+			accessToken: "opaque-access-token",
+			idToken:     issuer.token(t, otherSigner, map[string]interface{}{"realm_access": map[string]interface{}{"roles": []string{"admin"}}}),
+			wantStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:        "unverifiable_access_token",
+			rules:       Rules{Scopes: []string{"orders"}},
+			accessToken: issuer.token(t, otherSigner, map[string]interface{}{"scope": "openid orders"}),
+			idToken:     userIDToken,
+			wantStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:        "missing_role",
+			rules:       Rules{Roles: []string{"admin"}},
+			accessToken: "opaque-access-token",
+			idToken:     userIDToken,
+			wantStatus:  http.StatusForbidden,
+		},
+		{
+			name:        "missing_scope",
+			rules:       Rules{Scopes: []string{"orders"}},
+			accessToken: "opaque-access-token",
+			idToken:     userIDToken,
+			wantStatus:  http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				called = true
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// The tokens are saved in the context by the AuthenticationMiddleware
+			ctx := context.Background()
+			if tt.accessToken != "" {
+				ctx = context.WithValue(ctx, sessions.ContextKeyAccessTokenName, tt.accessToken)
+			}
+			if tt.idToken != "" {
+				ctx = context.WithValue(ctx, sessions.ContextKeyIDTokenName, tt.idToken)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/api", nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+
+			zlog.Middleware(opentelemetry.Middleware(Middleware(config, tt.rules, next), "test", "test")).ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Middleware() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			if called != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("Middleware() next called = %v, want %v", called, tt.wantStatus == http.StatusOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package authorization
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gandalfmagic/go-token-handler/oidc"
+)
+
+const (
+	defaultRolesClaim  = "realm_access.roles"
+	defaultGroupsClaim = "groups"
+	scopesClaim        = "scope"
+)
+
+var (
+	ErrInvalidClaimMatcher = errors.New("the claim matcher must have the format '<claim> <operator> [value]'")
+	ErrUnknownOperator     = errors.New("the claim matcher operator must be a value from: equals, contains, exists")
+	ErrMissingRole         = errors.New("the user doesn't have the required role")
+	ErrMissingGroup        = errors.New("the user doesn't belong to the required group")
+	ErrMissingScope        = errors.New("the token doesn't contain the required scope")
+	ErrClaimMismatch       = errors.New("the token claims don't match the required value")
+)
+
+type Operator string
+
+const (
+	OperatorEquals   Operator = "equals"
+	OperatorContains Operator = "contains"
+	OperatorExists   Operator = "exists"
+)
+
+// ClaimMatcher defines a condition that must be satisfied by a single claim
+// of the tokens.
+type ClaimMatcher struct {
+	Claim    string
+	Operator Operator
+	Value    string
+}
+
+// ParseClaimMatchers converts a list of expressions in the format
+// `<claim> <operator> [value]` (e.g. `realm_access.roles contains admin`) into
+// a list of ClaimMatcher.
+func ParseClaimMatchers(expressions []string) ([]ClaimMatcher, error) {
+	matchers := make([]ClaimMatcher, 0, len(expressions))
+
+	for _, expression := range expressions {
+		fields := strings.Fields(expression)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidClaimMatcher, expression)
+		}
+
+		matcher := ClaimMatcher{Claim: fields[0], Operator: Operator(fields[1])}
+
+		switch matcher.Operator {
+		case OperatorEquals, OperatorContains:
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidClaimMatcher, expression)
+			}
+
+			matcher.Value = fields[2]
+		case OperatorExists:
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidClaimMatcher, expression)
+			}
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnknownOperator, expression)
+		}
+
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers, nil
+}
+
+func (m ClaimMatcher) match(claims oidc.Claims) bool {
+	value, ok := claims.Lookup(m.Claim)
+	if !ok {
+		return false
+	}
+
+	switch m.Operator {
+	case OperatorExists:
+		return true
+	case OperatorEquals:
+		switch value.(type) {
+		case []interface{}, map[string]interface{}:
+			return false
+		default:
+			return fmt.Sprint(value) == m.Value
+		}
+	case OperatorContains:
+		return contains(value, m.Value)
+	}
+
+	return false
+}
+
+// contains verifies if a claim contains the specified value, the claim can be
+// either an array or a string with a list of values separated by spaces (e.g.
+// the `scope` claim).
+func contains(claim interface{}, value string) bool {
+	switch v := claim.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if fmt.Sprint(item) == value {
+				return true
+			}
+		}
+	case string:
+		for _, item := range strings.Fields(v) {
+			if item == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Rules contains the conditions that the tokens of a session must satisfy to
+// access a resource. All the conditions must be satisfied.
+type Rules struct {
+	// RolesClaim is the claim containing the user roles, the default value is
+	// `realm_access.roles`
+	RolesClaim string
+	// GroupsClaim is the claim containing the user groups, the default value is
+	// `groups`
+	GroupsClaim string
+	Roles       []string
+	Groups      []string
+	Scopes      []string
+	Claims      []ClaimMatcher
+}
+
+// IsEmpty returns true if the rules don't contain any condition.
+func (r Rules) IsEmpty() bool {
+	return len(r.Roles) == 0 && len(r.Groups) == 0 && len(r.Scopes) == 0 && len(r.Claims) == 0
+}
+
+// Evaluate verifies the claims against the rules, it returns an error
+// describing the first unsatisfied condition.
+func (r Rules) Evaluate(claims oidc.Claims) error {
+	rolesClaim := r.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = defaultRolesClaim
+	}
+
+	groupsClaim := r.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = defaultGroupsClaim
+	}
+
+	roles, _ := claims.Lookup(rolesClaim)
+	for _, role := range r.Roles {
+		if !contains(roles, role) {
+			return fmt.Errorf("%w: %s", ErrMissingRole, role)
+		}
+	}
+
+	groups, _ := claims.Lookup(groupsClaim)
+	for _, group := range r.Groups {
+		if !contains(groups, group) {
+			return fmt.Errorf("%w: %s", ErrMissingGroup, group)
+		}
+	}
+
+	scopes, _ := claims.Lookup(scopesClaim)
+	for _, scope := range r.Scopes {
+		if !contains(scopes, scope) {
+			return fmt.Errorf("%w: %s", ErrMissingScope, scope)
+		}
+	}
+
+	for _, matcher := range r.Claims {
+		if !matcher.match(claims) {
+			return fmt.Errorf("%w: %s %s %s", ErrClaimMismatch, matcher.Claim, matcher.Operator, matcher.Value)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package authorization
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gandalfmagic/go-token-handler/oidc"
+)
+
+func TestParseClaimMatchers(t *testing.T) {
+	tests := []struct {
+		name        string
+		expressions []string
+		want        []ClaimMatcher
+		wantErr     error
+	}{
+		{
+			name:        "contains",
+			expressions: []string{"realm_access.roles contains admin"},
+			want:        []ClaimMatcher{{Claim: "realm_access.roles", Operator: OperatorContains, Value: "admin"}},
+		},
+		{
+			name:        "exists",
+			expressions: []string{"email_verified exists"},
+			want:        []ClaimMatcher{{Claim: "email_verified", Operator: OperatorExists}},
+		},
+		{
+			name:        "missing_value",
+			expressions: []string{"azp equals"},
+			wantErr:     ErrInvalidClaimMatcher,
+		},
+		{
+			name:        "unexpected_value",
+			expressions: []string{"azp exists spa"},
+			wantErr:     ErrInvalidClaimMatcher,
+		},
+		{
+			name:        "unknown_operator",
+			expressions: []string{"azp like spa"},
+			wantErr:     ErrUnknownOperator,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseClaimMatchers(tt.expressions)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseClaimMatchers() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseClaimMatchers() got = %v, want %v", got, tt.want)
+			}
+
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("ParseClaimMatchers() got = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRules_Evaluate(t *testing.T) {
+	claims := oidc.Claims{
+		"sub":            "user",
+		"azp":            "spa",
+		"scope":          "openid profile email",
+		"email_verified": true,
+		"groups":         []interface{}{"operators"},
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"user", "admin"},
+		},
+		"resource_access": map[string]interface{}{
+			"backend": map[string]interface{}{
+				"roles": []interface{}{"reader"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		rules   Rules
+		wantErr error
+	}{
+		{
+			name:  "empty",
+			rules: Rules{},
+		},
+		{
+			name:  "all_satisfied",
+			rules: Rules{Roles: []string{"admin"}, Groups: []string{"operators"}, Scopes: []string{"email"}},
+		},
+		{
+			name:    "missing_role",
+			rules:   Rules{Roles: []string{"admin", "auditor"}},
+			wantErr: ErrMissingRole,
+		},
+		{
+			name:    "missing_group",
+			rules:   Rules{Groups: []string{"developers"}},
+			wantErr: ErrMissingGroup,
+		},
+		{
+			name:    "missing_scope",
+			rules:   Rules{Scopes: []string{"offline_access"}},
+			wantErr: ErrMissingScope,
+		},
+		{
+			name:  "custom_roles_claim",
+			rules: Rules{RolesClaim: "resource_access.backend.roles", Roles: []string{"reader"}},
+		},
+		{
+			name: "claims_satisfied",
+			rules: Rules{Claims: []ClaimMatcher{
+				{Claim: "azp", Operator: OperatorEquals, Value: "spa"},
+				{Claim: "email_verified", Operator: OperatorEquals, Value: "true"},
+				{Claim: "realm_access.roles", Operator: OperatorContains, Value: "admin"},
+				{Claim: "sub", Operator: OperatorExists},
+			}},
+		},
+		{
+			name:    "claim_not_equal",
+			rules:   Rules{Claims: []ClaimMatcher{{Claim: "azp", Operator: OperatorEquals, Value: "backend"}}},
+			wantErr: ErrClaimMismatch,
+		},
+		{
+			name:    "claim_equals_array",
+			rules:   Rules{Claims: []ClaimMatcher{{Claim: "groups", Operator: OperatorEquals, Value: "operators"}}},
+			wantErr: ErrClaimMismatch,
+		},
+		{
+			name:    "claim_missing",
+			rules:   Rules{Claims: []ClaimMatcher{{Claim: "realm_access.groups", Operator: OperatorExists}}},
+			wantErr: ErrClaimMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rules.Evaluate(claims); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Evaluate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gandalfmagic/go-token-handler/zlogger"
+
+	"go.uber.org/zap"
+)
+
+// defaultCertificateReloadInterval is the interval between the checks of the
+// certificate files.
+const defaultCertificateReloadInterval = 10 * time.Second
+
+// certificateReloader serves the certificate of a TLS listener, and loads it
+// again when the certificate or the key file changes.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// modTimes are the modification times of the loaded files
+	modTimes [2]time.Time
+}
+
+// newCertificateReloader loads the certificate, it fails if the files cannot
+// be read, or the key doesn't match the certificate.
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile}
+
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate returns the last certificate loaded, it's used as the
+// GetCertificate function of the tls.Config.
+func (r *certificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// reload loads the certificate if a file changed since the last load, it
+// returns true if the certificate was replaced. The previous certificate is
+// kept if the files cannot be loaded.
+func (r *certificateReloader) reload() (bool, error) {
+	var modTimes [2]time.Time
+
+	for i, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return false, fmt.Errorf("cannot read the tls certificate: %w", err)
+		}
+
+		modTimes[i] = info.ModTime()
+	}
+
+	r.mu.RLock()
+	changed := r.cert == nil || modTimes != r.modTimes
+	r.mu.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot load the tls certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = &cert
+	r.modTimes = modTimes
+
+	return true, nil
+}
+
+// watch checks the certificate files every interval, until the context is
+// done.
+func (r *certificateReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := r.reload()
+		if err != nil {
+			zlogger.FromContext(ctx).Error("cannot reload the tls certificate, the previous certificate is still used", zap.Error(err))
+			continue
+		}
+
+		if reloaded {
+			zlogger.FromContext(ctx).Info("the tls certificate has been reloaded", zap.String("file", r.certFile))
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gandalfmagic/go-token-handler/config"
+)
+
+func TestCertificateReloader(t *testing.T) {
+	firstCert, firstKey, first := writeTestCertificate(t, "first.example.com")
+	secondCert, secondKey, second := writeTestCertificate(t, "second.example.com")
+
+	reloader, err := newCertificateReloader(firstCert, firstKey)
+	if err != nil {
+		t.Fatalf("newCertificateReloader() fatal error = %v", err)
+	}
+
+	// copyFile replaces a file of the first certificate, with a later
+	// modification time
+	modTime := time.Now()
+	copyFile := func(src, dst string) {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatalf("ReadFile() fatal error = %v", err)
+		}
+
+		if err = os.WriteFile(dst, data, 0o600); err != nil {
+			t.Fatalf("WriteFile() fatal error = %v", err)
+		}
+
+		modTime = modTime.Add(time.Second)
+		if err = os.Chtimes(dst, modTime, modTime); err != nil {
+			t.Fatalf("Chtimes() fatal error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		change       func()
+		wantReloaded bool
+		wantErr      bool
+		wantSubject  string
+	}{
+		{name: "unchanged", change: func() {}, wantSubject: first.Subject.CommonName},
+		{
+			name: "key_mismatch",
+			change: func() {
+				copyFile(secondCert, firstCert)
+			},
+			wantErr:     true,
+			wantSubject: first.Subject.CommonName,
+		},
+		{
+			name: "changed",
+			change: func() {
+				copyFile(secondKey, firstKey)
+			},
+			wantReloaded: true,
+			wantSubject:  second.Subject.CommonName,
+		},
+		{
+			name: "missing_file",
+			change: func() {
+				if err := os.Remove(firstKey); err != nil {
+					t.Fatalf("Remove() fatal error = %v", err)
+				}
+			},
+			wantErr:     true,
+			wantSubject: second.Subject.CommonName,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change()
+
+			reloaded, err := reloader.reload()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if reloaded != tt.wantReloaded {
+				t.Errorf("reload() got = %v, want %v", reloaded, tt.wantReloaded)
+			}
+
+			cert, err := reloader.GetCertificate(nil)
+			if err != nil {
+				t.Fatalf("GetCertificate() fatal error = %v", err)
+			}
+
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatalf("ParseCertificate() fatal error = %v", err)
+			}
+
+			if leaf.Subject.CommonName != tt.wantSubject {
+				t.Errorf("GetCertificate() subject = %s, want %s", leaf.Subject.CommonName, tt.wantSubject)
+			}
+		})
+	}
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertificate(t, "token-handler.example.com")
+	clientCertFile, clientKeyFile, _ := writeTestCertificate(t, "client.example.com")
+	otherCertFile, otherKeyFile, _ := writeTestCertificate(t, "other.example.com")
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(cert)
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair() fatal error = %v", err)
+	}
+
+	// otherCert is not signed by the client CA
+	otherCert, err := tls.LoadX509KeyPair(otherCertFile, otherKeyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair() fatal error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		clientCA   string
+		clientAuth string
+		clientCert *tls.Certificate
+		wantErr    bool
+	}{
+		{name: "server_certificate", clientAuth: config.TLSClientAuthRequest},
+		{name: "request_client_certificate", clientCA: clientCertFile, clientAuth: config.TLSClientAuthRequest, clientCert: &clientCert},
+		{name: "request_missing_client_certificate", clientCA: clientCertFile, clientAuth: config.TLSClientAuthRequest},
+		{name: "request_invalid_client_certificate", clientCA: clientCertFile, clientAuth: config.TLSClientAuthRequest, clientCert: &otherCert, wantErr: true},
+		{name: "require_client_certificate", clientCA: clientCertFile, clientAuth: config.TLSClientAuthRequire, clientCert: &clientCert},
+		{name: "require_missing_client_certificate", clientCA: clientCertFile, clientAuth: config.TLSClientAuthRequire, wantErr: true},
+		{name: "require_invalid_client_certificate", clientCA: clientCertFile, clientAuth: config.TLSClientAuthRequire, clientCert: &otherCert, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := config.Config{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: tt.clientCA, TLSClientAuth: tt.clientAuth}
+
+			tlsConfig, err := newServerTLSConfig(newTestContext(t), c)
+			if err != nil {
+				t.Fatalf("newServerTLSConfig() fatal error = %v", err)
+			}
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(statusOKHandler))
+			server.EnableHTTP2 = true
+			server.TLS = tlsConfig
+			server.StartTLS()
+			t.Cleanup(server.Close)
+
+			clientTLSConfig := &tls.Config{RootCAs: rootCAs, ServerName: "token-handler.example.com"}
+			// The certificate is sent even if it's not signed by the CAs
+			// requested by the server
+			if tt.clientCert != nil {
+				clientTLSConfig.GetClientCertificate = func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return tt.clientCert, nil
+				}
+			}
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLSConfig, ForceAttemptHTTP2: true}}
+
+			resp, err := client.Get(server.URL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+
+			if resp.ProtoMajor != 2 {
+				t.Errorf("Get() protocol = %s, want HTTP/2.0", resp.Proto)
+			}
+		})
+	}
+}
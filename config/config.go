@@ -4,7 +4,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
@@ -23,8 +29,19 @@ const (
 	defaultOidcPostLoginRedirectURL  = ""
 	defaultOidcPostLogoutRedirectURL = ""
 	defaultListenAddr                = ":9080"
+	defaultTLSCertFile               = ""
+	defaultTLSKeyFile                = ""
+	defaultTLSClientCAFile           = ""
+	defaultTLSClientAuth             = TLSClientAuthRequest
+	defaultServerReadTimeout         = time.Duration(0)
+	defaultServerReadHeaderTimeout   = 10 * time.Second
+	defaultServerWriteTimeout        = time.Duration(0)
+	defaultServerIdleTimeout         = 2 * time.Minute
 	defaultCookieDomain              = "localhost"
 	defaultCookieName                = "session"
+	defaultCookiePath                = "/"
+	defaultCookieSameSite            = "strict"
+	defaultCookieSecure              = true
 	defaultSessionAuthSecret         = "my-secret-key-CHANGE-ME-IN-PROD!"
 	defaultSessionEncSecret          = ""
 	defaultSessionOldAuthSecret      = ""
@@ -37,6 +54,48 @@ const (
 	defaultDBName                    = ""
 	defaultDBUsername                = ""
 	defaultDBPassword                = ""
+	defaultDBDSN                     = ""
+	defaultDBPort                    = 0
+	defaultDBSSLMode                 = ""
+	defaultDBSSLRootCert             = ""
+	defaultDBSSLCert                 = ""
+	defaultDBSSLKey                  = ""
+	defaultDBSearchPath              = ""
+	defaultDBApplicationName         = ""
+	defaultDBMinConns                = 0
+	defaultDBMaxConns                = 10
+	defaultDBHealthCheckPeriod       = time.Minute
+	defaultDBConnectTimeout          = 5 * time.Second
+	defaultAdminListenAddr           = ""
+	defaultAdminToken                = ""
+	defaultAdminTLSCertFile          = ""
+	defaultAdminTLSKeyFile           = ""
+	defaultAdminTLSClientCAFile      = ""
+	defaultTokenRefreshSkew          = 30 * time.Second
+	defaultBackgroundRefreshInterval = time.Duration(0)
+	defaultBackgroundRefreshWindow   = 5 * time.Minute
+	defaultCORSAllowedOrigins        = ""
+	defaultCORSAllowedMethods        = "GET,HEAD,POST"
+	defaultCORSAllowedHeaders        = "Content-Type,X-CSRF-Token"
+	defaultCORSExposedHeaders        = ""
+	defaultCORSAllowCredentials      = true
+	defaultCORSMaxAge                = 10 * time.Minute
+	defaultCSRFProtection            = true
+	defaultLoginTimeout              = 5 * time.Minute
+	defaultSessionTimeout            = 30 * time.Minute
+	defaultSessionMaxLifetime        = 12 * time.Hour
+	defaultMigrateOnly               = false
+	defaultMigrateTargetConfig       = ""
+
+	// CommandMigrateSessions copies the sessions to the database configured
+	// in the migrate-target-config file, and exits
+	CommandMigrateSessions = "migrate-sessions"
+
+	// TLSClientAuthRequest verifies the client certificates of the main
+	// service only when the clients send them
+	TLSClientAuthRequest = "request"
+	// TLSClientAuthRequire refuses the clients without a valid certificate
+	TLSClientAuthRequire = "require"
 )
 
 var (
@@ -46,40 +105,137 @@ var (
 	ErrWrongAuthSecretSize             = errors.New("the session authentication secret should have a size of 32 or 64 bytes")
 	ErrWrongEncSecretSize              = errors.New("the session encryption secret should have a size of 16, 24 or 32 bytes")
 	ErrWrongEncDBKey                   = errors.New("the database encryption key must have a size of 32 bytes")
-	ErrWrongDBType                     = errors.New("the database backend must be a value from: sqlite, postgresql")
+	ErrWrongDBType                     = errors.New("the database backend must be a value from: sqlite, postgresql, redis, memory")
 	ErrMissingSQLiteDatabase           = errors.New("you must specify the database file name, using the db-name parameter")
 	ErrMissingDBServerHost             = errors.New("you must specify the database host, using the db-host parameter")
 	ErrMissingDBServerDatabase         = errors.New("you must specify the database name, using the db-name parameter")
 	ErrMissingDBServerUsername         = errors.New("you must specify the username to connect to the database, using the db-username parameter")
 	ErrMissingDBServerPassword         = errors.New("you must specify the password to connect to the database, using the db-password parameter")
+	ErrMemoryDBInProduction            = errors.New("the memory database backend shouldn't be used in production")
+	ErrWrongRedisDatabase              = errors.New("the redis database, specified using the db-name parameter, must be a non-negative number")
+	ErrMissingAdminAuthentication      = errors.New("the admin api requires an admin token or a client CA, using the admin-token or the admin-tls-client-ca-file parameters")
+	ErrMissingAdminTLSCertificate      = errors.New("the admin api requires both a certificate and a key to use tls, using the admin-tls-cert-file and admin-tls-key-file parameters")
+	ErrMissingTLSCertificate           = errors.New("the main service requires both a certificate and a key to use tls, using the tls-cert-file and tls-key-file parameters")
+	ErrWrongTLSClientAuth              = errors.New("the tls client auth must be a value from: request, require")
+	ErrWeakAdminToken                  = errors.New("the admin token should have a size of at least 32 bytes in production")
+	ErrNegativeDuration                = errors.New("the duration must not be negative")
+	ErrUnknownCommand                  = errors.New("the command must be empty, or a value from: migrate-sessions")
+	ErrMemoryDBMigration               = errors.New("the sessions cannot be migrated from or to the memory database backend")
+	ErrSameMigrationDatabase           = errors.New("the sessions cannot be migrated to the same database")
+	ErrNonPositiveDuration             = errors.New("the duration must be positive")
+	ErrWrongDBPoolSize                 = errors.New("the database pool size must be positive, and not less than the minimum number of connections")
+	ErrDBDSNConflict                   = errors.New("the db-dsn parameter cannot be used together with the other database connection parameters")
+	ErrWrongDBDSN                      = errors.New("the db-dsn parameter must be a postgresql url or a keyword/value connection string")
+	ErrWrongDBPort                     = errors.New("the database port must be between 1 and 65535, and the db-host must not contain a port")
+	ErrWrongDBSSLMode                  = errors.New("the database ssl mode must be a value from: disable, allow, prefer, require, verify-ca, verify-full")
+	ErrMissingDBSSLKeyPair             = errors.New("the database client certificate requires both the db-ssl-cert and the db-ssl-key parameters")
+	ErrDBSSLDisabled                   = errors.New("the database certificates cannot be used with the 'disable' ssl mode")
+	ErrWrongDBSearchPath               = errors.New("the database search path must be a comma separated list of schema names")
+	ErrWrongDBApplicationName          = errors.New("the database application name must contain at most 63 printable ascii characters")
+	ErrWrongCookieSameSite             = errors.New("the cookie same-site must be a value from: strict, lax, none")
+	ErrWrongCookiePath                 = errors.New("the cookie path must start with '/'")
+	ErrInsecureCookieInProduction      = errors.New("the session cookie must be secure in production")
+	ErrSameSiteNoneRequiresSecure      = errors.New("the cookie same-site 'none' requires a secure cookie")
+	ErrWrongSecurePrefixCookie         = errors.New("a cookie name with the __Secure- prefix requires a secure cookie")
+	ErrWrongHostPrefixCookie           = errors.New("a cookie name with the __Host- prefix requires a secure cookie, an empty cookie domain and the '/' cookie path")
+	ErrInsecureProxyTLSInProduction    = errors.New("the proxy tls insecure-skip-verify parameter shouldn't be used in production")
+	ErrMissingProxyTLSKeyPair          = errors.New("the proxy client certificate requires both the tls cert-file and key-file parameters")
+)
+
+var (
+	cookieSameSiteModes = map[string]http.SameSite{
+		"strict": http.SameSiteStrictMode,
+		"lax":    http.SameSiteLaxMode,
+		"none":   http.SameSiteNoneMode,
+	}
+
+	dbSSLModes = map[string]bool{
+		"disable":     true,
+		"allow":       true,
+		"prefer":      true,
+		"require":     true,
+		"verify-ca":   true,
+		"verify-full": true,
+	}
+
+	// dbSchemaName matches the unquoted schema names, and the special
+	// "$user" schema of the search path
+	dbSchemaName = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_$]*|\$user|"\$user")$`)
 )
 
 // Config stores all then configuration of the application.
 // The values are read by Viper from a configuration file or from environment variables.
 type Config struct {
-	IsProduction              bool   `mapstructure:"IS_PRODUCTION"`
-	LogLevel                  string `mapstructure:"LOG_LEVEL"`
-	OidcIssuer                string `mapstructure:"OIDC_ISSUER"`
-	OidcClientID              string `mapstructure:"OIDC_CLIENT_ID"`
-	OidcClientSecret          string `mapstructure:"OIDC_CLIENT_SECRET"`
-	OidcRedirectURL           string `mapstructure:"OIDC_REDIRECT_URL"`
-	OidcPostLoginRedirectURL  string `mapstructure:"OIDC_POST_LOGIN_REDIRECT_URL"`
-	OidcPostLogoutRedirectURL string `mapstructure:"OIDC_POST_LOGOUT_REDIRECT_URL"`
-	ListenAddr                string `mapstructure:"LISTEN_ADDR"`
-	CookieDomain              string `mapstructure:"COOKIE_DOMAIN"`
-	CookieName                string `mapstructure:"COOKIE_NAME"`
-	SessionAuthSecret         string `mapstructure:"SESSION_AUTH_SECRET"`
-	SessionEncSecret          string `mapstructure:"SESSION_ENC_SECRET"`
-	SessionOldAuthSecret      string `mapstructure:"SESSION_OLD_AUTH_SECRET"`
-	SessionOldEncSecret       string `mapstructure:"SESSION_OLD_ENC_SECRET"`
-	SessionDBKey              string `mapstructure:"SESSION_DB_KEY"`
-	SessionOldDBKey           string `mapstructure:"SESSION_OLD_DB_KEY"`
-	ProxyConfig               string `mapstructure:"PROXY_CONFIG"`
-	DBType                    string `mapstructure:"DB_TYPE"`
-	DBHost                    string `mapstructure:"DB_HOST"`
-	DBName                    string `mapstructure:"DB_NAME"`
-	DBUsername                string `mapstructure:"DB_USERNAME"`
-	DBPassword                string `mapstructure:"DB_PASSWORD"`
+	IsProduction              bool          `mapstructure:"IS_PRODUCTION"`
+	LogLevel                  string        `mapstructure:"LOG_LEVEL"`
+	OidcIssuer                string        `mapstructure:"OIDC_ISSUER"`
+	OidcClientID              string        `mapstructure:"OIDC_CLIENT_ID"`
+	OidcClientSecret          string        `mapstructure:"OIDC_CLIENT_SECRET"`
+	OidcRedirectURL           string        `mapstructure:"OIDC_REDIRECT_URL"`
+	OidcPostLoginRedirectURL  string        `mapstructure:"OIDC_POST_LOGIN_REDIRECT_URL"`
+	OidcPostLogoutRedirectURL string        `mapstructure:"OIDC_POST_LOGOUT_REDIRECT_URL"`
+	ListenAddr                string        `mapstructure:"LISTEN_ADDR"`
+	TLSCertFile               string        `mapstructure:"TLS_CERT_FILE"`
+	TLSKeyFile                string        `mapstructure:"TLS_KEY_FILE"`
+	TLSClientCAFile           string        `mapstructure:"TLS_CLIENT_CA_FILE"`
+	TLSClientAuth             string        `mapstructure:"TLS_CLIENT_AUTH"`
+	ServerReadTimeout         time.Duration `mapstructure:"SERVER_READ_TIMEOUT"`
+	ServerReadHeaderTimeout   time.Duration `mapstructure:"SERVER_READ_HEADER_TIMEOUT"`
+	ServerWriteTimeout        time.Duration `mapstructure:"SERVER_WRITE_TIMEOUT"`
+	ServerIdleTimeout         time.Duration `mapstructure:"SERVER_IDLE_TIMEOUT"`
+	CookieDomain              string        `mapstructure:"COOKIE_DOMAIN"`
+	CookieName                string        `mapstructure:"COOKIE_NAME"`
+	CookiePath                string        `mapstructure:"COOKIE_PATH"`
+	CookieSameSite            string        `mapstructure:"COOKIE_SAME_SITE"`
+	CookieSecure              bool          `mapstructure:"COOKIE_SECURE"`
+	SessionAuthSecret         string        `mapstructure:"SESSION_AUTH_SECRET"`
+	SessionEncSecret          string        `mapstructure:"SESSION_ENC_SECRET"`
+	SessionOldAuthSecret      string        `mapstructure:"SESSION_OLD_AUTH_SECRET"`
+	SessionOldEncSecret       string        `mapstructure:"SESSION_OLD_ENC_SECRET"`
+	SessionDBKey              string        `mapstructure:"SESSION_DB_KEY"`
+	SessionOldDBKey           string        `mapstructure:"SESSION_OLD_DB_KEY"`
+	ProxyConfig               string        `mapstructure:"PROXY_CONFIG"`
+	DBType                    string        `mapstructure:"DB_TYPE"`
+	DBHost                    string        `mapstructure:"DB_HOST"`
+	DBName                    string        `mapstructure:"DB_NAME"`
+	DBUsername                string        `mapstructure:"DB_USERNAME"`
+	DBPassword                string        `mapstructure:"DB_PASSWORD"`
+	DBDSN                     string        `mapstructure:"DB_DSN"`
+	DBPort                    int           `mapstructure:"DB_PORT"`
+	DBSSLMode                 string        `mapstructure:"DB_SSL_MODE"`
+	DBSSLRootCert             string        `mapstructure:"DB_SSL_ROOT_CERT"`
+	DBSSLCert                 string        `mapstructure:"DB_SSL_CERT"`
+	DBSSLKey                  string        `mapstructure:"DB_SSL_KEY"`
+	DBSearchPath              string        `mapstructure:"DB_SEARCH_PATH"`
+	DBApplicationName         string        `mapstructure:"DB_APPLICATION_NAME"`
+	DBMinConns                int32         `mapstructure:"DB_MIN_CONNS"`
+	DBMaxConns                int32         `mapstructure:"DB_MAX_CONNS"`
+	DBHealthCheckPeriod       time.Duration `mapstructure:"DB_HEALTH_CHECK_PERIOD"`
+	DBConnectTimeout          time.Duration `mapstructure:"DB_CONNECT_TIMEOUT"`
+	AdminListenAddr           string        `mapstructure:"ADMIN_LISTEN_ADDR"`
+	AdminToken                string        `mapstructure:"ADMIN_TOKEN"`
+	AdminTLSCertFile          string        `mapstructure:"ADMIN_TLS_CERT_FILE"`
+	AdminTLSKeyFile           string        `mapstructure:"ADMIN_TLS_KEY_FILE"`
+	AdminTLSClientCAFile      string        `mapstructure:"ADMIN_TLS_CLIENT_CA_FILE"`
+	TokenRefreshSkew          time.Duration `mapstructure:"TOKEN_REFRESH_SKEW"`
+	BackgroundRefreshInterval time.Duration `mapstructure:"BACKGROUND_REFRESH_INTERVAL"`
+	BackgroundRefreshWindow   time.Duration `mapstructure:"BACKGROUND_REFRESH_WINDOW"`
+	CORSAllowedOrigins        string        `mapstructure:"CORS_ALLOWED_ORIGINS"`
+	CORSAllowedMethods        string        `mapstructure:"CORS_ALLOWED_METHODS"`
+	CORSAllowedHeaders        string        `mapstructure:"CORS_ALLOWED_HEADERS"`
+	CORSExposedHeaders        string        `mapstructure:"CORS_EXPOSED_HEADERS"`
+	CORSAllowCredentials      bool          `mapstructure:"CORS_ALLOW_CREDENTIALS"`
+	CORSMaxAge                time.Duration `mapstructure:"CORS_MAX_AGE"`
+	CSRFProtection            bool          `mapstructure:"CSRF_PROTECTION"`
+	LoginTimeout              time.Duration `mapstructure:"LOGIN_TIMEOUT"`
+	SessionTimeout            time.Duration `mapstructure:"SESSION_TIMEOUT"`
+	SessionMaxLifetime        time.Duration `mapstructure:"SESSION_MAX_LIFETIME"`
+	MigrateOnly               bool          `mapstructure:"MIGRATE_ONLY"`
+	MigrateTargetConfig       string        `mapstructure:"MIGRATE_TARGET_CONFIG"`
+
+	// Command is the first positional argument, the service is started if
+	// it's empty
+	Command string `mapstructure:"-"`
 }
 
 // LoadConfig reads the configuration from a file or from environment variables.
@@ -93,8 +249,19 @@ func LoadConfig() (config Config, err error) {
 	viper.SetDefault("OIDC_POST_LOGIN_REDIRECT_URL", defaultOidcPostLoginRedirectURL)
 	viper.SetDefault("OIDC_POST_LOGOUT_REDIRECT_URL", defaultOidcPostLogoutRedirectURL)
 	viper.SetDefault("LISTEN_ADDR", defaultListenAddr)
+	viper.SetDefault("TLS_CERT_FILE", defaultTLSCertFile)
+	viper.SetDefault("TLS_KEY_FILE", defaultTLSKeyFile)
+	viper.SetDefault("TLS_CLIENT_CA_FILE", defaultTLSClientCAFile)
+	viper.SetDefault("TLS_CLIENT_AUTH", defaultTLSClientAuth)
+	viper.SetDefault("SERVER_READ_TIMEOUT", defaultServerReadTimeout)
+	viper.SetDefault("SERVER_READ_HEADER_TIMEOUT", defaultServerReadHeaderTimeout)
+	viper.SetDefault("SERVER_WRITE_TIMEOUT", defaultServerWriteTimeout)
+	viper.SetDefault("SERVER_IDLE_TIMEOUT", defaultServerIdleTimeout)
 	viper.SetDefault("COOKIE_DOMAIN", defaultCookieDomain)
 	viper.SetDefault("COOKIE_NAME", defaultCookieName)
+	viper.SetDefault("COOKIE_PATH", defaultCookiePath)
+	viper.SetDefault("COOKIE_SAME_SITE", defaultCookieSameSite)
+	viper.SetDefault("COOKIE_SECURE", defaultCookieSecure)
 	viper.SetDefault("SESSION_AUTH_SECRET", defaultSessionAuthSecret)
 	viper.SetDefault("SESSION_ENC_SECRET", defaultSessionEncSecret)
 	viper.SetDefault("SESSION_OLD_AUTH_SECRET", defaultSessionOldAuthSecret)
@@ -102,11 +269,27 @@ func LoadConfig() (config Config, err error) {
 	viper.SetDefault("SESSION_DB_KEY", defaultSessionDBKey)
 	viper.SetDefault("SESSION_OLD_DB_KEY", defaultSessionOldDBKey)
 	viper.SetDefault("PROXY_CONFIG", defaultProxyConfig)
-	viper.SetDefault("DB_TYPE", defaultDBType)
-	viper.SetDefault("DB_HOST", defaultDBHost)
-	viper.SetDefault("DB_NAME", defaultDBName)
-	viper.SetDefault("DB_USERNAME", defaultDBUsername)
-	viper.SetDefault("DB_PASSWORD", defaultDBPassword)
+	setDatabaseDefaults(viper.GetViper())
+	viper.SetDefault("ADMIN_LISTEN_ADDR", defaultAdminListenAddr)
+	viper.SetDefault("ADMIN_TOKEN", defaultAdminToken)
+	viper.SetDefault("ADMIN_TLS_CERT_FILE", defaultAdminTLSCertFile)
+	viper.SetDefault("ADMIN_TLS_KEY_FILE", defaultAdminTLSKeyFile)
+	viper.SetDefault("ADMIN_TLS_CLIENT_CA_FILE", defaultAdminTLSClientCAFile)
+	viper.SetDefault("TOKEN_REFRESH_SKEW", defaultTokenRefreshSkew)
+	viper.SetDefault("BACKGROUND_REFRESH_INTERVAL", defaultBackgroundRefreshInterval)
+	viper.SetDefault("BACKGROUND_REFRESH_WINDOW", defaultBackgroundRefreshWindow)
+	viper.SetDefault("CORS_ALLOWED_ORIGINS", defaultCORSAllowedOrigins)
+	viper.SetDefault("CORS_ALLOWED_METHODS", defaultCORSAllowedMethods)
+	viper.SetDefault("CORS_ALLOWED_HEADERS", defaultCORSAllowedHeaders)
+	viper.SetDefault("CORS_EXPOSED_HEADERS", defaultCORSExposedHeaders)
+	viper.SetDefault("CORS_ALLOW_CREDENTIALS", defaultCORSAllowCredentials)
+	viper.SetDefault("CORS_MAX_AGE", defaultCORSMaxAge)
+	viper.SetDefault("CSRF_PROTECTION", defaultCSRFProtection)
+	viper.SetDefault("LOGIN_TIMEOUT", defaultLoginTimeout)
+	viper.SetDefault("SESSION_TIMEOUT", defaultSessionTimeout)
+	viper.SetDefault("SESSION_MAX_LIFETIME", defaultSessionMaxLifetime)
+	viper.SetDefault("MIGRATE_ONLY", defaultMigrateOnly)
+	viper.SetDefault("MIGRATE_TARGET_CONFIG", defaultMigrateTargetConfig)
 	viper.AutomaticEnv()
 
 	flag.Bool("is-production", defaultIsProduction, "configure for a production environment")
@@ -118,8 +301,19 @@ func LoadConfig() (config Config, err error) {
 	flag.String("oidc-post-login-redirect-url", defaultOidcPostLoginRedirectURL, "where to redirect the client after a valid login")
 	flag.String("oidc-post-logout-redirect-url", defaultOidcPostLogoutRedirectURL, "where to redirect the client after a logout")
 	flag.String("listen-addr", defaultListenAddr, "define the address where the main service will listen on")
+	flag.String("tls-cert-file", defaultTLSCertFile, "the certificate file of the main service listener, reloaded when it changes")
+	flag.String("tls-key-file", defaultTLSKeyFile, "the key file of the main service listener, reloaded when it changes")
+	flag.String("tls-client-ca-file", defaultTLSClientCAFile, "the CA file used to verify the client certificates of the main service (disabled if empty)")
+	flag.String("tls-client-auth", defaultTLSClientAuth, "request or require the client certificates of the main service, when the tls-client-ca-file is set")
+	flag.Duration("server-read-timeout", defaultServerReadTimeout, "the maximum duration for reading a request of the main service, including the body (disabled if 0)")
+	flag.Duration("server-read-header-timeout", defaultServerReadHeaderTimeout, "the maximum duration for reading the headers of a request of the main service (disabled if 0)")
+	flag.Duration("server-write-timeout", defaultServerWriteTimeout, "the maximum duration for writing a response of the main service (disabled if 0)")
+	flag.Duration("server-idle-timeout", defaultServerIdleTimeout, "the maximum time to wait for the next request on a keep-alive connection (disabled if 0)")
 	flag.String("cookie-domain", defaultCookieDomain, "the domain for the session cookie")
-	flag.String("cookie-name", defaultCookieName, "the name of the session cookie")
+	flag.String("cookie-name", defaultCookieName, "the name of the session cookie, it can use the __Host- or the __Secure- prefix")
+	flag.String("cookie-path", defaultCookiePath, "the path of the session cookie")
+	flag.String("cookie-same-site", defaultCookieSameSite, "the same-site attribute of the session cookie (strict, lax, none)")
+	flag.Bool("cookie-secure", defaultCookieSecure, "set the secure attribute of the session cookie, disable it only for local development over http")
 	flag.String("session-auth-secret", defaultSessionAuthSecret, "the authentication key for the session cookie")
 	flag.String("session-enc-secret", defaultSessionEncSecret, "the encryption key for the session cookie")
 	flag.String("session-old-auth-secret", defaultSessionOldAuthSecret, "the old authentication key for the session cookie (rotation)")
@@ -127,12 +321,45 @@ func LoadConfig() (config Config, err error) {
 	flag.String("session-db-key", defaultSessionDBKey, "the encryption key for the session db storage")
 	flag.String("session-old-db-key", defaultSessionOldDBKey, "the old encryption key for the session db storage (rotation)")
 	flag.String("proxy-config", defaultProxyConfig, "the path to the proxy configuration file")
-	flag.String("db-type", defaultDBType, "the database backend used (postgresql, sqlite)")
+	flag.String("db-type", defaultDBType, "the database backend used (memory, postgresql, redis, sqlite)")
 	flag.String("db-host", defaultDBHost, "the database server hostname or ip address")
 	flag.String("db-name", defaultDBName, "the database name")
 	flag.String("db-username", defaultDBUsername, "the username to use to connect the database")
 	flag.String("db-password", defaultDBPassword, "the password to use to connect the database")
-
+	flag.String("db-dsn", defaultDBDSN, "the connection string of the database, instead of the other connection parameters (postgresql only)")
+	flag.Int("db-port", defaultDBPort, "the database server port (postgresql only, default 5432)")
+	flag.String("db-ssl-mode", defaultDBSSLMode, "the ssl mode of the database connections (postgresql only, default prefer)")
+	flag.String("db-ssl-root-cert", defaultDBSSLRootCert, "the CA file used to verify the database server certificate (postgresql only)")
+	flag.String("db-ssl-cert", defaultDBSSLCert, "the client certificate file of the database connections (postgresql only)")
+	flag.String("db-ssl-key", defaultDBSSLKey, "the client key file of the database connections (postgresql only)")
+	flag.String("db-search-path", defaultDBSearchPath, "the search path of the database connections, the tables are created in its first schema (postgresql only)")
+	flag.String("db-application-name", defaultDBApplicationName, "the application name of the database connections (postgresql only, default token-handler)")
+	flag.Int("db-min-conns", defaultDBMinConns, "the minimum number of connections kept open to the database (postgresql only)")
+	flag.Int("db-max-conns", defaultDBMaxConns, "the maximum number of connections opened to the database (postgresql only)")
+	flag.Duration("db-health-check-period", defaultDBHealthCheckPeriod, "the interval between the health checks of the idle database connections (postgresql only)")
+	flag.Duration("db-connect-timeout", defaultDBConnectTimeout, "the maximum time to wait for a new database connection (postgresql only)")
+	flag.String("admin-listen-addr", defaultAdminListenAddr, "the address where the admin api will listen on (disabled if empty)")
+	flag.String("admin-token", defaultAdminToken, "the static token required to access the admin api")
+	flag.String("admin-tls-cert-file", defaultAdminTLSCertFile, "the certificate file of the admin api listener")
+	flag.String("admin-tls-key-file", defaultAdminTLSKeyFile, "the key file of the admin api listener")
+	flag.String("admin-tls-client-ca-file", defaultAdminTLSClientCAFile, "the CA file used to verify the client certificates of the admin api")
+	flag.Duration("token-refresh-skew", defaultTokenRefreshSkew, "refresh the access token when it expires in less than this duration")
+	flag.Duration("background-refresh-interval", defaultBackgroundRefreshInterval, "the interval of the background refresh of the tokens (disabled if 0)")
+	flag.Duration("background-refresh-window", defaultBackgroundRefreshWindow, "the background refresh only renews the tokens of the sessions used in this window")
+	flag.String("cors-allowed-origins", defaultCORSAllowedOrigins, "comma separated list of the origins allowed by CORS (CORS disabled if empty)")
+	flag.String("cors-allowed-methods", defaultCORSAllowedMethods, "comma separated list of the methods allowed by CORS")
+	flag.String("cors-allowed-headers", defaultCORSAllowedHeaders, "comma separated list of the request headers allowed by CORS")
+	flag.String("cors-exposed-headers", defaultCORSExposedHeaders, "comma separated list of the response headers exposed by CORS")
+	flag.Bool("cors-allow-credentials", defaultCORSAllowCredentials, "allow the cross-origin requests to include the credentials (cookies)")
+	flag.Duration("cors-max-age", defaultCORSMaxAge, "how long the result of a CORS preflight request can be cached")
+	flag.Bool("csrf-protection", defaultCSRFProtection, "require a valid csrf token for the authenticated requests using an unsafe method")
+	flag.Duration("login-timeout", defaultLoginTimeout, "the time available to the user to complete the login")
+	flag.Duration("session-timeout", defaultSessionTimeout, "the idle timeout of the sessions, extended by every authenticated request")
+	flag.Duration("session-max-lifetime", defaultSessionMaxLifetime, "the maximum lifetime of the sessions, regardless of the activity (no limit if 0)")
+	flag.Bool("migrate-only", defaultMigrateOnly, "apply the migrations of the database schema, and exit without starting the service")
+	flag.String("migrate-target-config", defaultMigrateTargetConfig, "the configuration file of the target database of the migrate-sessions command")
+
+	pflag.CommandLine.SetNormalizeFunc(normalizeFlagName)
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 
@@ -151,44 +378,128 @@ func LoadConfig() (config Config, err error) {
 		return
 	}
 
+	config.Command = pflag.Arg(0)
+
 	return config.configValidate()
 }
 
-func (c Config) configValidate() (Config, error) {
-	if c.OidcIssuer == "" {
-		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-issuer")
+// normalizeFlagName replaces the dashes of the flag names with underscores, so
+// that every flag is bound to the configuration key with the same name, and
+// both --db-name and --db_name are accepted.
+func normalizeFlagName(_ *pflag.FlagSet, name string) pflag.NormalizedName {
+	return pflag.NormalizedName(strings.ReplaceAll(name, "-", "_"))
+}
+
+// setDatabaseDefaults sets the default values of the database parameters, that
+// are shared by the configuration of the service and by the configuration of
+// the target database of the migrate-sessions command.
+func setDatabaseDefaults(v *viper.Viper) {
+	v.SetDefault("DB_TYPE", defaultDBType)
+	v.SetDefault("DB_HOST", defaultDBHost)
+	v.SetDefault("DB_NAME", defaultDBName)
+	v.SetDefault("DB_USERNAME", defaultDBUsername)
+	v.SetDefault("DB_PASSWORD", defaultDBPassword)
+	v.SetDefault("DB_DSN", defaultDBDSN)
+	v.SetDefault("DB_PORT", defaultDBPort)
+	v.SetDefault("DB_SSL_MODE", defaultDBSSLMode)
+	v.SetDefault("DB_SSL_ROOT_CERT", defaultDBSSLRootCert)
+	v.SetDefault("DB_SSL_CERT", defaultDBSSLCert)
+	v.SetDefault("DB_SSL_KEY", defaultDBSSLKey)
+	v.SetDefault("DB_SEARCH_PATH", defaultDBSearchPath)
+	v.SetDefault("DB_APPLICATION_NAME", defaultDBApplicationName)
+	v.SetDefault("DB_MIN_CONNS", defaultDBMinConns)
+	v.SetDefault("DB_MAX_CONNS", defaultDBMaxConns)
+	v.SetDefault("DB_HEALTH_CHECK_PERIOD", defaultDBHealthCheckPeriod)
+	v.SetDefault("DB_CONNECT_TIMEOUT", defaultDBConnectTimeout)
+}
+
+// LoadMigrateTargetConfig reads the configuration of the target database of the
+// migrate-sessions command, from the env file specified by the
+// migrate-target-config parameter. The file contains the db-* parameters of the
+// target, and its session-db-key: the key of the source is used if it's not
+// set, a different key encrypts the tokens again.
+func (c Config) LoadMigrateTargetConfig() (Config, error) {
+	v := viper.New()
+	setDatabaseDefaults(v)
+	v.SetDefault("SESSION_DB_KEY", c.SessionDBKey)
+	v.SetConfigFile(c.MigrateTargetConfig)
+	v.SetConfigType("env")
+
+	if err := v.ReadInConfig(); err != nil {
+		return Config{}, fmt.Errorf("cannot read the migration target configuration: %w", err)
 	}
 
-	if c.OidcClientID == "" {
-		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-client-id")
+	// The parameters not related to the database are copied from the source
+	target := Config{IsProduction: c.IsProduction, SessionTimeout: c.SessionTimeout}
+	if err := v.Unmarshal(&target); err != nil {
+		return Config{}, fmt.Errorf("cannot read the migration target configuration: %w", err)
 	}
 
-	if c.OidcClientSecret == "" {
-		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-client-secret")
+	if target.SessionDBKey != "" && len(target.SessionDBKey) != 32 {
+		return target, fmt.Errorf("%w: %s", ErrWrongEncDBKey, "session-db-key")
 	}
 
-	if c.OidcRedirectURL == "" {
-		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-redirect-url")
+	target, err := target.databaseValidate()
+	if err != nil {
+		return target, err
 	}
 
-	if c.OidcPostLoginRedirectURL == "" {
-		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-post-login-redirect-url")
+	if target.DBType == "memory" {
+		return target, ErrMemoryDBMigration
 	}
 
-	if c.OidcPostLogoutRedirectURL == "" {
-		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-post-logout-redirect-url")
+	if target.DBType == c.DBType && target.DBHost == c.DBHost && target.DBPort == c.DBPort && target.DBName == c.DBName && target.DBDSN == c.DBDSN {
+		return target, ErrSameMigrationDatabase
+	}
+
+	return target, nil
+}
+
+func (c Config) configValidate() (Config, error) {
+	// The database tasks don't connect to the auth server
+	if !c.MigrateOnly && c.Command != CommandMigrateSessions {
+		if _, err := c.oidcValidate(); err != nil {
+			return c, err
+		}
 	}
 
 	if c.ListenAddr == "" {
 		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "listen-addr")
 	}
 
-	if c.CookieDomain == "" {
+	if c.CookieName == "" {
+		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "cookie-name")
+	}
+
+	// A cookie with the __Host- prefix is bound to the host, without a domain
+	hostPrefixCookie := strings.HasPrefix(c.CookieName, "__Host-")
+	if c.CookieDomain == "" && !hostPrefixCookie {
 		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "cookie-domain")
 	}
 
-	if c.CookieName == "" {
-		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "cookie-name")
+	c.CookieSameSite = strings.ToLower(c.CookieSameSite)
+	if _, ok := cookieSameSiteModes[c.CookieSameSite]; !ok {
+		return c, fmt.Errorf("%w: %s", ErrWrongCookieSameSite, c.CookieSameSite)
+	}
+
+	if !strings.HasPrefix(c.CookiePath, "/") {
+		return c, fmt.Errorf("%w: %s", ErrWrongCookiePath, c.CookiePath)
+	}
+
+	if !c.CookieSecure && c.IsProduction {
+		return c, ErrInsecureCookieInProduction
+	}
+
+	if !c.CookieSecure && c.CookieSameSite == "none" {
+		return c, ErrSameSiteNoneRequiresSecure
+	}
+
+	if !c.CookieSecure && strings.HasPrefix(c.CookieName, "__Secure-") {
+		return c, ErrWrongSecurePrefixCookie
+	}
+
+	if hostPrefixCookie && (!c.CookieSecure || c.CookieDomain != "" || c.CookiePath != "/") {
+		return c, ErrWrongHostPrefixCookie
 	}
 
 	if c.SessionAuthSecret == "" {
@@ -239,11 +550,146 @@ func (c Config) configValidate() (Config, error) {
 		return c, fmt.Errorf("%w: %s", ErrWrongEncDBKey, "session-old-db-key")
 	}
 
+	c, err := c.databaseValidate()
+	if err != nil {
+		return c, err
+	}
+
+	switch c.Command {
+	case "":
+	case CommandMigrateSessions:
+		if c.MigrateTargetConfig == "" {
+			return c, fmt.Errorf("%w: %s", ErrMissingParameter, "migrate-target-config")
+		}
+
+		// The sessions saved in memory cannot be read by another process
+		if c.DBType == "memory" {
+			return c, ErrMemoryDBMigration
+		}
+	default:
+		return c, fmt.Errorf("%w: %s", ErrUnknownCommand, c.Command)
+	}
+
+	if c.TokenRefreshSkew < 0 {
+		return c, fmt.Errorf("%w: %s", ErrNegativeDuration, "token-refresh-skew")
+	}
+
+	if c.BackgroundRefreshInterval < 0 {
+		return c, fmt.Errorf("%w: %s", ErrNegativeDuration, "background-refresh-interval")
+	}
+
+	if c.BackgroundRefreshInterval > 0 && c.BackgroundRefreshWindow <= 0 {
+		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "background-refresh-window")
+	}
+
+	if c.LoginTimeout <= 0 {
+		return c, fmt.Errorf("%w: %s", ErrNonPositiveDuration, "login-timeout")
+	}
+
+	if c.SessionTimeout <= 0 {
+		return c, fmt.Errorf("%w: %s", ErrNonPositiveDuration, "session-timeout")
+	}
+
+	if c.SessionMaxLifetime < 0 {
+		return c, fmt.Errorf("%w: %s", ErrNegativeDuration, "session-max-lifetime")
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return c, ErrMissingTLSCertificate
+	}
+
+	// The client certificates can only be verified using tls
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		return c, ErrMissingTLSCertificate
+	}
+
+	if c.TLSClientAuth != TLSClientAuthRequest && c.TLSClientAuth != TLSClientAuthRequire {
+		return c, fmt.Errorf("%w: %s", ErrWrongTLSClientAuth, c.TLSClientAuth)
+	}
+
+	for name, timeout := range map[string]time.Duration{
+		"server-read-timeout":        c.ServerReadTimeout,
+		"server-read-header-timeout": c.ServerReadHeaderTimeout,
+		"server-write-timeout":       c.ServerWriteTimeout,
+		"server-idle-timeout":        c.ServerIdleTimeout,
+	} {
+		if timeout < 0 {
+			return c, fmt.Errorf("%w: %s", ErrNegativeDuration, name)
+		}
+	}
+
+	if c.CORSMaxAge < 0 {
+		return c, fmt.Errorf("%w: %s", ErrNegativeDuration, "cors-max-age")
+	}
+
+	// The admin api is optional, but it must always be protected
+	if c.AdminListenAddr != "" {
+		if c.AdminToken == "" && c.AdminTLSClientCAFile == "" {
+			return c, ErrMissingAdminAuthentication
+		}
+
+		if (c.AdminTLSCertFile == "") != (c.AdminTLSKeyFile == "") {
+			return c, ErrMissingAdminTLSCertificate
+		}
+
+		// The client certificates can only be verified using tls
+		if c.AdminTLSClientCAFile != "" && c.AdminTLSCertFile == "" {
+			return c, ErrMissingAdminTLSCertificate
+		}
+
+		if c.AdminToken != "" && len(c.AdminToken) < 32 && c.IsProduction {
+			return c, ErrWeakAdminToken
+		}
+	}
+
+	return c, nil
+}
+
+// oidcValidate validates the parameters of the auth server, that are not
+// required by the database tasks.
+func (c Config) oidcValidate() (Config, error) {
+	if c.OidcIssuer == "" {
+		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-issuer")
+	}
+
+	if c.OidcClientID == "" {
+		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-client-id")
+	}
+
+	if c.OidcClientSecret == "" {
+		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-client-secret")
+	}
+
+	if c.OidcRedirectURL == "" {
+		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-redirect-url")
+	}
+
+	if c.OidcPostLoginRedirectURL == "" {
+		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-post-login-redirect-url")
+	}
+
+	if c.OidcPostLogoutRedirectURL == "" {
+		return c, fmt.Errorf("%w: %s", ErrMissingParameter, "oidc-post-logout-redirect-url")
+	}
+
+	return c, nil
+}
+
+// databaseValidate validates the database parameters, that are shared by the
+// configuration of the service and by the configuration of the target database
+// of the migrate-sessions command.
+func (c Config) databaseValidate() (Config, error) {
 	// The database backend must be supported
-	if c.DBType != "sqlite" && c.DBType != "postgresql" {
+	if c.DBType != "sqlite" && c.DBType != "postgresql" && c.DBType != "redis" && c.DBType != "memory" {
 		return c, ErrWrongDBType
 	}
 
+	// The sessions saved in memory are lost on restart, and are not shared
+	// between multiple instances
+	if c.DBType == "memory" && c.IsProduction {
+		return c, ErrMemoryDBInProduction
+	}
+
 	// For SQLite the db name must be populated (used as filename for the db)
 	if c.DBType == "sqlite" && c.DBName == "" {
 		return c, ErrMissingSQLiteDatabase
@@ -251,37 +697,242 @@ func (c Config) configValidate() (Config, error) {
 
 	// For Postgresql the db host must be populated
 	if c.DBType == "postgresql" {
-		if c.DBHost == "" {
-			return c, ErrMissingDBServerHost
+		if c.DBDSN != "" {
+			// The DSN contains all the connection parameters
+			if c.DBHost != "" || c.DBPort != 0 || c.DBName != "" || c.DBUsername != "" || c.DBPassword != "" ||
+				c.DBSSLMode != "" || c.DBSSLRootCert != "" || c.DBSSLCert != "" || c.DBSSLKey != "" || c.DBSearchPath != "" {
+				return c, ErrDBDSNConflict
+			}
+
+			if strings.HasPrefix(c.DBDSN, "postgres://") || strings.HasPrefix(c.DBDSN, "postgresql://") {
+				if _, err := url.Parse(c.DBDSN); err != nil {
+					return c, fmt.Errorf("%w: %s", ErrWrongDBDSN, err)
+				}
+			} else if !strings.Contains(c.DBDSN, "=") {
+				return c, ErrWrongDBDSN
+			}
+		} else {
+			if c.DBHost == "" {
+				return c, ErrMissingDBServerHost
+			}
+
+			if c.DBName == "" {
+				return c, ErrMissingDBServerDatabase
+			}
+
+			if c.DBUsername == "" {
+				return c, ErrMissingDBServerUsername
+			}
+
+			if c.DBPassword == "" {
+				return c, ErrMissingDBServerPassword
+			}
+
+			// The port can also be part of the host, but not both
+			if c.DBPort != 0 {
+				if _, _, err := net.SplitHostPort(c.DBHost); err == nil || c.DBPort < 0 || c.DBPort > 65535 {
+					return c, fmt.Errorf("%w: %d", ErrWrongDBPort, c.DBPort)
+				}
+			}
+
+			if c.DBSSLMode != "" && !dbSSLModes[c.DBSSLMode] {
+				return c, fmt.Errorf("%w: %s", ErrWrongDBSSLMode, c.DBSSLMode)
+			}
+
+			if (c.DBSSLCert == "") != (c.DBSSLKey == "") {
+				return c, ErrMissingDBSSLKeyPair
+			}
+
+			if c.DBSSLMode == "disable" && (c.DBSSLRootCert != "" || c.DBSSLCert != "") {
+				return c, ErrDBSSLDisabled
+			}
+
+			if c.DBSearchPath != "" {
+				for _, schema := range strings.Split(c.DBSearchPath, ",") {
+					if !dbSchemaName.MatchString(strings.TrimSpace(schema)) {
+						return c, fmt.Errorf("%w: %s", ErrWrongDBSearchPath, c.DBSearchPath)
+					}
+				}
+			}
+		}
+
+		if len(c.DBApplicationName) > 63 || strings.IndexFunc(c.DBApplicationName, func(r rune) bool { return r < 0x20 || r > 0x7e }) >= 0 {
+			return c, ErrWrongDBApplicationName
+		}
+
+		if c.DBMaxConns <= 0 || c.DBMinConns < 0 || c.DBMinConns > c.DBMaxConns {
+			return c, fmt.Errorf("%w: min %d, max %d", ErrWrongDBPoolSize, c.DBMinConns, c.DBMaxConns)
+		}
+
+		if c.DBHealthCheckPeriod <= 0 {
+			return c, fmt.Errorf("%w: %s", ErrNonPositiveDuration, "db-health-check-period")
 		}
 
-		if c.DBName == "" {
-			return c, ErrMissingDBServerDatabase
+		if c.DBConnectTimeout <= 0 {
+			return c, fmt.Errorf("%w: %s", ErrNonPositiveDuration, "db-connect-timeout")
 		}
+	}
 
-		if c.DBUsername == "" {
-			return c, ErrMissingDBServerUsername
+	// For Redis the db host must be populated, the db name is optional and
+	// contains the database number
+	if c.DBType == "redis" {
+		if c.DBHost == "" {
+			return c, ErrMissingDBServerHost
 		}
 
-		if c.DBPassword == "" {
-			return c, ErrMissingDBServerPassword
+		if c.DBName != "" {
+			if n, err := strconv.Atoi(c.DBName); err != nil || n < 0 {
+				return c, ErrWrongRedisDatabase
+			}
 		}
 	}
 
 	return c, nil
 }
 
+// RedisDatabase returns the number of the Redis database, read from the db-name
+// parameter. The default database is 0.
+func (c Config) RedisDatabase() int {
+	n, _ := strconv.Atoi(c.DBName)
+	return n
+}
+
+// CookieSameSiteMode returns the same-site attribute of the session cookie.
+func (c Config) CookieSameSiteMode() http.SameSite {
+	return cookieSameSiteModes[c.CookieSameSite]
+}
+
+// CORSConfigData contains the CORS configuration, the empty fields of the
+// configuration of a proxy are inherited from the global configuration.
+type CORSConfigData struct {
+	AllowedOrigins   []string       `yaml:"allowed-origins"`
+	AllowedMethods   []string       `yaml:"allowed-methods"`
+	AllowedHeaders   []string       `yaml:"allowed-headers"`
+	ExposedHeaders   []string       `yaml:"exposed-headers"`
+	AllowCredentials *bool          `yaml:"allow-credentials"`
+	MaxAge           *time.Duration `yaml:"max-age"`
+}
+
+// CORS returns the global CORS configuration.
+func (c Config) CORS() CORSConfigData {
+	return CORSConfigData{
+		AllowedOrigins:   splitList(c.CORSAllowedOrigins),
+		AllowedMethods:   splitList(c.CORSAllowedMethods),
+		AllowedHeaders:   splitList(c.CORSAllowedHeaders),
+		ExposedHeaders:   splitList(c.CORSExposedHeaders),
+		AllowCredentials: &c.CORSAllowCredentials,
+		MaxAge:           &c.CORSMaxAge,
+	}
+}
+
+// Override returns a copy of the configuration, with the fields set in the
+// override configuration replaced.
+func (d CORSConfigData) Override(o CORSConfigData) CORSConfigData {
+	if o.AllowedOrigins != nil {
+		d.AllowedOrigins = o.AllowedOrigins
+	}
+
+	if o.AllowedMethods != nil {
+		d.AllowedMethods = o.AllowedMethods
+	}
+
+	if o.AllowedHeaders != nil {
+		d.AllowedHeaders = o.AllowedHeaders
+	}
+
+	if o.ExposedHeaders != nil {
+		d.ExposedHeaders = o.ExposedHeaders
+	}
+
+	if o.AllowCredentials != nil {
+		d.AllowCredentials = o.AllowCredentials
+	}
+
+	if o.MaxAge != nil {
+		d.MaxAge = o.MaxAge
+	}
+
+	return d
+}
+
+// splitList splits a comma separated list, ignoring the empty values.
+func splitList(list string) []string {
+	values := make([]string, 0)
+
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
 type ProxyConfigData struct {
-	Proxies []struct {
-		Endpoint   string `yaml:"endpoint"`
-		Target     string `yaml:"target"`
-		Parameters struct {
-			IdleConnTimeout time.Duration `yaml:"idle-conn-timeout"`
-			MaxIdleConns    int           `yaml:"max-idle-conns"`
-			DialKeepAlive   time.Duration `yaml:"keep-alive"`
-			DialTimeout     time.Duration `yaml:"timeout"`
-		} `yaml:"parameters"`
-	} `yaml:"proxies"`
+	Proxies []ProxyEndpointData `yaml:"proxies"`
+}
+
+// ProxyEndpointData is the configuration of a proxy route.
+type ProxyEndpointData struct {
+	Endpoint string `yaml:"endpoint"`
+	// Target is the only target of the route, it's added to the Targets
+	Target        string   `yaml:"target"`
+	Targets       []string `yaml:"targets"`
+	LoadBalancing string   `yaml:"load-balancing"`
+	HealthCheck   struct {
+		Path     string        `yaml:"path"`
+		Interval time.Duration `yaml:"interval"`
+		Timeout  time.Duration `yaml:"timeout"`
+	} `yaml:"health-check"`
+	PassiveHealthCheck struct {
+		MaxFailures  int           `yaml:"max-failures"`
+		EjectionTime time.Duration `yaml:"ejection-time"`
+	} `yaml:"passive-health-check"`
+	// TLS configures the connections to the https targets
+	TLS struct {
+		CAFile             string `yaml:"ca-file"`
+		CertFile           string `yaml:"cert-file"`
+		KeyFile            string `yaml:"key-file"`
+		ServerName         string `yaml:"server-name"`
+		MinVersion         string `yaml:"min-version"`
+		InsecureSkipVerify bool   `yaml:"insecure-skip-verify"`
+	} `yaml:"tls"`
+	Retry struct {
+		Attempts int           `yaml:"attempts"`
+		Backoff  time.Duration `yaml:"backoff"`
+	} `yaml:"retry"`
+	StripPrefix string `yaml:"strip-prefix"`
+	Rewrite     struct {
+		Match   string `yaml:"match"`
+		Replace string `yaml:"replace"`
+	} `yaml:"rewrite"`
+	Parameters struct {
+		IdleConnTimeout     time.Duration `yaml:"idle-conn-timeout"`
+		MaxIdleConns        int           `yaml:"max-idle-conns"`
+		DialKeepAlive       time.Duration `yaml:"keep-alive"`
+		DialTimeout         time.Duration `yaml:"timeout"`
+		TLSHandshakeTimeout time.Duration `yaml:"tls-handshake-timeout"`
+		ResponseTimeout     time.Duration `yaml:"response-timeout"`
+		RequestTimeout      time.Duration `yaml:"request-timeout"`
+	} `yaml:"parameters"`
+	Authorization struct {
+		RolesClaim  string   `yaml:"roles-claim"`
+		GroupsClaim string   `yaml:"groups-claim"`
+		Roles       []string `yaml:"roles"`
+		Groups      []string `yaml:"groups"`
+		Scopes      []string `yaml:"scopes"`
+		Claims      []string `yaml:"claims"`
+	} `yaml:"authorization"`
+	CORS CORSConfigData `yaml:"cors"`
+}
+
+// TargetURLs returns all the targets of the route, the single target first.
+func (d ProxyEndpointData) TargetURLs() []string {
+	if d.Target == "" {
+		return d.Targets
+	}
+
+	return append([]string{d.Target}, d.Targets...)
 }
 
 func (c Config) ReadProxyConfig() (ProxyConfigData, error) {
@@ -297,5 +948,15 @@ func (c Config) ReadProxyConfig() (ProxyConfigData, error) {
 		return ProxyConfigData{}, err
 	}
 
+	for _, proxy := range data.Proxies {
+		if (proxy.TLS.CertFile == "") != (proxy.TLS.KeyFile == "") {
+			return ProxyConfigData{}, fmt.Errorf("%w: %s", ErrMissingProxyTLSKeyPair, proxy.Endpoint)
+		}
+
+		if proxy.TLS.InsecureSkipVerify && c.IsProduction {
+			return ProxyConfigData{}, fmt.Errorf("%w: %s", ErrInsecureProxyTLSInProduction, proxy.Endpoint)
+		}
+	}
+
 	return data, nil
 }
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func TestNormalizeFlagName(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		key  string
+		want string
+	}{
+		{name: "dashes", args: []string{"--db-name=sessions"}, key: "DB_NAME", want: "sessions"},
+		{name: "underscores", args: []string{"--db_name=sessions"}, key: "DB_NAME", want: "sessions"},
+		{name: "boolean", args: []string{"--migrate-only"}, key: "MIGRATE_ONLY", want: "true"},
+		{name: "default", key: "DB_NAME", want: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			fs.SetNormalizeFunc(normalizeFlagName)
+			fs.String("db-name", "default", "")
+			fs.Bool("migrate-only", false, "")
+
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatalf("Parse() fatal error = %v", err)
+			}
+
+			v := viper.New()
+			if err := v.BindPFlags(fs); err != nil {
+				t.Fatalf("BindPFlags() fatal error = %v", err)
+			}
+
+			if got := v.GetString(tt.key); got != tt.want {
+				t.Errorf("GetString(%s) got = %s, want %s", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_configValidate_DatabaseTasks(t *testing.T) {
+	// The configuration doesn't contain the oidc parameters
+	base := Config{
+		ListenAddr:        defaultListenAddr,
+		CookieName:        defaultCookieName,
+		CookieDomain:      defaultCookieDomain,
+		CookiePath:        defaultCookiePath,
+		CookieSameSite:    defaultCookieSameSite,
+		CookieSecure:      defaultCookieSecure,
+		SessionAuthSecret: defaultSessionAuthSecret,
+		SessionDBKey:      "01234567890123456789012345678901",
+		SessionTimeout:    defaultSessionTimeout,
+		LoginTimeout:      defaultLoginTimeout,
+		TLSClientAuth:     defaultTLSClientAuth,
+		DBType:            "sqlite",
+		DBName:            "sessions.db",
+	}
+
+	tests := []struct {
+		name         string
+		migrateOnly  bool
+		command      string
+		targetConfig string
+		wantErr      error
+	}{
+		{name: "service", wantErr: ErrMissingParameter},
+		{name: "migrate_only", migrateOnly: true},
+		{name: "migrate_sessions", command: CommandMigrateSessions, targetConfig: "target.env"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := base
+			c.MigrateOnly = tt.migrateOnly
+			c.Command = tt.command
+			c.MigrateTargetConfig = tt.targetConfig
+
+			if _, err := c.configValidate(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("configValidate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
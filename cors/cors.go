@@ -0,0 +1,189 @@
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidOrigin           = errors.New("the allowed origin is not valid")
+	ErrWildcardWithCredentials = errors.New("the wildcard origin cannot be used when the credentials are allowed")
+)
+
+var (
+	defaultAllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+)
+
+// Options configures the CORS policy of an endpoint. An empty AllowedOrigins
+// disables CORS, and the wildcard origin "*" allows any origin.
+type Options struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// Policy is a validated CORS configuration.
+type Policy struct {
+	anyOrigin        bool
+	origins          map[string]bool
+	methods          map[string]bool
+	headers          map[string]bool
+	allowMethods     string
+	allowHeaders     string
+	exposeHeaders    string
+	allowCredentials bool
+	maxAge           string
+}
+
+// NewPolicy validates the options and creates a new Policy, it returns nil if
+// the options don't contain any allowed origin.
+func NewPolicy(options Options) (*Policy, error) {
+	if len(options.AllowedOrigins) == 0 {
+		return nil, nil
+	}
+
+	p := &Policy{
+		origins:          make(map[string]bool),
+		methods:          make(map[string]bool),
+		headers:          make(map[string]bool),
+		allowCredentials: options.AllowCredentials,
+	}
+
+	for _, origin := range options.AllowedOrigins {
+		if origin == "*" {
+			p.anyOrigin = true
+			continue
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidOrigin, origin)
+		}
+
+		p.origins[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+	}
+
+	// The browsers refuse the credentials with a wildcard origin
+	if p.anyOrigin && p.allowCredentials {
+		return nil, ErrWildcardWithCredentials
+	}
+
+	allowedMethods := options.AllowedMethods
+	if len(allowedMethods) == 0 {
+		allowedMethods = defaultAllowedMethods
+	}
+
+	methods := make([]string, 0, len(allowedMethods))
+	for _, method := range allowedMethods {
+		method = strings.ToUpper(method)
+		methods = append(methods, method)
+		p.methods[method] = true
+	}
+
+	for _, header := range options.AllowedHeaders {
+		p.headers[http.CanonicalHeaderKey(header)] = true
+	}
+
+	p.allowMethods = strings.Join(methods, ", ")
+	p.allowHeaders = strings.Join(options.AllowedHeaders, ", ")
+	p.exposeHeaders = strings.Join(options.ExposedHeaders, ", ")
+
+	if options.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(options.MaxAge.Seconds()))
+	}
+
+	return p, nil
+}
+
+func (p *Policy) originAllowed(origin string) bool {
+	return p.anyOrigin || p.origins[strings.ToLower(origin)]
+}
+
+func (p *Policy) headersAllowed(requestHeaders string) bool {
+	for _, header := range strings.Split(requestHeaders, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !p.headers[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *Policy) setAllowOrigin(w http.ResponseWriter, origin string) {
+	// The allowed origins are echoed back, the wildcard is sent as is
+	if p.anyOrigin {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if p.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Middleware applies the CORS policy to the requests. The preflight requests
+// are answered directly, without calling the next handler, so they never
+// require an authentication. A nil Policy doesn't change the requests.
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			p.preflight(w, r, origin)
+			return
+		}
+
+		if !p.anyOrigin {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if origin != "" && p.originAllowed(origin) {
+			p.setAllowOrigin(w, origin)
+
+			if p.exposeHeaders != "" {
+				w.Header().Set("Access-Control-Expose-Headers", p.exposeHeaders)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *Policy) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	w.Header().Add("Vary", "Origin")
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	if origin == "" || !p.originAllowed(origin) || !p.methods[method] || !p.headersAllowed(r.Header.Get("Access-Control-Request-Headers")) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	p.setAllowOrigin(w, origin)
+	w.Header().Set("Access-Control-Allow-Methods", p.allowMethods)
+
+	if p.allowHeaders != "" {
+		w.Header().Set("Access-Control-Allow-Headers", p.allowHeaders)
+	}
+
+	if p.maxAge != "" {
+		w.Header().Set("Access-Control-Max-Age", p.maxAge)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
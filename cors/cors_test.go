@@ -0,0 +1,207 @@
+package cors
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		wantNil bool
+		wantErr error
+	}{
+		{name: "disabled", options: Options{}, wantNil: true},
+		{name: "valid", options: Options{AllowedOrigins: []string{"https://spa.example.com", "http://localhost:3000/"}, AllowCredentials: true}},
+		{name: "wildcard", options: Options{AllowedOrigins: []string{"*"}}},
+		{name: "wildcard_with_credentials", options: Options{AllowedOrigins: []string{"*"}, AllowCredentials: true}, wantErr: ErrWildcardWithCredentials},
+		{name: "missing_scheme", options: Options{AllowedOrigins: []string{"spa.example.com"}}, wantErr: ErrInvalidOrigin},
+		{name: "invalid_scheme", options: Options{AllowedOrigins: []string{"ftp://spa.example.com"}}, wantErr: ErrInvalidOrigin},
+		{name: "with_path", options: Options{AllowedOrigins: []string{"https://spa.example.com/app"}}, wantErr: ErrInvalidOrigin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewPolicy(tt.options)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr == nil && (got == nil) != tt.wantNil {
+				t.Errorf("NewPolicy() = %v, wantNil %v", got, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestPolicy_Middleware(t *testing.T) {
+	policy, err := NewPolicy(Options{
+		AllowedOrigins:   []string{"https://spa.example.com"},
+		AllowedMethods:   []string{"get", "post", "delete"},
+		AllowedHeaders:   []string{"Content-Type", "X-Requested-With"},
+		ExposedHeaders:   []string{"X-Request-Id"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewPolicy() fatal error = %v", err)
+	}
+
+	wildcard, err := NewPolicy(Options{AllowedOrigins: []string{"*"}})
+	if err != nil {
+		t.Fatalf("NewPolicy() fatal error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		policy      *Policy
+		method      string
+		headers     map[string]string
+		wantCode    int
+		wantNext    bool
+		wantHeaders map[string]string
+	}{
+		{
+			name:   "preflight",
+			policy: policy,
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                         "https://spa.example.com",
+				"Access-Control-Request-Method":  "DELETE",
+				"Access-Control-Request-Headers": "content-type, x-requested-with",
+			},
+			wantCode: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://spa.example.com",
+				"Access-Control-Allow-Methods":     "GET, POST, DELETE",
+				"Access-Control-Allow-Headers":     "Content-Type, X-Requested-With",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Max-Age":           "600",
+			},
+		},
+		{
+			name:   "preflight_origin_not_allowed",
+			policy: policy,
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                        "https://evil.example.com",
+				"Access-Control-Request-Method": "GET",
+			},
+			wantCode:    http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:   "preflight_method_not_allowed",
+			policy: policy,
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                        "https://spa.example.com",
+				"Access-Control-Request-Method": "PUT",
+			},
+			wantCode:    http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:   "preflight_header_not_allowed",
+			policy: policy,
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                         "https://spa.example.com",
+				"Access-Control-Request-Method":  "GET",
+				"Access-Control-Request-Headers": "Authorization",
+			},
+			wantCode:    http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:     "simple_request",
+			policy:   policy,
+			method:   http.MethodGet,
+			headers:  map[string]string{"Origin": "https://spa.example.com"},
+			wantCode: http.StatusOK,
+			wantNext: true,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://spa.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Expose-Headers":    "X-Request-Id",
+				"Vary":                             "Origin",
+			},
+		},
+		{
+			name:     "simple_request_origin_not_allowed",
+			policy:   policy,
+			method:   http.MethodGet,
+			headers:  map[string]string{"Origin": "https://evil.example.com"},
+			wantCode: http.StatusOK,
+			wantNext: true,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "",
+				"Vary":                        "Origin",
+			},
+		},
+		{
+			name:     "plain_options",
+			policy:   policy,
+			method:   http.MethodOptions,
+			wantCode: http.StatusOK,
+			wantNext: true,
+		},
+		{
+			name:     "wildcard",
+			policy:   wildcard,
+			method:   http.MethodGet,
+			headers:  map[string]string{"Origin": "https://any.example.com"},
+			wantCode: http.StatusOK,
+			wantNext: true,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "",
+				"Vary":                             "",
+			},
+		},
+		{
+			name:     "disabled",
+			policy:   nil,
+			method:   http.MethodGet,
+			headers:  map[string]string{"Origin": "https://spa.example.com"},
+			wantCode: http.StatusOK,
+			wantNext: true,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+
+			r := httptest.NewRequest(tt.method, "/api/items", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			w := httptest.NewRecorder()
+			tt.policy.Middleware(next).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Middleware() code = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if called != tt.wantNext {
+				t.Errorf("Middleware() next called = %v, want %v", called, tt.wantNext)
+			}
+
+			for k, v := range tt.wantHeaders {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("Middleware() header %s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package database
+
+import (
+	"context"
+	"fmt"
+)
+
+// CopySessions copies the sessions that are not expired from the source to the
+// target, keeping their ids so that the session cookies remain valid. The
+// tokens are decrypted with the cipher of the source, and encrypted again with
+// the cipher of the target. It returns the number of sessions copied.
+func CopySessions(ctx context.Context, source, target SessionImpl) (int64, error) {
+	var count int64
+
+	err := source.Export(ctx, func(id string, s SessionData) error {
+		if err := target.Import(ctx, id, s); err != nil {
+			return fmt.Errorf("cannot import the session %s: %w", id, err)
+		}
+
+		count++
+
+		return nil
+	})
+
+	return count, err
+}
@@ -4,13 +4,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/gandalfmagic/encryption"
 )
 
+// legacySessionTimeout is the idle timeout given to the sessions saved by the
+// previous versions, that don't have a session expiration. It's the default
+// session timeout of the previous versions.
+const legacySessionTimeout = 30 * time.Minute
+
 var (
-	ErrSessionsMismatch = errors.New("the old and new session do not match")
+	ErrSessionsMismatch   = errors.New("the old and new session do not match")
+	ErrInvalidSessionData = errors.New("the session data is not valid")
+	ErrVersionConflict    = errors.New("the session was modified by another request")
 )
 
 type SessionImpl interface {
@@ -18,8 +26,47 @@ type SessionImpl interface {
 	Add(context.Context, SessionData) (string, error)
 	Delete(context.Context, string) error
 	Get(context.Context, string) (SessionData, error)
+	// Update saves the session only if its Version matches the saved one, and
+	// increments the saved Version, otherwise it returns ErrVersionConflict.
+	// The SessionExpiresAt and AbsoluteExpiresAt of the session are not changed
 	Update(context.Context, string, SessionData) error
+	// Touch extends the idle timeout of a session, without changing its Version
+	Touch(ctx context.Context, id string, sessionExpiresAt time.Time) error
+	// Purge deletes the expired sessions, a session with an expired access
+	// token is not expired, and it's kept until its refresh
 	Purge(ctx context.Context) error
+	// DeleteBySubject deletes all the sessions of a user, and returns the
+	// number of sessions deleted
+	DeleteBySubject(ctx context.Context, subject string) (int64, error)
+	// DeleteBySID deletes all the sessions linked to a session of the auth
+	// server, and returns the number of sessions deleted
+	DeleteBySID(ctx context.Context, sid string) (int64, error)
+	// ListBySubject returns the details of all the sessions of a user that
+	// are not expired, sorted by expiration
+	ListBySubject(ctx context.Context, subject string) ([]SessionInfo, error)
+	// Count returns the number of sessions saved in the database that are not
+	// expired
+	Count(ctx context.Context) (int64, error)
+	// Export calls fn for every session that is not expired, with its id and
+	// its decrypted tokens, the iteration stops at the first error returned
+	// by fn
+	Export(ctx context.Context, fn func(id string, s SessionData) error) error
+	// Import saves a session with the specified id, replacing the session
+	// with the same id. The Version and the expirations of the session are
+	// saved unchanged
+	Import(ctx context.Context, id string, s SessionData) error
+}
+
+// SessionInfo contains the details of a session that can be shown to the
+// operators, the tokens are never included.
+type SessionInfo struct {
+	ID      string `json:"id"`
+	Subject string `json:"subject"`
+	SID     string `json:"sid,omitempty"`
+	// ExpiresAt is the expiration of the session, not of its access token:
+	// the idle timeout limited by the maximum lifetime, zero if the session
+	// doesn't expire
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 type SessionData struct {
@@ -27,7 +74,34 @@ type SessionData struct {
 	AccessToken  string
 	RefreshToken string
 	IDToken      string
-	ExpiresAt    time.Time
+	// ExpiresAt is the expiration of the access token, it's saved as
+	// token_expires_at
+	ExpiresAt time.Time
+	// SID is the id of the user session on the auth server, read from the
+	// `sid` claim of the id-token, it can be empty
+	SID string
+	// Version is incremented by every update, and it's used to detect the
+	// concurrent updates of the same session (optimistic locking)
+	Version int64
+	// SessionExpiresAt is the end of the idle timeout of the session, extended
+	// by the activity of the user up to AbsoluteExpiresAt, zero if the session
+	// has no idle timeout
+	SessionExpiresAt time.Time
+	// AbsoluteExpiresAt is the end of the maximum lifetime of the session, zero
+	// if the session has no maximum lifetime
+	AbsoluteExpiresAt time.Time
+}
+
+// sortSessionInfo sorts the sessions by expiration, for the backends that
+// cannot sort them in the query.
+func sortSessionInfo(sessions []SessionInfo) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].ExpiresAt.Equal(sessions[j].ExpiresAt) {
+			return sessions[i].ID < sessions[j].ID
+		}
+
+		return sessions[i].ExpiresAt.Before(sessions[j].ExpiresAt)
+	})
 }
 
 func (d SessionData) IsExpired() bool {
@@ -35,6 +109,76 @@ func (d SessionData) IsExpired() bool {
 	return now.After(d.ExpiresAt)
 }
 
+// IsSessionExpired returns true if the session reached its idle timeout, or
+// its maximum lifetime. The access token can be expired in a valid session.
+func (d SessionData) IsSessionExpired() bool {
+	now := time.Now()
+
+	if !d.SessionExpiresAt.IsZero() && now.After(d.SessionExpiresAt) {
+		return true
+	}
+
+	return !d.AbsoluteExpiresAt.IsZero() && now.After(d.AbsoluteExpiresAt)
+}
+
+// sessionExpiration returns the end of the idle timeout of a session, limited by
+// its maximum lifetime, zero if the session has neither of them.
+func sessionExpiration(sessionExpiresAt, absoluteExpiresAt time.Time) time.Time {
+	if !absoluteExpiresAt.IsZero() && (sessionExpiresAt.IsZero() || absoluteExpiresAt.Before(sessionExpiresAt)) {
+		return absoluteExpiresAt
+	}
+
+	return sessionExpiresAt
+}
+
+// ExpiresWithin returns true if the access token is expired, or it's going to
+// expire in the specified duration.
+func (d SessionData) ExpiresWithin(skew time.Duration) bool {
+	return time.Now().Add(skew).After(d.ExpiresAt)
+}
+
+// toUnix converts a time to the unix timestamp saved in the databases, the zero
+// time is saved as 0.
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// fromUnix converts a unix timestamp saved in the databases to a time, 0 is
+// converted to the zero time.
+func fromUnix(timestamp int64) time.Time {
+	if timestamp == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(timestamp, 0)
+}
+
+// validate enforces the same constraints of the sql schemas, for the
+// backends that don't have a schema.
+func (d SessionData) validate() error {
+	if d.Subject == "" {
+		return fmt.Errorf("%w: %s", ErrInvalidSessionData, "empty subject")
+	}
+
+	if d.AccessToken == "" {
+		return fmt.Errorf("%w: %s", ErrInvalidSessionData, "empty access token")
+	}
+
+	if d.RefreshToken == "" {
+		return fmt.Errorf("%w: %s", ErrInvalidSessionData, "empty refresh token")
+	}
+
+	if d.IDToken == "" {
+		return fmt.Errorf("%w: %s", ErrInvalidSessionData, "empty id token")
+	}
+
+	return nil
+}
+
 func encryptArgs(cipher encryption.HexCipher, s SessionData) (SessionData, error) {
 	if cipher == nil {
 		return s, nil
@@ -55,13 +199,11 @@ func encryptArgs(cipher encryption.HexCipher, s SessionData) (SessionData, error
 		return SessionData{}, fmt.Errorf("cannot encrypt id token: %w", err)
 	}
 
-	return SessionData{
-		Subject:      s.Subject,
-		AccessToken:  encAccessToken,
-		RefreshToken: encRefreshToken,
-		IDToken:      encIDToken,
-		ExpiresAt:    s.ExpiresAt,
-	}, nil
+	s.AccessToken = encAccessToken
+	s.RefreshToken = encRefreshToken
+	s.IDToken = encIDToken
+
+	return s, nil
 }
 
 func decryptArgs(cipher encryption.HexCipher, s SessionData) (SessionData, error) {
@@ -87,11 +229,9 @@ func decryptArgs(cipher encryption.HexCipher, s SessionData) (SessionData, error
 		return SessionData{}, fmt.Errorf("cannot decrypt id token: %w", err)
 	}
 
-	return SessionData{
-		Subject:      s.Subject,
-		AccessToken:  string(decAccessToken),
-		RefreshToken: string(decRefreshToken),
-		IDToken:      string(decIDToken),
-		ExpiresAt:    s.ExpiresAt,
-	}, nil
+	s.AccessToken = string(decAccessToken)
+	s.RefreshToken = string(decRefreshToken)
+	s.IDToken = string(decIDToken)
+
+	return s, nil
 }
@@ -13,6 +13,14 @@ import (
 var (
 	testSQLite     *sqlite
 	testPostgreSQL *postgresql
+
+	testPostgresqlConfig = PostgresqlConfig{
+		Host:     "127.0.0.1:5532",
+		Database: "sessions",
+		Username: "postgres",
+		Password: "postgres",
+		MaxConns: 10,
+	}
 )
 
 func TestMain(m *testing.M) {
@@ -43,7 +51,7 @@ func runDatabaseTests(m *testing.M) (code int, err error) {
 	}()
 
 	// Create PostgresSQL connection
-	postgresqlConn, err := NewPostgresqlSessionImpl(context.TODO(), nil, "127.0.0.1:5532", "sessions", "postgres", "postgres")
+	postgresqlConn, err := NewPostgresqlSessionImpl(context.TODO(), nil, testPostgresqlConfig)
 	if err != nil {
 		return -1, fmt.Errorf("could not create or connect to database: %w", err)
 	}
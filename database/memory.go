@@ -0,0 +1,414 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gandalfmagic/go-token-handler/opentelemetry"
+
+	"github.com/gandalfmagic/encryption"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+type memoryEntry struct {
+	data     SessionData
+	deadline time.Time
+}
+
+type memory struct {
+	mu       sync.RWMutex
+	sessions map[string]memoryEntry
+	cipher   encryption.HexCipher
+	ttl      time.Duration
+}
+
+// NewMemorySessionImpl creates a SessionImpl that keeps the sessions in memory,
+// it should only be used for development and tests. Every session expires
+// after the ttl, that is reset every time the session is added, updated or
+// touched.
+func NewMemorySessionImpl(_ context.Context, cipher encryption.HexCipher, ttl time.Duration) (SessionImpl, error) {
+	return &memory{sessions: make(map[string]memoryEntry), cipher: cipher, ttl: ttl}, nil
+}
+
+func (db *memory) CloseConnection(_ context.Context) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.sessions = make(map[string]memoryEntry)
+
+	return nil
+}
+
+func (db *memory) Add(ctx context.Context, s SessionData) (string, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.memory: INSERT")
+	if span != nil {
+		defer span.End()
+	}
+
+	id := uuid.New().String()
+
+	if span != nil {
+		span.SetAttributes(
+			attribute.String("db.table.id", id),
+			attribute.String("db.table.subject", s.Subject),
+			attribute.String("db.table.expires_at", s.ExpiresAt.String()))
+	}
+
+	if err := s.validate(); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: INSERT -> validate")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return "", err
+	}
+
+	enc, err := encryptArgs(db.cipher, s)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: INSERT -> encryptArgs")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return "", err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.sessions[id] = memoryEntry{data: enc, deadline: time.Now().Add(db.ttl)}
+
+	return id, nil
+}
+
+func (db *memory) Delete(ctx context.Context, id string) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.memory: DELETE")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.table.id", id))
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.sessions, id)
+
+	return nil
+}
+
+func (db *memory) Get(ctx context.Context, id string) (SessionData, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.memory: SELECT")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.table.id", id))
+	}
+
+	db.mu.RLock()
+	entry, ok := db.sessions[id]
+	db.mu.RUnlock()
+
+	// An expired session is not returned, even if it's not purged yet, the
+	// error is the same returned by the sql implementations
+	if !ok || time.Now().After(entry.deadline) {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: SELECT -> not found")
+		}
+
+		return SessionData{}, sql.ErrNoRows
+	}
+
+	return decryptArgs(db.cipher, entry.data)
+}
+
+func (db *memory) Update(ctx context.Context, id string, s SessionData) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.memory: UPDATE")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table.id", id),
+			attribute.String("db.table.subject", s.Subject),
+			attribute.String("db.table.expires_at", s.ExpiresAt.String()))
+	}
+
+	oldSession, err := db.Get(ctx, id)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: UPDATE -> Get")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	if s.Subject != oldSession.Subject {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: subject mismatch")
+		}
+
+		return ErrSessionsMismatch
+	}
+
+	if err = s.validate(); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: UPDATE -> validate")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	enc, err := encryptArgs(db.cipher, s)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: UPDATE -> encryptArgs")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// The session could expire after the Get, before the lock
+	old, ok := db.sessions[id]
+	if !ok || time.Now().After(old.deadline) {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: UPDATE -> not found")
+		}
+
+		return sql.ErrNoRows
+	}
+
+	if old.data.Version != s.Version {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: version conflict")
+		}
+
+		return ErrVersionConflict
+	}
+
+	enc.Version++
+	enc.SessionExpiresAt = old.data.SessionExpiresAt
+	enc.AbsoluteExpiresAt = old.data.AbsoluteExpiresAt
+	db.sessions[id] = memoryEntry{data: enc, deadline: time.Now().Add(db.ttl)}
+
+	return nil
+}
+
+func (db *memory) Touch(ctx context.Context, id string, sessionExpiresAt time.Time) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.memory: TOUCH")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table.id", id),
+			attribute.String("db.table.session_expires_at", sessionExpiresAt.String()))
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, ok := db.sessions[id]
+	if !ok || time.Now().After(entry.deadline) {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: TOUCH -> not found")
+		}
+
+		return sql.ErrNoRows
+	}
+
+	entry.data.SessionExpiresAt = sessionExpiresAt
+	entry.deadline = time.Now().Add(db.ttl)
+	db.sessions[id] = entry
+
+	return nil
+}
+
+func (db *memory) Purge(_ context.Context) error {
+	now := time.Now()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for id, entry := range db.sessions {
+		if now.After(entry.deadline) || entry.data.IsSessionExpired() {
+			delete(db.sessions, id)
+		}
+	}
+
+	return nil
+}
+
+func (db *memory) DeleteBySubject(ctx context.Context, subject string) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.memory: DELETE")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.table.subject", subject))
+	}
+
+	return db.deleteWhere(func(s SessionData) bool { return s.Subject == subject }), nil
+}
+
+func (db *memory) DeleteBySID(ctx context.Context, sid string) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.memory: DELETE")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.table.sid", sid))
+	}
+
+	if sid == "" {
+		return 0, nil
+	}
+
+	return db.deleteWhere(func(s SessionData) bool { return s.SID == sid }), nil
+}
+
+// deleteWhere deletes all the sessions matching the filter, and returns the
+// number of sessions deleted. The subject and the sid are not encrypted.
+func (db *memory) deleteWhere(filter func(SessionData) bool) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var count int64
+
+	for id, entry := range db.sessions {
+		if filter(entry.data) {
+			delete(db.sessions, id)
+			count++
+		}
+	}
+
+	return count
+}
+
+func (db *memory) ListBySubject(ctx context.Context, subject string) ([]SessionInfo, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.memory: SELECT")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.table.subject", subject))
+	}
+
+	now := time.Now()
+	sessions := make([]SessionInfo, 0)
+
+	db.mu.RLock()
+	for id, entry := range db.sessions {
+		if entry.data.Subject == subject && !now.After(entry.deadline) && !entry.data.IsSessionExpired() {
+			sessions = append(sessions, SessionInfo{ID: id, Subject: entry.data.Subject, SID: entry.data.SID, ExpiresAt: sessionExpiration(entry.data.SessionExpiresAt, entry.data.AbsoluteExpiresAt)})
+		}
+	}
+	db.mu.RUnlock()
+
+	sortSessionInfo(sessions)
+
+	return sessions, nil
+}
+
+func (db *memory) Export(ctx context.Context, fn func(id string, s SessionData) error) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.memory: SELECT")
+	if span != nil {
+		defer span.End()
+	}
+
+	now := time.Now()
+	sessions := make(map[string]SessionData)
+
+	// The sessions are copied, fn can use the same store
+	db.mu.RLock()
+	for id, entry := range db.sessions {
+		if !now.After(entry.deadline) && !entry.data.IsSessionExpired() {
+			sessions[id] = entry.data
+		}
+	}
+	db.mu.RUnlock()
+
+	for id, enc := range sessions {
+		s, err := decryptArgs(db.cipher, enc)
+		if err != nil {
+			if span != nil {
+				span.SetStatus(codes.Error, "session.memory: SELECT -> decryptArgs")
+				span.SetAttributes(attribute.String("error.message", err.Error()))
+			}
+
+			return fmt.Errorf("cannot export the session %s: %w", id, err)
+		}
+
+		if err = fn(id, s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *memory) Import(ctx context.Context, id string, s SessionData) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.memory: INSERT")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table.id", id),
+			attribute.String("db.table.subject", s.Subject),
+			attribute.String("db.table.expires_at", s.ExpiresAt.String()))
+	}
+
+	if err := s.validate(); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: INSERT -> validate")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	enc, err := encryptArgs(db.cipher, s)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.memory: INSERT -> encryptArgs")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.sessions[id] = memoryEntry{data: enc, deadline: time.Now().Add(db.ttl)}
+
+	return nil
+}
+
+func (db *memory) Count(ctx context.Context) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.memory: SELECT")
+	if span != nil {
+		defer span.End()
+	}
+
+	now := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var count int64
+
+	for _, entry := range db.sessions {
+		if !now.After(entry.deadline) && !entry.data.IsSessionExpired() {
+			count++
+		}
+	}
+
+	return count, nil
+}
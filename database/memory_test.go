@@ -0,0 +1,325 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gandalfmagic/encryption"
+)
+
+func newTestMemory(t *testing.T, cipher encryption.HexCipher) *memory {
+	t.Helper()
+
+	conn, err := NewMemorySessionImpl(context.TODO(), cipher, 30*time.Minute)
+	if err != nil {
+		t.Fatalf("NewMemorySessionImpl() fatal error = %v", err)
+	}
+
+	db, ok := conn.(*memory)
+	if !ok {
+		t.Fatalf("could not convert DB interface to *memory")
+	}
+
+	return db
+}
+
+func TestMemory_AddGet(t *testing.T) {
+	cipher, err := encryption.NewXChaCha20Cipher("0123456789abcdef0123456789abcdef", "")
+	if err != nil {
+		t.Fatalf("NewXChaCha20Cipher() fatal error = %v", err)
+	}
+
+	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
+
+	tests := []struct {
+		name    string
+		cipher  encryption.HexCipher
+		s       SessionData
+		wantErr bool
+	}{
+		{
+			name: "correct_data",
+			s:    SessionData{Subject: "user", ExpiresAt: validDate, IDToken: "id_token", RefreshToken: "refresh_token", AccessToken: "access_token"},
+		},
+		{
+			name:   "correct_data_encrypted",
+			cipher: cipher,
+			s:      SessionData{Subject: "user", ExpiresAt: validDate, IDToken: "id_token", RefreshToken: "refresh_token", AccessToken: "access_token"},
+		},
+		{
+			name:    "empty_subject",
+			s:       SessionData{ExpiresAt: validDate, IDToken: "id_token", RefreshToken: "refresh_token", AccessToken: "access_token"},
+			wantErr: true,
+		},
+		{
+			name:    "empty_refresh_token",
+			s:       SessionData{Subject: "user", ExpiresAt: validDate, IDToken: "id_token", AccessToken: "access_token"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestMemory(t, tt.cipher)
+
+			id, err := db.Add(context.TODO(), tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Add() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if tt.cipher != nil && db.sessions[id].data.AccessToken == tt.s.AccessToken {
+				t.Errorf("Add() the access token is not encrypted")
+			}
+
+			got, err := db.Get(context.TODO(), id)
+			if err != nil {
+				t.Fatalf("Get() reading added data, fatal error = %v, ", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.s) {
+				t.Errorf("Get() got = %v, want %v", got, tt.s)
+			}
+		})
+	}
+}
+
+func TestMemory_Update(t *testing.T) {
+	db := newTestMemory(t, nil)
+	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
+
+	id, err := db.Add(context.TODO(), SessionData{Subject: "subject_to_update", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: validDate})
+	if err != nil {
+		t.Fatalf("Add() fatal error = %v, ", err)
+	}
+
+	newData := SessionData{Subject: "subject_to_update", AccessToken: "at_1111", RefreshToken: "rt_1111", IDToken: "it_1111", ExpiresAt: validDate.Add(5 * time.Minute)}
+
+	// The expired session is not purged yet
+	expiredID, err := db.Add(context.TODO(), SessionData{Subject: "subject_to_update", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: validDate})
+	if err != nil {
+		t.Fatalf("Add() fatal error = %v, ", err)
+	}
+
+	db.mu.Lock()
+	expired := db.sessions[expiredID]
+	expired.deadline = time.Now().Add(-time.Second)
+	db.sessions[expiredID] = expired
+	db.mu.Unlock()
+
+	tests := []struct {
+		name    string
+		id      string
+		s       SessionData
+		wantErr error
+	}{
+		{
+			name: "valid",
+			id:   id,
+			s:    newData,
+		},
+		{
+			name:    "invalid_id",
+			id:      "NOT_VALID_ID",
+			s:       newData,
+			wantErr: sql.ErrNoRows,
+		},
+		{
+			name:    "expired",
+			id:      expiredID,
+			s:       newData,
+			wantErr: sql.ErrNoRows,
+		},
+		{
+			name:    "invalid_subject",
+			id:      id,
+			s:       SessionData{Subject: "wrong_subject", AccessToken: "at_1111", RefreshToken: "rt_1111", IDToken: "it_1111", ExpiresAt: validDate},
+			wantErr: ErrSessionsMismatch,
+		},
+		{
+			name:    "stale_version",
+			id:      id,
+			s:       newData,
+			wantErr: ErrVersionConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := db.Update(context.TODO(), tt.id, tt.s); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr == nil {
+				got, err := db.Get(context.TODO(), tt.id)
+				if err != nil {
+					t.Fatalf("Get() reading updated data, fatal error = %v, ", err)
+				}
+
+				want := tt.s
+				want.Version++
+
+				if got != want {
+					t.Errorf("Update() got = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemory_Purge(t *testing.T) {
+	db := newTestMemory(t, nil)
+
+	expiredID, err := db.Add(context.TODO(), SessionData{Subject: "exp_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Add() fatal error = %v, ", err)
+	}
+
+	// The session is valid even if its access token is expired
+	validID, err := db.Add(context.TODO(), SessionData{Subject: "valid_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: time.Now().Add(-5 * time.Minute), SessionExpiresAt: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("Add() fatal error = %v, ", err)
+	}
+
+	idleID, err := db.Add(context.TODO(), SessionData{Subject: "idle_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: time.Now(), SessionExpiresAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatalf("Add() fatal error = %v, ", err)
+	}
+
+	absoluteID, err := db.Add(context.TODO(), SessionData{Subject: "absolute_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: time.Now(), AbsoluteExpiresAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatalf("Add() fatal error = %v, ", err)
+	}
+
+	// Move the deadline of the session in the past
+	entry := db.sessions[expiredID]
+	entry.deadline = time.Now().Add(-time.Second)
+	db.sessions[expiredID] = entry
+
+	if _, err = db.Get(context.TODO(), expiredID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Get() an expired session should not be returned, error = %v", err)
+	}
+
+	if err = db.Purge(context.TODO()); err != nil {
+		t.Errorf("Purge() error = %v", err)
+	}
+
+	for _, id := range []string{expiredID, idleID, absoluteID} {
+		if _, ok := db.sessions[id]; ok {
+			t.Errorf("Purge() the expired session %s was not removed", id)
+		}
+	}
+
+	if _, ok := db.sessions[validID]; !ok {
+		t.Errorf("Purge() the valid session was removed")
+	}
+}
+
+func TestMemory_Concurrency(t *testing.T) {
+	db := newTestMemory(t, nil)
+	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			subject := fmt.Sprintf("subject_%d", i)
+
+			id, err := db.Add(context.TODO(), SessionData{Subject: subject, AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate})
+			if err != nil {
+				t.Errorf("Add() error = %v", err)
+				return
+			}
+
+			if err = db.Update(context.TODO(), id, SessionData{Subject: subject, AccessToken: "at_new", RefreshToken: "rt_new", IDToken: "it_new", ExpiresAt: validDate}); err != nil {
+				t.Errorf("Update() error = %v", err)
+			}
+
+			if err = db.Purge(context.TODO()); err != nil {
+				t.Errorf("Purge() error = %v", err)
+			}
+
+			if err = db.Delete(context.TODO(), id); err != nil {
+				t.Errorf("Delete() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(db.sessions) != 0 {
+		t.Errorf("the sessions should be all deleted, found %d", len(db.sessions))
+	}
+}
+
+func TestMemory_ConcurrentUpdates(t *testing.T) {
+	testConcurrentUpdates(t, newTestMemory(t, nil))
+}
+
+func TestMemory_DeleteBy(t *testing.T) {
+	testDeleteBy(t, func(t *testing.T) SessionImpl { return newTestMemory(t, nil) })
+}
+
+func TestMemory_ListCount(t *testing.T) {
+	testListCount(t, newTestMemory(t, nil))
+}
+
+func TestMemory_Touch(t *testing.T) {
+	testTouch(t, newTestMemory(t, nil))
+}
+
+func TestMemory_CopySessions(t *testing.T) {
+	sourceCipher, err := encryption.NewXChaCha20Cipher("0123456789abcdef0123456789abcdef", "")
+	if err != nil {
+		t.Fatalf("NewXChaCha20Cipher() fatal error = %v", err)
+	}
+
+	targetCipher, err := encryption.NewXChaCha20Cipher("fedcba9876543210fedcba9876543210", "")
+	if err != nil {
+		t.Fatalf("NewXChaCha20Cipher() fatal error = %v", err)
+	}
+
+	source := newTestMemory(t, sourceCipher)
+	target := newTestMemory(t, targetCipher)
+
+	ids := testCopySessions(t, source, target)
+
+	// The tokens are encrypted again with the key of the target
+	for _, id := range ids {
+		want, err := source.Get(context.TODO(), id)
+		if err != nil {
+			t.Fatalf("Get() fatal error = %v", err)
+		}
+
+		enc := target.sessions[id].data
+
+		if got, err := targetCipher.DecryptFromHexString(enc.AccessToken); err != nil || string(got) != want.AccessToken {
+			t.Errorf("CopySessions() the token cannot be decrypted by the target key, error = %v", err)
+		}
+
+		if got, err := sourceCipher.DecryptFromHexString(enc.AccessToken); err == nil && string(got) == want.AccessToken {
+			t.Errorf("CopySessions() the token can be decrypted by the source key")
+		}
+	}
+
+	// The export stops at the first error
+	exportErr := errors.New("export failed")
+	calls := 0
+
+	err = source.Export(context.TODO(), func(_ string, _ SessionData) error {
+		calls++
+		return exportErr
+	})
+	if !errors.Is(err, exportErr) || calls != 1 {
+		t.Errorf("Export() error = %v, calls = %d, want %v, 1 call", err, calls, exportErr)
+	}
+}
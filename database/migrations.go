@@ -0,0 +1,79 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrMigrationFailed = errors.New("cannot migrate the database schema")
+	ErrSchemaTooNew    = errors.New("the database schema is newer than the supported one")
+)
+
+// migration is a versioned change of the schema of a sql database. The
+// migrations are applied in order of version, and each version is applied only
+// once, its number is saved in the schema_version table.
+type migration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, tx migrationTx) error
+}
+
+// migrationTx is the transaction used to apply the migrations, the sql backends
+// hold a lock on the database until it's committed, so that the migrations are
+// applied by only one instance of the service.
+type migrationTx interface {
+	exec(ctx context.Context, query string, args ...interface{}) error
+	// schemaVersion creates the schema_version table if it doesn't exist, and
+	// returns the version of the last migration applied, 0 if none
+	schemaVersion(ctx context.Context) (int, error)
+	setSchemaVersion(ctx context.Context, m migration) error
+}
+
+// execMigration returns the up function of a migration that only executes
+// the queries.
+func execMigration(queries ...string) func(ctx context.Context, tx migrationTx) error {
+	return func(ctx context.Context, tx migrationTx) error {
+		for _, query := range queries {
+			if err := tx.exec(ctx, query); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// applyMigrations applies the migrations newer than the schema version of the
+// database, the migrations must be sorted by version. It returns the schema
+// version of the database after the migrations.
+func applyMigrations(ctx context.Context, tx migrationTx, migrations []migration) (int, error) {
+	current, err := tx.schemaVersion(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%w: cannot read the schema version: %s", ErrMigrationFailed, err)
+	}
+
+	// The database was migrated by a newer version of the service
+	if latest := migrations[len(migrations)-1].version; current > latest {
+		return current, fmt.Errorf("%w: version %d, supported %d", ErrSchemaTooNew, current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		if err = m.up(ctx, tx); err != nil {
+			return current, fmt.Errorf("%w: version %d (%s): %s", ErrMigrationFailed, m.version, m.description, err)
+		}
+
+		if err = tx.setSchemaVersion(ctx, m); err != nil {
+			return current, fmt.Errorf("%w: version %d (%s): %s", ErrMigrationFailed, m.version, m.description, err)
+		}
+
+		current = m.version
+	}
+
+	return current, nil
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testMigrationTx records the queries executed by the migrations.
+type testMigrationTx struct {
+	version int
+	applied []int
+	queries []string
+	failOn  string
+}
+
+func (t *testMigrationTx) exec(_ context.Context, query string, _ ...interface{}) error {
+	if query == t.failOn {
+		return errors.New("query failed")
+	}
+
+	t.queries = append(t.queries, query)
+
+	return nil
+}
+
+func (t *testMigrationTx) schemaVersion(_ context.Context) (int, error) {
+	return t.version, nil
+}
+
+func (t *testMigrationTx) setSchemaVersion(_ context.Context, m migration) error {
+	t.applied = append(t.applied, m.version)
+	t.version = m.version
+
+	return nil
+}
+
+func TestApplyMigrations(t *testing.T) {
+	migrations := []migration{
+		{version: 1, description: "first", up: execMigration("q1")},
+		{version: 2, description: "second", up: execMigration("q2a", "q2b")},
+		{version: 3, description: "third", up: execMigration("q3")},
+	}
+
+	tests := []struct {
+		name        string
+		tx          *testMigrationTx
+		wantVersion int
+		wantApplied []int
+		wantQueries []string
+		wantErr     error
+	}{
+		{
+			name:        "empty_database",
+			tx:          &testMigrationTx{},
+			wantVersion: 3,
+			wantApplied: []int{1, 2, 3},
+			wantQueries: []string{"q1", "q2a", "q2b", "q3"},
+		},
+		{
+			name:        "partially_migrated",
+			tx:          &testMigrationTx{version: 2},
+			wantVersion: 3,
+			wantApplied: []int{3},
+			wantQueries: []string{"q3"},
+		},
+		{
+			name:        "up_to_date",
+			tx:          &testMigrationTx{version: 3},
+			wantVersion: 3,
+		},
+		{
+			name:        "newer_schema",
+			tx:          &testMigrationTx{version: 4},
+			wantVersion: 4,
+			wantErr:     ErrSchemaTooNew,
+		},
+		{
+			name:        "failed_migration",
+			tx:          &testMigrationTx{failOn: "q2b"},
+			wantVersion: 1,
+			wantApplied: []int{1},
+			wantQueries: []string{"q1", "q2a"},
+			wantErr:     ErrMigrationFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyMigrations(context.TODO(), tt.tx, migrations)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("applyMigrations() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.wantVersion {
+				t.Errorf("applyMigrations() got = %d, want %d", got, tt.wantVersion)
+			}
+
+			if !reflect.DeepEqual(tt.tx.applied, tt.wantApplied) {
+				t.Errorf("applyMigrations() applied = %v, want %v", tt.tx.applied, tt.wantApplied)
+			}
+
+			if !reflect.DeepEqual(tt.tx.queries, tt.wantQueries) {
+				t.Errorf("applyMigrations() queries = %v, want %v", tt.tx.queries, tt.wantQueries)
+			}
+		})
+	}
+}
@@ -2,8 +2,8 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
-	"sync"
 	"time"
 
 	"github.com/gandalfmagic/go-token-handler/opentelemetry"
@@ -11,12 +11,15 @@ import (
 	"github.com/gandalfmagic/encryption"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 )
 
+// The tables are not qualified by the schema, they are created and used in the
+// first schema of the search_path of the connections
 const (
-	queryPostgresqlCreate = `CREATE TABLE IF NOT EXISTS public.sessions (
+	queryPostgresqlCreate = `CREATE TABLE IF NOT EXISTS sessions (
 		session_id varchar(36) NOT NULL,
 		subject varchar NOT NULL,
 		access_token varchar NOT NULL,
@@ -27,51 +30,150 @@ const (
 		CONSTRAINT sessions_subject_check CHECK (subject != ''),
 		CONSTRAINT sessions_access_token_check CHECK (access_token != ''),
 		CONSTRAINT sessions_refresh_token_check CHECK (refresh_token != ''),
-		CONSTRAINT sessions_id_token CHECK (id_token != ''));`
-	queryPostgresqlDelete = `DELETE FROM sessions WHERE session_id = $1`
-	queryPostgresqlInsert = `INSERT INTO sessions (session_id, subject, access_token, refresh_token, id_token, expires_at) VALUES ($1, $2, $3, $4, $5, $6)`
-	queryPostgresqlSelect = `SELECT subject, access_token, refresh_token, id_token, expires_at FROM sessions WHERE session_id = $1`
-	queryPostgresqlUpdate = `UPDATE sessions SET subject = $1, access_token = $2, refresh_token = $3, id_token = $4, expires_at = $5 WHERE session_id = $6`
-	queryPostgresqlPurge  = `DELETE FROM sessions WHERE expires_at < $1`
+		CONSTRAINT sessions_id_token CHECK (id_token != ''))`
+	queryPostgresqlAddSIDVersion = `ALTER TABLE sessions ADD COLUMN sid varchar NOT NULL DEFAULT '';
+		ALTER TABLE sessions ADD COLUMN version integer NOT NULL DEFAULT 0;
+		CREATE INDEX IF NOT EXISTS sessions_subject ON sessions (subject);
+		CREATE INDEX IF NOT EXISTS sessions_sid ON sessions (sid);`
+	queryPostgresqlRenameExpiresAt = `ALTER TABLE sessions RENAME COLUMN expires_at TO token_expires_at`
+	queryPostgresqlAddExpirations  = `ALTER TABLE sessions ADD COLUMN session_expires_at integer NOT NULL DEFAULT 0;
+		ALTER TABLE sessions ADD COLUMN absolute_expires_at integer NOT NULL DEFAULT 0;
+		CREATE INDEX IF NOT EXISTS sessions_session_expires_at ON sessions (session_expires_at);`
+	queryPostgresqlInitSession         = `UPDATE sessions SET session_expires_at = $1 WHERE session_expires_at = 0`
+	queryPostgresqlCreateSchemaVersion = `CREATE TABLE IF NOT EXISTS schema_version (
+		version integer NOT NULL,
+		description varchar NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now(),
+		CONSTRAINT schema_version_pkey PRIMARY KEY (version))`
+	queryPostgresqlSchemaVersion    = `SELECT COALESCE(MAX(version), 0) FROM schema_version`
+	queryPostgresqlSetSchemaVersion = `INSERT INTO schema_version (version, description) VALUES ($1, $2)`
+	queryPostgresqlMigrationLock    = `SELECT pg_advisory_xact_lock($1)`
+	queryPostgresqlDelete           = `DELETE FROM sessions WHERE session_id = $1`
+	queryPostgresqlDeleteSubject    = `DELETE FROM sessions WHERE subject = $1`
+	queryPostgresqlDeleteSID        = `DELETE FROM sessions WHERE sid = $1`
+	queryPostgresqlInsert           = `INSERT INTO sessions (session_id, subject, access_token, refresh_token, id_token, token_expires_at, sid, session_expires_at, absolute_expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	queryPostgresqlSelect           = `SELECT subject, access_token, refresh_token, id_token, token_expires_at, sid, version, session_expires_at, absolute_expires_at FROM sessions WHERE session_id = $1`
+	queryPostgresqlUpdate           = `UPDATE sessions SET subject = $1, access_token = $2, refresh_token = $3, id_token = $4, token_expires_at = $5, sid = $6, version = version + 1 WHERE session_id = $7 AND version = $8`
+	queryPostgresqlTouch            = `UPDATE sessions SET session_expires_at = $1 WHERE session_id = $2`
+	queryPostgresqlPurge            = `DELETE FROM sessions WHERE (session_expires_at > 0 AND session_expires_at < $1) OR (absolute_expires_at > 0 AND absolute_expires_at < $1)`
+	queryPostgresqlListSubject      = `SELECT session_id, subject, sid, CASE WHEN absolute_expires_at > 0 AND (session_expires_at = 0 OR absolute_expires_at < session_expires_at) THEN absolute_expires_at ELSE session_expires_at END AS expires_at FROM sessions WHERE subject = $1 AND (session_expires_at = 0 OR session_expires_at >= $2) AND (absolute_expires_at = 0 OR absolute_expires_at >= $2) ORDER BY expires_at, session_id`
+	queryPostgresqlCount            = `SELECT COUNT(*) FROM sessions WHERE (session_expires_at = 0 OR session_expires_at >= $1) AND (absolute_expires_at = 0 OR absolute_expires_at >= $1)`
+	queryPostgresqlExport           = `SELECT session_id, subject, access_token, refresh_token, id_token, token_expires_at, sid, version, session_expires_at, absolute_expires_at FROM sessions WHERE (session_expires_at = 0 OR session_expires_at >= $1) AND (absolute_expires_at = 0 OR absolute_expires_at >= $1)`
+	queryPostgresqlImport           = `INSERT INTO sessions (session_id, subject, access_token, refresh_token, id_token, token_expires_at, sid, version, session_expires_at, absolute_expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (session_id) DO UPDATE SET subject = EXCLUDED.subject, access_token = EXCLUDED.access_token, refresh_token = EXCLUDED.refresh_token, id_token = EXCLUDED.id_token,
+		token_expires_at = EXCLUDED.token_expires_at, sid = EXCLUDED.sid, version = EXCLUDED.version, session_expires_at = EXCLUDED.session_expires_at, absolute_expires_at = EXCLUDED.absolute_expires_at`
 )
 
 type postgresql struct {
-	conn   *pgx.Conn
+	pool   *pgxpool.Pool
 	cipher encryption.HexCipher
 }
 
-var (
-	pgInstance *postgresql
-	pgOnce     sync.Once
-)
+// NewPostgresqlSessionImpl creates a pool of connections to the PostgreSQL
+// database, and applies the migrations of its schema. Every call returns a new
+// instance, with its own pool, that must be closed by the caller.
+func NewPostgresqlSessionImpl(ctx context.Context, cipher encryption.HexCipher, c PostgresqlConfig) (SessionImpl, error) {
+	poolConfig, err := c.poolConfig()
+	if err != nil {
+		return nil, err
+	}
 
-func NewPostgresqlSessionImpl(ctx context.Context, cipher encryption.HexCipher, host, database, username, password string) (SessionImpl, error) {
-	var conn *pgx.Conn
-	var err error
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
 
-	pgOnce.Do(func() {
-		connStr := fmt.Sprintf("postgresql://%s:%s@%s/%s?sslmode=disable", username, password, host, database)
-		conn, err = pgx.Connect(ctx, connStr)
-		if err != nil {
-			return
-		}
+	// The pool connects lazily, the migrations fail if the database is not
+	// reachable
+	if _, err = migratePostgresql(ctx, pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
 
-		_, err = conn.Exec(context.TODO(), queryPostgresqlCreate)
-		if err != nil {
-			return
-		}
+	return &postgresql{pool: pool, cipher: cipher}, nil
+}
+
+// postgresqlMigrationLock is the key of the advisory lock held while the
+// migrations are applied, it's the same for all the instances of the service.
+const postgresqlMigrationLock int64 = 0x746f6b656e // "token"
+
+// postgresqlMigrations are the migrations of the PostgreSQL schema, sorted by
+// version.
+var postgresqlMigrations = []migration{
+	{version: 1, description: "create the sessions table", up: execMigration(queryPostgresqlCreate)},
+	{version: 2, description: "add the sid and version columns", up: execMigration(queryPostgresqlAddSIDVersion)},
+	{version: 3, description: "rename the expiration of the access token to token_expires_at", up: execMigration(queryPostgresqlRenameExpiresAt)},
+	{version: 4, description: "add the session and absolute expirations", up: postgresqlAddExpirations},
+}
+
+// postgresqlMigrationTx applies the migrations in a transaction, that holds an
+// advisory lock until it's committed.
+type postgresqlMigrationTx struct {
+	tx pgx.Tx
+}
+
+func (t postgresqlMigrationTx) exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := t.tx.Exec(ctx, query, args...)
+	return err
+}
+
+func (t postgresqlMigrationTx) queryInt(ctx context.Context, query string, args ...interface{}) (int, error) {
+	var value int
+	err := t.tx.QueryRow(ctx, query, args...).Scan(&value)
+	return value, err
+}
 
-		pgInstance = &postgresql{conn: conn, cipher: cipher}
-	})
+func (t postgresqlMigrationTx) schemaVersion(ctx context.Context) (int, error) {
+	if err := t.exec(ctx, queryPostgresqlCreateSchemaVersion); err != nil {
+		return 0, err
+	}
+
+	return t.queryInt(ctx, queryPostgresqlSchemaVersion)
+}
+
+func (t postgresqlMigrationTx) setSchemaVersion(ctx context.Context, m migration) error {
+	return t.exec(ctx, queryPostgresqlSetSchemaVersion, m.version, m.description)
+}
+
+// migratePostgresql applies the migrations of the schema, and returns the
+// schema version of the database.
+func migratePostgresql(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	tx, err := pool.Begin(ctx)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	// The other instances wait for the lock, and find the schema already
+	// migrated
+	if _, err = tx.Exec(ctx, queryPostgresqlMigrationLock, postgresqlMigrationLock); err != nil {
+		return 0, fmt.Errorf("%w: cannot acquire the lock: %s", ErrMigrationFailed, err)
+	}
+
+	version, err := applyMigrations(ctx, postgresqlMigrationTx{tx: tx}, postgresqlMigrations)
+	if err != nil {
+		return version, err
+	}
+
+	return version, tx.Commit(ctx)
+}
+
+// postgresqlAddExpirations adds the session and absolute expirations, the
+// sessions saved without an expiration get a new idle timeout, instead of being
+// purged together with their access token.
+func postgresqlAddExpirations(ctx context.Context, tx migrationTx) error {
+	if err := tx.exec(ctx, queryPostgresqlAddExpirations); err != nil {
+		return err
 	}
 
-	return pgInstance, err
+	return tx.exec(ctx, queryPostgresqlInitSession, time.Now().Add(legacySessionTimeout).Unix())
 }
 
-func (db *postgresql) CloseConnection(ctx context.Context) error {
-	return db.conn.Close(ctx)
+func (db *postgresql) CloseConnection(_ context.Context) error {
+	db.pool.Close()
+	return nil
 }
 
 func (db *postgresql) Add(ctx context.Context, s SessionData) (string, error) {
@@ -87,7 +189,7 @@ func (db *postgresql) Add(ctx context.Context, s SessionData) (string, error) {
 			attribute.String("db.table", "sessions"),
 			attribute.String("db.table.id", id),
 			attribute.String("db.table.subject", s.Subject),
-			attribute.String("db.table.expires_at", s.ExpiresAt.String()))
+			attribute.String("db.table.token_expires_at", s.ExpiresAt.String()))
 	}
 
 	enc, err := encryptArgs(db.cipher, s)
@@ -99,9 +201,9 @@ func (db *postgresql) Add(ctx context.Context, s SessionData) (string, error) {
 		return "", err
 	}
 
-	if _, err = db.conn.Exec(ctx, queryPostgresqlInsert, id, enc.Subject, enc.AccessToken, enc.RefreshToken, enc.IDToken, enc.ExpiresAt.Unix()); err != nil {
+	if _, err = db.pool.Exec(ctx, queryPostgresqlInsert, id, enc.Subject, enc.AccessToken, enc.RefreshToken, enc.IDToken, enc.ExpiresAt.Unix(), enc.SID, toUnix(enc.SessionExpiresAt), toUnix(enc.AbsoluteExpiresAt)); err != nil {
 		if span != nil {
-			span.SetStatus(codes.Error, "session.postgresql: INSERT -> db.conn.Exec")
+			span.SetStatus(codes.Error, "session.postgresql: INSERT -> db.pool.Exec")
 			span.SetAttributes(attribute.String("error.message", err.Error()))
 		}
 		return "", err
@@ -120,10 +222,10 @@ func (db *postgresql) Delete(ctx context.Context, id string) error {
 			attribute.String("db.table.id", id))
 	}
 
-	_, err := db.conn.Exec(ctx, queryPostgresqlDelete, id)
+	_, err := db.pool.Exec(ctx, queryPostgresqlDelete, id)
 	if err != nil {
 		if span != nil {
-			span.SetStatus(codes.Error, "session.postgresql: DELETE -> db.conn.Exec")
+			span.SetStatus(codes.Error, "session.postgresql: DELETE -> db.pool.Exec")
 			span.SetAttributes(attribute.String("error.message", err.Error()))
 		}
 
@@ -144,17 +246,19 @@ func (db *postgresql) Get(ctx context.Context, id string) (SessionData, error) {
 	}
 
 	s := SessionData{}
-	var expiresAt int64
+	var expiresAt, sessionExpiresAt, absoluteExpiresAt int64
 
-	if err := db.conn.QueryRow(ctx, queryPostgresqlSelect, id).Scan(&s.Subject, &s.AccessToken, &s.RefreshToken, &s.IDToken, &expiresAt); err != nil {
+	if err := db.pool.QueryRow(ctx, queryPostgresqlSelect, id).Scan(&s.Subject, &s.AccessToken, &s.RefreshToken, &s.IDToken, &expiresAt, &s.SID, &s.Version, &sessionExpiresAt, &absoluteExpiresAt); err != nil {
 		if span != nil {
-			span.SetStatus(codes.Error, "session.postgresql: INSERT -> db.conn.QueryRow")
+			span.SetStatus(codes.Error, "session.postgresql: INSERT -> db.pool.QueryRow")
 			span.SetAttributes(attribute.String("error.message", err.Error()))
 		}
 		return SessionData{}, err
 	}
 
 	s.ExpiresAt = time.Unix(expiresAt, 0)
+	s.SessionExpiresAt = fromUnix(sessionExpiresAt)
+	s.AbsoluteExpiresAt = fromUnix(absoluteExpiresAt)
 
 	return decryptArgs(db.cipher, s)
 }
@@ -168,7 +272,7 @@ func (db *postgresql) Update(ctx context.Context, id string, s SessionData) erro
 			attribute.String("db.table", "sessions"),
 			attribute.String("db.table.id", id),
 			attribute.String("db.table.subject", s.Subject),
-			attribute.String("db.table.expires_at", s.ExpiresAt.String()))
+			attribute.String("db.table.token_expires_at", s.ExpiresAt.String()))
 	}
 
 	oldSession, err := db.Get(ctx, id)
@@ -199,23 +303,267 @@ func (db *postgresql) Update(ctx context.Context, id string, s SessionData) erro
 		return err
 	}
 
-	_, err = db.conn.Exec(ctx, queryPostgresqlUpdate, enc.Subject, enc.AccessToken, enc.RefreshToken, enc.IDToken, enc.ExpiresAt.Unix(), id)
+	tag, err := db.pool.Exec(ctx, queryPostgresqlUpdate, enc.Subject, enc.AccessToken, enc.RefreshToken, enc.IDToken, enc.ExpiresAt.Unix(), enc.SID, id, s.Version)
 	if err != nil {
 		if span != nil {
-			span.SetStatus(codes.Error, "session.postgresql: UPDATE -> db.conn.Exec")
+			span.SetStatus(codes.Error, "session.postgresql: UPDATE -> db.pool.Exec")
 			span.SetAttributes(attribute.String("error.message", err.Error()))
 		}
 
 		return err
 	}
 
+	// The session exists, so the version was changed by another update
+	if tag.RowsAffected() == 0 {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.postgresql: version conflict")
+		}
+
+		return ErrVersionConflict
+	}
+
+	return nil
+}
+
+func (db *postgresql) Touch(ctx context.Context, id string, sessionExpiresAt time.Time) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.postgresql: UPDATE")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table", "sessions"),
+			attribute.String("db.table.id", id),
+			attribute.String("db.table.session_expires_at", sessionExpiresAt.String()))
+	}
+
+	tag, err := db.pool.Exec(ctx, queryPostgresqlTouch, toUnix(sessionExpiresAt), id)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.postgresql: UPDATE -> db.pool.Exec")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return sql.ErrNoRows
+	}
+
 	return nil
 }
 
 func (db *postgresql) Purge(ctx context.Context) error {
 	now := time.Now().Unix()
 
-	if _, err := db.conn.Exec(ctx, queryPostgresqlPurge, now); err != nil {
+	if _, err := db.pool.Exec(ctx, queryPostgresqlPurge, now); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *postgresql) DeleteBySubject(ctx context.Context, subject string) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.postgresql: DELETE")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table", "sessions"),
+			attribute.String("db.table.subject", subject))
+	}
+
+	tag, err := db.pool.Exec(ctx, queryPostgresqlDeleteSubject, subject)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.postgresql: DELETE -> db.pool.Exec")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+func (db *postgresql) DeleteBySID(ctx context.Context, sid string) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.postgresql: DELETE")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table", "sessions"),
+			attribute.String("db.table.sid", sid))
+	}
+
+	// An empty sid is saved for the sessions without a sid claim
+	if sid == "" {
+		return 0, nil
+	}
+
+	tag, err := db.pool.Exec(ctx, queryPostgresqlDeleteSID, sid)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.postgresql: DELETE -> db.pool.Exec")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+func (db *postgresql) ListBySubject(ctx context.Context, subject string) ([]SessionInfo, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.postgresql: SELECT")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table", "sessions"),
+			attribute.String("db.table.subject", subject))
+	}
+
+	// The expired sessions that are not purged yet are not listed
+	rows, err := db.pool.Query(ctx, queryPostgresqlListSubject, subject, time.Now().Unix())
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.postgresql: SELECT -> db.pool.Query")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]SessionInfo, 0)
+
+	for rows.Next() {
+		var s SessionInfo
+		var expiresAt int64
+
+		if err = rows.Scan(&s.ID, &s.Subject, &s.SID, &expiresAt); err != nil {
+			if span != nil {
+				span.SetStatus(codes.Error, "session.postgresql: SELECT -> rows.Scan")
+				span.SetAttributes(attribute.String("error.message", err.Error()))
+			}
+
+			return nil, err
+		}
+
+		s.ExpiresAt = fromUnix(expiresAt)
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (db *postgresql) Count(ctx context.Context) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.postgresql: SELECT")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.table", "sessions"))
+	}
+
+	var count int64
+
+	// The expired sessions that are not purged yet are not counted
+	if err := db.pool.QueryRow(ctx, queryPostgresqlCount, time.Now().Unix()).Scan(&count); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.postgresql: SELECT -> db.pool.QueryRow")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (db *postgresql) Export(ctx context.Context, fn func(id string, s SessionData) error) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.postgresql: SELECT")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.table", "sessions"))
+	}
+
+	rows, err := db.pool.Query(ctx, queryPostgresqlExport, time.Now().Unix())
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.postgresql: SELECT -> db.pool.Query")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var enc SessionData
+		var expiresAt, sessionExpiresAt, absoluteExpiresAt int64
+
+		if err = rows.Scan(&id, &enc.Subject, &enc.AccessToken, &enc.RefreshToken, &enc.IDToken, &expiresAt, &enc.SID, &enc.Version, &sessionExpiresAt, &absoluteExpiresAt); err != nil {
+			if span != nil {
+				span.SetStatus(codes.Error, "session.postgresql: SELECT -> rows.Scan")
+				span.SetAttributes(attribute.String("error.message", err.Error()))
+			}
+
+			return err
+		}
+
+		enc.ExpiresAt = time.Unix(expiresAt, 0)
+		enc.SessionExpiresAt = fromUnix(sessionExpiresAt)
+		enc.AbsoluteExpiresAt = fromUnix(absoluteExpiresAt)
+
+		s, err := decryptArgs(db.cipher, enc)
+		if err != nil {
+			if span != nil {
+				span.SetStatus(codes.Error, "session.postgresql: SELECT -> decryptArgs")
+				span.SetAttributes(attribute.String("error.message", err.Error()))
+			}
+
+			return fmt.Errorf("cannot export the session %s: %w", id, err)
+		}
+
+		if err = fn(id, s); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *postgresql) Import(ctx context.Context, id string, s SessionData) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.postgresql: INSERT")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table", "sessions"),
+			attribute.String("db.table.id", id),
+			attribute.String("db.table.subject", s.Subject),
+			attribute.String("db.table.token_expires_at", s.ExpiresAt.String()))
+	}
+
+	enc, err := encryptArgs(db.cipher, s)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.postgresql: INSERT -> encryptArgs")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	if _, err = db.pool.Exec(ctx, queryPostgresqlImport, id, enc.Subject, enc.AccessToken, enc.RefreshToken, enc.IDToken, enc.ExpiresAt.Unix(), enc.SID, enc.Version, toUnix(enc.SessionExpiresAt), toUnix(enc.AbsoluteExpiresAt)); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.postgresql: INSERT -> db.pool.Exec")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
 		return err
 	}
 
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// defaultPostgresqlSSLMode uses TLS when the server supports it, like the
+	// other PostgreSQL clients
+	defaultPostgresqlSSLMode         = "prefer"
+	defaultPostgresqlApplicationName = "token-handler"
+)
+
+// PostgresqlConfig contains the parameters of the connection pool. The
+// connection can be configured using a DSN, or using the other parameters.
+type PostgresqlConfig struct {
+	// DSN is a connection string in the URL or in the keyword/value format,
+	// when it's set the other connection parameters must be empty
+	DSN      string
+	Host     string
+	Port     int
+	Database string
+	Username string
+	Password string
+	// SSLMode is one of disable, allow, prefer, require, verify-ca and
+	// verify-full, the default is prefer
+	SSLMode string
+	// SSLRootCert is the file of the CAs used to verify the server certificate
+	SSLRootCert string
+	// SSLCert and SSLKey are the files of the client certificate
+	SSLCert string
+	SSLKey  string
+	// SearchPath is the search_path of the connections, the tables are
+	// created in the first schema of the path
+	SearchPath string
+	// ApplicationName is shown in the pg_stat_activity view, the default is
+	// token-handler
+	ApplicationName string
+	// MinConns is the number of connections kept open by the pool, even when
+	// they are idle
+	MinConns int32
+	// MaxConns is the maximum number of connections opened by the pool, the
+	// requests wait for a free connection when they are all in use
+	MaxConns int32
+	// HealthCheckPeriod is the interval between the checks of the idle
+	// connections, the broken connections are closed and replaced
+	HealthCheckPeriod time.Duration
+	// ConnectTimeout is the maximum time to wait for a new connection
+	ConnectTimeout time.Duration
+}
+
+// connString returns the DSN, or a connection URL built from the other
+// parameters. The username, the password and the other values are escaped.
+func (c PostgresqlConfig) connString() string {
+	if c.DSN != "" {
+		return c.DSN
+	}
+
+	host := c.Host
+	if c.Port != 0 {
+		host = net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	}
+
+	sslMode := c.SSLMode
+	if sslMode == "" {
+		sslMode = defaultPostgresqlSSLMode
+	}
+
+	query := url.Values{}
+	query.Set("sslmode", sslMode)
+
+	for key, value := range map[string]string{
+		"sslrootcert": c.SSLRootCert,
+		"sslcert":     c.SSLCert,
+		"sslkey":      c.SSLKey,
+		"search_path": c.SearchPath,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+
+	u := url.URL{
+		Scheme:   "postgresql",
+		User:     url.UserPassword(c.Username, c.Password),
+		Host:     host,
+		Path:     "/" + c.Database,
+		RawQuery: query.Encode(),
+	}
+
+	return u.String()
+}
+
+// poolConfig returns the configuration of the connection pool, it fails if
+// the connection parameters, or the TLS certificates, are not valid.
+func (c PostgresqlConfig) poolConfig() (*pgxpool.Config, error) {
+	poolConfig, err := pgxpool.ParseConfig(c.connString())
+	if err != nil {
+		return nil, err
+	}
+
+	// The application name of a DSN is kept
+	if c.ApplicationName != "" {
+		poolConfig.ConnConfig.RuntimeParams["application_name"] = c.ApplicationName
+	} else if _, ok := poolConfig.ConnConfig.RuntimeParams["application_name"]; !ok {
+		poolConfig.ConnConfig.RuntimeParams["application_name"] = defaultPostgresqlApplicationName
+	}
+
+	// The zero values keep the defaults of pgxpool
+	if c.MinConns > 0 {
+		poolConfig.MinConns = c.MinConns
+	}
+
+	if c.MaxConns > 0 {
+		poolConfig.MaxConns = c.MaxConns
+	}
+
+	if c.HealthCheckPeriod > 0 {
+		poolConfig.HealthCheckPeriod = c.HealthCheckPeriod
+	}
+
+	if c.ConnectTimeout > 0 {
+		poolConfig.ConnConfig.ConnectTimeout = c.ConnectTimeout
+	}
+
+	return poolConfig, nil
+}
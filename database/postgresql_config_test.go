@@ -0,0 +1,156 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPostgresqlConfig_connString(t *testing.T) {
+	tests := []struct {
+		name   string
+		config PostgresqlConfig
+		want   string
+	}{
+		{
+			name:   "defaults",
+			config: PostgresqlConfig{Host: "db", Database: "sessions", Username: "user", Password: "secret"},
+			want:   "postgresql://user:secret@db/sessions?sslmode=prefer",
+		},
+		{
+			name:   "escaped_password",
+			config: PostgresqlConfig{Host: "db", Database: "sessions", Username: "user", Password: "p@ss:w/rd?#"},
+			want:   "postgresql://user:p%40ss%3Aw%2Frd%3F%23@db/sessions?sslmode=prefer",
+		},
+		{
+			name:   "port",
+			config: PostgresqlConfig{Host: "db", Port: 5433, Database: "sessions", Username: "user", Password: "secret"},
+			want:   "postgresql://user:secret@db:5433/sessions?sslmode=prefer",
+		},
+		{
+			name:   "ipv6_port",
+			config: PostgresqlConfig{Host: "::1", Port: 5433, Database: "sessions", Username: "user", Password: "secret"},
+			want:   "postgresql://user:secret@[::1]:5433/sessions?sslmode=prefer",
+		},
+		{
+			name: "tls_and_search_path",
+			config: PostgresqlConfig{
+				Host:        "db",
+				Database:    "sessions",
+				Username:    "user",
+				Password:    "secret",
+				SSLMode:     "verify-full",
+				SSLRootCert: "/certs/ca.pem",
+				SSLCert:     "/certs/client.pem",
+				SSLKey:      "/certs/client.key",
+				SearchPath:  "tokens,public",
+			},
+			want: "postgresql://user:secret@db/sessions?search_path=tokens%2Cpublic&sslcert=%2Fcerts%2Fclient.pem" +
+				"&sslkey=%2Fcerts%2Fclient.key&sslmode=verify-full&sslrootcert=%2Fcerts%2Fca.pem",
+		},
+		{
+			name:   "dsn",
+			config: PostgresqlConfig{DSN: "host=db dbname=sessions user=user password=secret"},
+			want:   "host=db dbname=sessions user=user password=secret",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.connString(); got != tt.want {
+				t.Errorf("connString() got = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostgresqlConfig_poolConfig(t *testing.T) {
+	tests := []struct {
+		name                string
+		config              PostgresqlConfig
+		wantPassword        string
+		wantPort            uint16
+		wantSearchPath      string
+		wantApplicationName string
+		wantMaxConns        int32
+		wantConnectTimeout  time.Duration
+		wantErr             bool
+	}{
+		{
+			name: "defaults",
+			config: PostgresqlConfig{
+				Host: "db", Database: "sessions", Username: "user", Password: "p@ss:w/rd?#", MaxConns: 7, ConnectTimeout: 3 * time.Second,
+			},
+			wantPassword:        "p@ss:w/rd?#",
+			wantPort:            5432,
+			wantApplicationName: "token-handler",
+			wantMaxConns:        7,
+			wantConnectTimeout:  3 * time.Second,
+		},
+		{
+			name: "options",
+			config: PostgresqlConfig{
+				Host: "db", Port: 5433, Database: "sessions", Username: "user", Password: "secret",
+				SearchPath: "tokens", ApplicationName: "sessions-eu",
+			},
+			wantPassword:        "secret",
+			wantPort:            5433,
+			wantSearchPath:      "tokens",
+			wantApplicationName: "sessions-eu",
+		},
+		{
+			name:                "dsn_application_name",
+			config:              PostgresqlConfig{DSN: "postgres://user:secret@db:5434/sessions?application_name=from-dsn"},
+			wantPassword:        "secret",
+			wantPort:            5434,
+			wantApplicationName: "from-dsn",
+		},
+		{
+			name: "missing_root_cert",
+			config: PostgresqlConfig{
+				Host: "db", Database: "sessions", Username: "user", Password: "secret",
+				SSLMode: "verify-full", SSLRootCert: "/nonexistent/ca.pem",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "wrong_dsn",
+			config:  PostgresqlConfig{DSN: "postgres://user:secret@db:port/sessions"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.config.poolConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("poolConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if got.ConnConfig.Password != tt.wantPassword {
+				t.Errorf("poolConfig() password = %s, want %s", got.ConnConfig.Password, tt.wantPassword)
+			}
+
+			if got.ConnConfig.Port != tt.wantPort {
+				t.Errorf("poolConfig() port = %d, want %d", got.ConnConfig.Port, tt.wantPort)
+			}
+
+			if got.ConnConfig.RuntimeParams["search_path"] != tt.wantSearchPath {
+				t.Errorf("poolConfig() search_path = %s, want %s", got.ConnConfig.RuntimeParams["search_path"], tt.wantSearchPath)
+			}
+
+			if got.ConnConfig.RuntimeParams["application_name"] != tt.wantApplicationName {
+				t.Errorf("poolConfig() application_name = %s, want %s", got.ConnConfig.RuntimeParams["application_name"], tt.wantApplicationName)
+			}
+
+			if tt.wantMaxConns != 0 && got.MaxConns != tt.wantMaxConns {
+				t.Errorf("poolConfig() MaxConns = %d, want %d", got.MaxConns, tt.wantMaxConns)
+			}
+
+			if tt.wantConnectTimeout != 0 && got.ConnConfig.ConnectTimeout != tt.wantConnectTimeout {
+				t.Errorf("poolConfig() ConnectTimeout = %s, want %s", got.ConnConfig.ConnectTimeout, tt.wantConnectTimeout)
+			}
+		})
+	}
+}
@@ -9,11 +9,12 @@ import (
 	"testing"
 	"time"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 func testPostgresqlEnd() {
 	_, _ = testSQLite.db.Exec("DROP TABLE IF EXISTS sessions")
+	_, _ = testSQLite.db.Exec("DROP TABLE IF EXISTS schema_version")
 	_ = testSQLite.CloseConnection(context.TODO())
 }
 
@@ -21,7 +22,7 @@ func TestPostgresql_Add(t *testing.T) {
 	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
 
 	type fields struct {
-		conn *pgx.Conn
+		pool *pgxpool.Pool
 	}
 
 	type args struct {
@@ -36,30 +37,30 @@ func TestPostgresql_Add(t *testing.T) {
 	}{
 		{
 			name:   "correct_data",
-			fields: fields{conn: testPostgreSQL.conn},
+			fields: fields{pool: testPostgreSQL.pool},
 			args:   args{s: SessionData{Subject: "user", ExpiresAt: validDate, IDToken: "id_token", RefreshToken: "refresh_token", AccessToken: "access_token"}},
 		},
 		{
 			name:    "empty_subject",
-			fields:  fields{conn: testPostgreSQL.conn},
+			fields:  fields{pool: testPostgreSQL.pool},
 			args:    args{s: SessionData{ExpiresAt: validDate, IDToken: "id_token", RefreshToken: "refresh_token", AccessToken: "access_token"}},
 			wantErr: true,
 		},
 		{
 			name:    "empty_id_token",
-			fields:  fields{conn: testPostgreSQL.conn},
+			fields:  fields{pool: testPostgreSQL.pool},
 			args:    args{s: SessionData{Subject: "user", ExpiresAt: validDate, RefreshToken: "refresh_token", AccessToken: "access_token"}},
 			wantErr: true,
 		},
 		{
 			name:    "empty_refresh_token",
-			fields:  fields{conn: testPostgreSQL.conn},
+			fields:  fields{pool: testPostgreSQL.pool},
 			args:    args{s: SessionData{Subject: "user", ExpiresAt: validDate, IDToken: "id_token", AccessToken: "access_token"}},
 			wantErr: true,
 		},
 		{
 			name:    "empty_access_token",
-			fields:  fields{conn: testPostgreSQL.conn},
+			fields:  fields{pool: testPostgreSQL.pool},
 			args:    args{s: SessionData{Subject: "user", ExpiresAt: validDate, IDToken: "id_token", RefreshToken: "refresh_token"}},
 			wantErr: true,
 		},
@@ -67,7 +68,7 @@ func TestPostgresql_Add(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			db := &postgresql{
-				conn: tt.fields.conn,
+				pool: tt.fields.pool,
 			}
 
 			id, err := db.Add(context.TODO(), tt.args.s)
@@ -93,14 +94,14 @@ func TestPostgresql_Add(t *testing.T) {
 }
 
 func TestPostgresql_Delete(t *testing.T) {
-	id, err := testPostgreSQL.Add(context.TODO(), SessionData{"subject_to_delete", "access_token", "refresh_token", "id_token", time.Now()})
+	id, err := testPostgreSQL.Add(context.TODO(), SessionData{Subject: "subject_to_delete", AccessToken: "access_token", RefreshToken: "refresh_token", IDToken: "id_token", ExpiresAt: time.Now()})
 	if err != nil {
 		t.Fatalf("Add() reading added data, fatal error = %v, ", err)
 		return
 	}
 
 	type fields struct {
-		conn *pgx.Conn
+		pool *pgxpool.Pool
 	}
 	type args struct {
 		id string
@@ -113,12 +114,12 @@ func TestPostgresql_Delete(t *testing.T) {
 	}{
 		{
 			name:   "valid_item",
-			fields: fields{conn: testPostgreSQL.conn},
+			fields: fields{pool: testPostgreSQL.pool},
 			args:   args{id: id},
 		},
 		{
 			name:   "invalid_item",
-			fields: fields{conn: testPostgreSQL.conn},
+			fields: fields{pool: testPostgreSQL.pool},
 			args:   args{id: "NOT_VALID"}, // no error expected from SQL
 		},
 	}
@@ -126,7 +127,7 @@ func TestPostgresql_Delete(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			db := &postgresql{
-				conn: tt.fields.conn,
+				pool: tt.fields.pool,
 			}
 			if err := db.Delete(context.TODO(), tt.args.id); (err != nil) != tt.wantErr {
 				t.Errorf("Delete() error = %v, wantErr %v", err, tt.wantErr)
@@ -137,7 +138,7 @@ func TestPostgresql_Delete(t *testing.T) {
 
 func TestPostgresql_Get(t *testing.T) {
 	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
-	data := SessionData{"subject_to_get", "at_1234", "rt_1234", "it_1234", validDate}
+	data := SessionData{Subject: "subject_to_get", AccessToken: "at_1234", RefreshToken: "rt_1234", IDToken: "it_1234", ExpiresAt: validDate}
 
 	id, err := testPostgreSQL.Add(context.TODO(), data)
 	if err != nil {
@@ -146,7 +147,7 @@ func TestPostgresql_Get(t *testing.T) {
 	}
 
 	type fields struct {
-		conn *pgx.Conn
+		pool *pgxpool.Pool
 	}
 	type args struct {
 		id string
@@ -160,13 +161,13 @@ func TestPostgresql_Get(t *testing.T) {
 	}{
 		{
 			name:   "found",
-			fields: fields{conn: testPostgreSQL.conn},
+			fields: fields{pool: testPostgreSQL.pool},
 			args:   args{id: id},
 			want:   data,
 		},
 		{
 			name:    "notfound",
-			fields:  fields{conn: testPostgreSQL.conn},
+			fields:  fields{pool: testPostgreSQL.pool},
 			args:    args{id: "INVALID"},
 			wantErr: true,
 		},
@@ -174,7 +175,7 @@ func TestPostgresql_Get(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			db := &postgresql{
-				conn: tt.fields.conn,
+				pool: tt.fields.pool,
 			}
 			got, err := db.Get(context.TODO(), tt.args.id)
 			if (err != nil) != tt.wantErr {
@@ -190,7 +191,7 @@ func TestPostgresql_Get(t *testing.T) {
 
 func TestPostgresql_Update(t *testing.T) {
 	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
-	oldData := SessionData{"subject_to_update", "at_9999", "rt_9999", "it_9999", validDate}
+	oldData := SessionData{Subject: "subject_to_update", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: validDate}
 
 	id, err := testPostgreSQL.Add(context.TODO(), oldData)
 	if err != nil {
@@ -199,11 +200,11 @@ func TestPostgresql_Update(t *testing.T) {
 	}
 
 	newValidDate := time.Now().Add(10 * time.Minute).Round(time.Second)
-	newData := SessionData{"subject_to_update", "at_1111", "rt_1111", "it_1111", newValidDate}
-	newDataInvalidSubject := SessionData{"wrong_ubject", "at_1111", "rt_1111", "it_1111", newValidDate}
+	newData := SessionData{Subject: "subject_to_update", AccessToken: "at_1111", RefreshToken: "rt_1111", IDToken: "it_1111", ExpiresAt: newValidDate}
+	newDataInvalidSubject := SessionData{Subject: "wrong_ubject", AccessToken: "at_1111", RefreshToken: "rt_1111", IDToken: "it_1111", ExpiresAt: newValidDate}
 
 	type fields struct {
-		conn *pgx.Conn
+		pool *pgxpool.Pool
 	}
 	type args struct {
 		id string
@@ -217,26 +218,32 @@ func TestPostgresql_Update(t *testing.T) {
 	}{
 		{
 			name:   "valid",
-			fields: fields{conn: testPostgreSQL.conn},
+			fields: fields{pool: testPostgreSQL.pool},
 			args:   args{id: id, s: newData},
 		},
 		{
 			name:    "invalid_id",
-			fields:  fields{conn: testPostgreSQL.conn},
+			fields:  fields{pool: testPostgreSQL.pool},
 			args:    args{id: "NOT_VALID_ID", s: newData},
 			wantErr: true,
 		},
 		{
 			name:    "invalid_subject",
-			fields:  fields{conn: testPostgreSQL.conn},
+			fields:  fields{pool: testPostgreSQL.pool},
 			args:    args{id: id, s: newDataInvalidSubject},
 			wantErr: true,
 		},
+		{
+			name:    "stale_version",
+			fields:  fields{pool: testPostgreSQL.pool},
+			args:    args{id: id, s: newData},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			db := &postgresql{
-				conn: tt.fields.conn,
+				pool: tt.fields.pool,
 			}
 			if err := db.Update(context.TODO(), tt.args.id, tt.args.s); (err != nil) != tt.wantErr {
 				t.Errorf("Update() error = %v, wantErr %v", err, tt.wantErr)
@@ -249,8 +256,11 @@ func TestPostgresql_Update(t *testing.T) {
 					return
 				}
 
-				if verify != tt.args.s {
-					t.Errorf("Add() error = %v, want %v", verify, tt.args.s)
+				want := tt.args.s
+				want.Version++
+
+				if verify != want {
+					t.Errorf("Add() error = %v, want %v", verify, want)
 					return
 				}
 			}
@@ -263,29 +273,29 @@ func TestPostgresql_Purge(t *testing.T) {
 		now := time.Now()
 		expiredDate := now.Add(-5 * time.Minute).Round(time.Second)
 
-		_, err := testPostgreSQL.Add(context.TODO(), SessionData{"exp_01", "at_9999", "rt_9999", "it_9999", expiredDate})
+		_, err := testPostgreSQL.Add(context.TODO(), SessionData{Subject: "exp_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: expiredDate, SessionExpiresAt: expiredDate})
 		if err != nil {
 			t.Fatalf("Add() reading added data, fatal error = %v, ", err)
 			return
 		}
-		_, err = testPostgreSQL.Add(context.TODO(), SessionData{"exp_02", "at_9999", "rt_9999", "it_9999", expiredDate})
+		_, err = testPostgreSQL.Add(context.TODO(), SessionData{Subject: "exp_02", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: expiredDate, SessionExpiresAt: expiredDate})
 		if err != nil {
 			t.Fatalf("Add() reading added data, fatal error = %v, ", err)
 			return
 		}
-		_, err = testPostgreSQL.Add(context.TODO(), SessionData{"exp_03", "at_9999", "rt_9999", "it_9999", expiredDate})
+		_, err = testPostgreSQL.Add(context.TODO(), SessionData{Subject: "exp_03", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: expiredDate, SessionExpiresAt: expiredDate})
 		if err != nil {
 			t.Fatalf("Add() reading added data, fatal error = %v, ", err)
 			return
 		}
 
 		db := &postgresql{
-			conn: testPostgreSQL.conn,
+			pool: testPostgreSQL.pool,
 		}
 
 		var count int
 
-		err = db.conn.QueryRow(context.TODO(), "SELECT count(*) FROM sessions WHERE expires_at < extract(epoch from now())").Scan(&count)
+		err = db.pool.QueryRow(context.TODO(), "SELECT count(*) FROM sessions WHERE session_expires_at > 0 AND session_expires_at < extract(epoch from now())").Scan(&count)
 		if err != nil {
 			t.Fatalf("Purge() getting expired sissions, fatal error = %v, ", err)
 			return
@@ -299,7 +309,7 @@ func TestPostgresql_Purge(t *testing.T) {
 			t.Errorf("Purge() error = %v", err)
 		}
 
-		err = db.conn.QueryRow(context.TODO(), "SELECT COUNT(*) FROM SESSIONS WHERE expires_at < extract(epoch from now())").Scan(&count)
+		err = db.pool.QueryRow(context.TODO(), "SELECT COUNT(*) FROM SESSIONS WHERE session_expires_at > 0 AND session_expires_at < extract(epoch from now())").Scan(&count)
 		if err != nil {
 			t.Fatalf("Purge() getting expired sissions, fatal error = %v, ", err)
 			return
@@ -310,3 +320,114 @@ func TestPostgresql_Purge(t *testing.T) {
 		}
 	})
 }
+
+func TestPostgresql_DeleteBy(t *testing.T) {
+	testDeleteBy(t, func(t *testing.T) SessionImpl {
+		if _, err := testPostgreSQL.pool.Exec(context.TODO(), "DELETE FROM sessions"); err != nil {
+			t.Fatalf("cannot empty the sessions table: %v", err)
+		}
+
+		return testPostgreSQL
+	})
+}
+
+func TestPostgresql_ListCount(t *testing.T) {
+	if _, err := testPostgreSQL.pool.Exec(context.TODO(), "DELETE FROM sessions"); err != nil {
+		t.Fatalf("cannot empty the sessions table: %v", err)
+	}
+
+	testListCount(t, testPostgreSQL)
+}
+
+func TestPostgresql_ConcurrentUpdates(t *testing.T) {
+	// More goroutines than connections wait for a free connection
+	testConcurrentUpdates(t, testPostgreSQL)
+}
+
+func TestPostgresql_Touch(t *testing.T) {
+	testTouch(t, testPostgreSQL)
+}
+
+func TestPostgresql_Migrate(t *testing.T) {
+	// The migrations are already applied by the connection
+	for i := 0; i < 2; i++ {
+		version, err := migratePostgresql(context.TODO(), testPostgreSQL.pool)
+		if err != nil {
+			t.Fatalf("migratePostgresql() error = %v", err)
+		}
+
+		if version != len(postgresqlMigrations) {
+			t.Errorf("migratePostgresql() got = %d, want %d", version, len(postgresqlMigrations))
+		}
+	}
+
+	var count int
+	if err := testPostgreSQL.pool.QueryRow(context.TODO(), "SELECT COUNT(*) FROM schema_version").Scan(&count); err != nil {
+		t.Fatalf("cannot read the schema version: %v", err)
+	}
+
+	if count != len(postgresqlMigrations) {
+		t.Errorf("migratePostgresql() applied %d migrations, want %d", count, len(postgresqlMigrations))
+	}
+}
+
+func TestPostgresql_IndependentInstances(t *testing.T) {
+	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
+	session := SessionData{Subject: "user", ExpiresAt: validDate, IDToken: "id_token", RefreshToken: "refresh_token", AccessToken: "access_token"}
+
+	first, err := NewPostgresqlSessionImpl(context.TODO(), nil, testPostgresqlConfig)
+	if err != nil {
+		t.Fatalf("NewPostgresqlSessionImpl() error = %v", err)
+	}
+
+	second, err := NewPostgresqlSessionImpl(context.TODO(), nil, testPostgresqlConfig)
+	if err != nil {
+		t.Fatalf("NewPostgresqlSessionImpl() error = %v", err)
+	}
+	defer second.CloseConnection(context.TODO())
+
+	if first == second || first == SessionImpl(testPostgreSQL) {
+		t.Fatalf("NewPostgresqlSessionImpl() returned an existing instance")
+	}
+
+	id, err := first.Add(context.TODO(), session)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// Closing an instance doesn't close the pools of the others
+	if err = first.CloseConnection(context.TODO()); err != nil {
+		t.Fatalf("CloseConnection() error = %v", err)
+	}
+
+	if _, err = first.Get(context.TODO(), id); err == nil {
+		t.Errorf("Get() on a closed instance error = %v, wantErr true", err)
+	}
+
+	got, err := second.Get(context.TODO(), id)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	if got.Subject != session.Subject {
+		t.Errorf("Get() Subject = %s, want %s", got.Subject, session.Subject)
+	}
+
+	if _, err = testPostgreSQL.Get(context.TODO(), id); err != nil {
+		t.Errorf("Get() error = %v", err)
+	}
+
+	if err = second.Delete(context.TODO(), id); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+}
+
+func TestPostgresql_CopySessions(t *testing.T) {
+	t.Run("import", func(t *testing.T) {
+		testCopySessions(t, newTestMemory(t, nil), testPostgreSQL)
+	})
+
+	t.Run("export", func(t *testing.T) {
+		testCopySessions(t, testPostgreSQL, newTestMemory(t, nil))
+	})
+}
@@ -0,0 +1,777 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gandalfmagic/go-token-handler/opentelemetry"
+
+	"github.com/gandalfmagic/encryption"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const (
+	redisKeyPrefix        = "sessions:"
+	redisSubjectKeyPrefix = "sessions:subject:"
+	redisSIDKeyPrefix     = "sessions:sid:"
+
+	// redisLegacyExpiresAt is the field used by the previous versions for
+	// the expiration of the access token, it's removed by the next update
+	redisLegacyExpiresAt = "expires_at"
+)
+
+type redisStore struct {
+	client *redis.Client
+	cipher encryption.HexCipher
+	ttl    time.Duration
+}
+
+// NewRedisSessionImpl creates a SessionImpl backed by a Redis server. Every
+// session is saved as a hash, that expires using the native Redis key TTL: the
+// ttl is reset every time the session is added, updated or touched, but it never
+// exceeds the maximum lifetime of the session.
+func NewRedisSessionImpl(ctx context.Context, cipher encryption.HexCipher, addr, username, password string, database int, ttl time.Duration) (SessionImpl, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Username: username,
+		Password: password,
+		DB:       database,
+	})
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	return &redisStore{client: client, cipher: cipher, ttl: ttl}, nil
+}
+
+func redisKey(id string) string {
+	return redisKeyPrefix + id
+}
+
+// redisSubjectKey returns the key of the set containing the ids of all the
+// sessions of a user.
+func redisSubjectKey(subject string) string {
+	return redisSubjectKeyPrefix + subject
+}
+
+// redisSIDKey returns the key of the set containing the ids of all the
+// sessions linked to a session of the auth server.
+func redisSIDKey(sid string) string {
+	return redisSIDKeyPrefix + sid
+}
+
+// keyTTL returns the TTL of a session key, limited by the maximum lifetime of
+// the session.
+func (db *redisStore) keyTTL(absoluteExpiresAt time.Time) time.Duration {
+	if absoluteExpiresAt.IsZero() {
+		return db.ttl
+	}
+
+	if untilAbsolute := time.Until(absoluteExpiresAt); untilAbsolute < db.ttl {
+		return untilAbsolute
+	}
+
+	return db.ttl
+}
+
+// redisInt64 parses an integer field returned by HMGET, a missing field is
+// returned as 0.
+func redisInt64(value interface{}) (int64, error) {
+	raw, ok := value.(string)
+	if !ok || raw == "" {
+		return 0, nil
+	}
+
+	parsed, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse the session field: %w", err)
+	}
+
+	return parsed, nil
+}
+
+func (db *redisStore) CloseConnection(_ context.Context) error {
+	return db.client.Close()
+}
+
+// set saves the session and updates the indexes by subject and sid, the
+// oldSID is removed from the index if it's different from the new one.
+func (db *redisStore) set(ctx context.Context, c redis.Cmdable, id string, enc SessionData, oldSID string) error {
+	key := redisKey(id)
+
+	_, err := c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"subject", enc.Subject,
+			"access_token", enc.AccessToken,
+			"refresh_token", enc.RefreshToken,
+			"id_token", enc.IDToken,
+			"token_expires_at", enc.ExpiresAt.Unix(),
+			"sid", enc.SID,
+			"version", enc.Version,
+			"session_expires_at", toUnix(enc.SessionExpiresAt),
+			"absolute_expires_at", toUnix(enc.AbsoluteExpiresAt))
+		pipe.HDel(ctx, key, redisLegacyExpiresAt)
+		pipe.Expire(ctx, key, db.keyTTL(enc.AbsoluteExpiresAt))
+
+		// The indexes expire together with the last session they contain
+		pipe.SAdd(ctx, redisSubjectKey(enc.Subject), id)
+		pipe.Expire(ctx, redisSubjectKey(enc.Subject), db.ttl)
+
+		if oldSID != "" && oldSID != enc.SID {
+			pipe.SRem(ctx, redisSIDKey(oldSID), id)
+		}
+
+		if enc.SID != "" {
+			pipe.SAdd(ctx, redisSIDKey(enc.SID), id)
+			pipe.Expire(ctx, redisSIDKey(enc.SID), db.ttl)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// remove deletes a session and its references in the indexes, it returns true
+// if the session existed.
+func (db *redisStore) remove(ctx context.Context, id string) (bool, error) {
+	key := redisKey(id)
+
+	values, err := db.client.HMGet(ctx, key, "subject", "sid").Result()
+	if err != nil {
+		return false, err
+	}
+
+	var deleted *redis.IntCmd
+
+	_, err = db.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, key)
+
+		if subject, ok := values[0].(string); ok && subject != "" {
+			pipe.SRem(ctx, redisSubjectKey(subject), id)
+		}
+
+		if sid, ok := values[1].(string); ok && sid != "" {
+			pipe.SRem(ctx, redisSIDKey(sid), id)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return deleted.Val() > 0, nil
+}
+
+// removeIndex deletes all the sessions referenced by an index, and the index
+// itself. It returns the number of sessions deleted.
+func (db *redisStore) removeIndex(ctx context.Context, indexKey string) (int64, error) {
+	ids, err := db.client.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+
+	for _, id := range ids {
+		deleted, err := db.remove(ctx, id)
+		if err != nil {
+			return count, err
+		}
+
+		if deleted {
+			count++
+		}
+	}
+
+	if err = db.client.Del(ctx, indexKey).Err(); err != nil {
+		return count, err
+	}
+
+	return count, nil
+}
+
+func (db *redisStore) Add(ctx context.Context, s SessionData) (string, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.redis: HSET")
+	if span != nil {
+		defer span.End()
+	}
+
+	id := uuid.New().String()
+
+	if span != nil {
+		span.SetAttributes(
+			attribute.String("db.key", redisKey(id)),
+			attribute.String("db.key.subject", s.Subject),
+			attribute.String("db.key.token_expires_at", s.ExpiresAt.String()))
+	}
+
+	if err := s.validate(); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: HSET -> validate")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return "", err
+	}
+
+	enc, err := encryptArgs(db.cipher, s)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: HSET -> encryptArgs")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return "", err
+	}
+
+	if err = db.set(ctx, db.client, id, enc, ""); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: HSET -> db.client.TxPipelined")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (db *redisStore) Delete(ctx context.Context, id string) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.redis: DEL")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.key", redisKey(id)))
+	}
+
+	if _, err := db.remove(ctx, id); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: DEL -> remove")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisStore) Get(ctx context.Context, id string) (SessionData, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.redis: HGETALL")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.key", redisKey(id)))
+	}
+
+	values, err := db.client.HGetAll(ctx, redisKey(id)).Result()
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: HGETALL -> db.client.HGetAll")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return SessionData{}, err
+	}
+
+	// A missing key is returned as an empty hash, the error is the same
+	// returned by the sql implementations
+	if len(values) == 0 {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: HGETALL -> not found")
+		}
+
+		return SessionData{}, sql.ErrNoRows
+	}
+
+	// The sessions saved by the previous versions have the expiration of the
+	// access token in the legacy field
+	rawExpiresAt, ok := values["token_expires_at"]
+	if !ok {
+		rawExpiresAt = values[redisLegacyExpiresAt]
+	}
+
+	expiresAt, err := strconv.ParseInt(rawExpiresAt, 10, 64)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: HGETALL -> strconv.ParseInt")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return SessionData{}, fmt.Errorf("cannot parse the session expiration: %w", err)
+	}
+
+	// The sessions saved by the previous versions don't have a version, and
+	// the session and absolute expirations
+	var version, sessionExpiresAt, absoluteExpiresAt int64
+	for field, value := range map[string]*int64{"version": &version, "session_expires_at": &sessionExpiresAt, "absolute_expires_at": &absoluteExpiresAt} {
+		if values[field] == "" {
+			continue
+		}
+
+		if *value, err = strconv.ParseInt(values[field], 10, 64); err != nil {
+			return SessionData{}, fmt.Errorf("cannot parse the session %s: %w", field, err)
+		}
+	}
+
+	s := SessionData{
+		Subject:      values["subject"],
+		AccessToken:  values["access_token"],
+		RefreshToken: values["refresh_token"],
+		IDToken:      values["id_token"],
+		ExpiresAt:    time.Unix(expiresAt, 0),
+		SID:          values["sid"],
+		Version:      version,
+
+		SessionExpiresAt:  fromUnix(sessionExpiresAt),
+		AbsoluteExpiresAt: fromUnix(absoluteExpiresAt),
+	}
+
+	return decryptArgs(db.cipher, s)
+}
+
+func (db *redisStore) Update(ctx context.Context, id string, s SessionData) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.redis: HSET")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.key", redisKey(id)),
+			attribute.String("db.key.subject", s.Subject),
+			attribute.String("db.key.token_expires_at", s.ExpiresAt.String()))
+	}
+
+	oldSession, err := db.Get(ctx, id)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: UPDATE -> Get")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	if s.Subject != oldSession.Subject {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: subject mismatch")
+		}
+
+		return ErrSessionsMismatch
+	}
+
+	if err = s.validate(); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: UPDATE -> validate")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	enc, err := encryptArgs(db.cipher, s)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: UPDATE -> encryptArgs")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	// The version is compared and incremented in a transaction, that fails if
+	// the session is modified after the WATCH
+	err = db.client.Watch(ctx, func(tx *redis.Tx) error {
+		values, err := tx.HMGet(ctx, redisKey(id), "version", "session_expires_at", "absolute_expires_at").Result()
+		if err != nil {
+			return err
+		}
+
+		version, err := redisInt64(values[0])
+		if err != nil {
+			return err
+		}
+
+		if version != s.Version {
+			return ErrVersionConflict
+		}
+
+		// The session and absolute expirations are only changed by Touch
+		sessionExpiresAt, err := redisInt64(values[1])
+		if err != nil {
+			return err
+		}
+
+		absoluteExpiresAt, err := redisInt64(values[2])
+		if err != nil {
+			return err
+		}
+
+		enc.Version = version + 1
+		enc.SessionExpiresAt = fromUnix(sessionExpiresAt)
+		enc.AbsoluteExpiresAt = fromUnix(absoluteExpiresAt)
+
+		return db.set(ctx, tx, id, enc, oldSession.SID)
+	}, redisKey(id))
+	if errors.Is(err, redis.TxFailedErr) {
+		err = ErrVersionConflict
+	}
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: UPDATE -> db.client.Watch")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisStore) Touch(ctx context.Context, id string, sessionExpiresAt time.Time) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.redis: HSET")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.key", redisKey(id)),
+			attribute.String("db.key.session_expires_at", sessionExpiresAt.String()))
+	}
+
+	key := redisKey(id)
+
+	// The session is checked in a transaction, a deleted session must not be
+	// created again with only the session expiration
+	err := db.client.Watch(ctx, func(tx *redis.Tx) error {
+		values, err := tx.HMGet(ctx, key, "subject", "absolute_expires_at", "sid").Result()
+		if err != nil {
+			return err
+		}
+
+		subject, ok := values[0].(string)
+		if !ok {
+			return sql.ErrNoRows
+		}
+
+		absoluteExpiresAt, err := redisInt64(values[1])
+		if err != nil {
+			return err
+		}
+
+		sid, _ := values[2].(string)
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, "session_expires_at", toUnix(sessionExpiresAt))
+			pipe.Expire(ctx, key, db.keyTTL(fromUnix(absoluteExpiresAt)))
+
+			// The indexes must not expire before the sessions they contain
+			pipe.Expire(ctx, redisSubjectKey(subject), db.ttl)
+			if sid != "" {
+				pipe.Expire(ctx, redisSIDKey(sid), db.ttl)
+			}
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: HSET -> db.client.Watch")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Purge does nothing, the expired sessions are removed by Redis using the key TTL.
+func (db *redisStore) Purge(_ context.Context) error {
+	return nil
+}
+
+func (db *redisStore) DeleteBySubject(ctx context.Context, subject string) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.redis: DEL")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.key", redisSubjectKey(subject)))
+	}
+
+	count, err := db.removeIndex(ctx, redisSubjectKey(subject))
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: DEL -> removeIndex")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return count, err
+	}
+
+	return count, nil
+}
+
+func (db *redisStore) DeleteBySID(ctx context.Context, sid string) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.redis: DEL")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.key", redisSIDKey(sid)))
+	}
+
+	if sid == "" {
+		return 0, nil
+	}
+
+	count, err := db.removeIndex(ctx, redisSIDKey(sid))
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: DEL -> removeIndex")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return count, err
+	}
+
+	return count, nil
+}
+
+func (db *redisStore) ListBySubject(ctx context.Context, subject string) ([]SessionInfo, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.redis: SMEMBERS")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.key", redisSubjectKey(subject)))
+	}
+
+	ids, err := db.client.SMembers(ctx, redisSubjectKey(subject)).Result()
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: SMEMBERS -> db.client.SMembers")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return nil, err
+	}
+
+	sessions := make([]SessionInfo, 0, len(ids))
+
+	for _, id := range ids {
+		values, err := db.client.HMGet(ctx, redisKey(id), "subject", "sid", "session_expires_at", "absolute_expires_at").Result()
+		if err != nil {
+			if span != nil {
+				span.SetStatus(codes.Error, "session.redis: SMEMBERS -> db.client.HMGet")
+				span.SetAttributes(attribute.String("error.message", err.Error()))
+			}
+
+			return nil, err
+		}
+
+		// The index can still reference the sessions expired by the TTL
+		subject, ok := values[0].(string)
+		if !ok {
+			continue
+		}
+
+		sid, _ := values[1].(string)
+
+		// The sessions saved by the previous versions don't have the session
+		// and absolute expirations
+		sessionExpiresAt, err := redisInt64(values[2])
+		if err != nil {
+			return nil, err
+		}
+
+		absoluteExpiresAt, err := redisInt64(values[3])
+		if err != nil {
+			return nil, err
+		}
+
+		// The expired sessions are kept until the end of the key TTL
+		expiresAt := sessionExpiration(fromUnix(sessionExpiresAt), fromUnix(absoluteExpiresAt))
+		if !expiresAt.IsZero() && time.Now().After(expiresAt) {
+			continue
+		}
+
+		sessions = append(sessions, SessionInfo{ID: id, Subject: subject, SID: sid, ExpiresAt: expiresAt})
+	}
+
+	sortSessionInfo(sessions)
+
+	return sessions, nil
+}
+
+func (db *redisStore) Export(ctx context.Context, fn func(id string, s SessionData) error) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.redis: SCAN")
+	if span != nil {
+		defer span.End()
+	}
+
+	iter := db.client.Scan(ctx, 0, redisKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		// Skip the indexes, the session ids don't contain a colon
+		id := strings.TrimPrefix(iter.Val(), redisKeyPrefix)
+		if strings.Contains(id, ":") {
+			continue
+		}
+
+		s, err := db.Get(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			// The session expired after the SCAN
+			continue
+		}
+		if err != nil {
+			if span != nil {
+				span.SetStatus(codes.Error, "session.redis: SCAN -> Get")
+				span.SetAttributes(attribute.String("error.message", err.Error()))
+			}
+
+			return fmt.Errorf("cannot export the session %s: %w", id, err)
+		}
+
+		if s.IsSessionExpired() {
+			continue
+		}
+
+		if err = fn(id, s); err != nil {
+			return err
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: SCAN -> iter.Next")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisStore) Import(ctx context.Context, id string, s SessionData) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.redis: HSET")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.key", redisKey(id)),
+			attribute.String("db.key.subject", s.Subject),
+			attribute.String("db.key.token_expires_at", s.ExpiresAt.String()))
+	}
+
+	if err := s.validate(); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: HSET -> validate")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	enc, err := encryptArgs(db.cipher, s)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: HSET -> encryptArgs")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	// The replaced session is removed from the indexes of its subject and sid
+	if _, err = db.remove(ctx, id); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: HSET -> remove")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	if err = db.set(ctx, db.client, id, enc, ""); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: HSET -> db.client.TxPipelined")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisStore) Count(ctx context.Context) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.redis: SCAN")
+	if span != nil {
+		defer span.End()
+	}
+
+	var count int64
+
+	iter := db.client.Scan(ctx, 0, redisKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		// Skip the indexes, the session ids don't contain a colon
+		if strings.Contains(strings.TrimPrefix(iter.Val(), redisKeyPrefix), ":") {
+			continue
+		}
+
+		values, err := db.client.HMGet(ctx, iter.Val(), "subject", "session_expires_at", "absolute_expires_at").Result()
+		if err != nil {
+			if span != nil {
+				span.SetStatus(codes.Error, "session.redis: SCAN -> db.client.HMGet")
+				span.SetAttributes(attribute.String("error.message", err.Error()))
+			}
+
+			return 0, err
+		}
+
+		// The session expired after the SCAN
+		if values[0] == nil {
+			continue
+		}
+
+		sessionExpiresAt, err := redisInt64(values[1])
+		if err != nil {
+			return 0, err
+		}
+
+		absoluteExpiresAt, err := redisInt64(values[2])
+		if err != nil {
+			return 0, err
+		}
+
+		// The expired sessions are kept until the end of the key TTL
+		expiresAt := sessionExpiration(fromUnix(sessionExpiresAt), fromUnix(absoluteExpiresAt))
+		if !expiresAt.IsZero() && time.Now().After(expiresAt) {
+			continue
+		}
+
+		count++
+	}
+
+	if err := iter.Err(); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.redis: SCAN -> iter.Next")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return 0, err
+	}
+
+	return count, nil
+}
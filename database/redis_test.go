@@ -0,0 +1,416 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gandalfmagic/encryption"
+)
+
+func newTestRedis(t *testing.T, cipher encryption.HexCipher) (*redisStore, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+
+	conn, err := NewRedisSessionImpl(context.TODO(), cipher, server.Addr(), "", "", 0, 30*time.Minute)
+	if err != nil {
+		t.Fatalf("NewRedisSessionImpl() fatal error = %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.CloseConnection(context.TODO())
+	})
+
+	db, ok := conn.(*redisStore)
+	if !ok {
+		t.Fatalf("could not convert DB interface to *redisStore")
+	}
+
+	return db, server
+}
+
+func TestRedis_Add(t *testing.T) {
+	db, server := newTestRedis(t, nil)
+	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
+
+	type args struct {
+		s SessionData
+	}
+
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "correct_data",
+			args: args{s: SessionData{Subject: "user", ExpiresAt: validDate, IDToken: "id_token", RefreshToken: "refresh_token", AccessToken: "access_token"}},
+		},
+		{
+			name:    "empty_subject",
+			args:    args{s: SessionData{ExpiresAt: validDate, IDToken: "id_token", RefreshToken: "refresh_token", AccessToken: "access_token"}},
+			wantErr: true,
+		},
+		{
+			name:    "empty_id_token",
+			args:    args{s: SessionData{Subject: "user", ExpiresAt: validDate, RefreshToken: "refresh_token", AccessToken: "access_token"}},
+			wantErr: true,
+		},
+		{
+			name:    "empty_refresh_token",
+			args:    args{s: SessionData{Subject: "user", ExpiresAt: validDate, IDToken: "id_token", AccessToken: "access_token"}},
+			wantErr: true,
+		},
+		{
+			name:    "empty_access_token",
+			args:    args{s: SessionData{Subject: "user", ExpiresAt: validDate, IDToken: "id_token", RefreshToken: "refresh_token"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := db.Add(context.TODO(), tt.args.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Add() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if !tt.wantErr {
+				verify, err := db.Get(context.TODO(), id)
+				if err != nil {
+					t.Fatalf("Add() reading added data, fatal error = %v, ", err)
+					return
+				}
+
+				if verify != tt.args.s {
+					t.Errorf("Add() error = %v, want %v", verify, tt.args.s)
+					return
+				}
+
+				if ttl := server.TTL(redisKey(id)); ttl != 30*time.Minute {
+					t.Errorf("Add() ttl = %v, want %v", ttl, 30*time.Minute)
+				}
+			}
+		})
+	}
+}
+
+func TestRedis_Delete(t *testing.T) {
+	db, server := newTestRedis(t, nil)
+
+	id, err := db.Add(context.TODO(), SessionData{Subject: "subject_to_delete", AccessToken: "access_token", RefreshToken: "refresh_token", IDToken: "id_token", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Add() reading added data, fatal error = %v, ", err)
+		return
+	}
+
+	tests := []struct {
+		name    string
+		id      string
+		wantErr bool
+	}{
+		{
+			name: "valid_item",
+			id:   id,
+		},
+		{
+			name: "invalid_item",
+			id:   "NOT_VALID",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := db.Delete(context.TODO(), tt.id); (err != nil) != tt.wantErr {
+				t.Errorf("Delete() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if server.Exists(redisKey(tt.id)) {
+				t.Errorf("Delete() the key %s still exists", redisKey(tt.id))
+			}
+		})
+	}
+}
+
+func TestRedis_Get(t *testing.T) {
+	cipher, err := encryption.NewXChaCha20Cipher("0123456789abcdef0123456789abcdef", "")
+	if err != nil {
+		t.Fatalf("NewXChaCha20Cipher() fatal error = %v", err)
+	}
+
+	db, server := newTestRedis(t, cipher)
+	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
+	data := SessionData{Subject: "subject_to_get", AccessToken: "at_1234", RefreshToken: "rt_1234", IDToken: "it_1234", ExpiresAt: validDate}
+
+	id, err := db.Add(context.TODO(), data)
+	if err != nil {
+		t.Fatalf("Add() reading added data, fatal error = %v, ", err)
+		return
+	}
+
+	if server.HGet(redisKey(id), "access_token") == data.AccessToken {
+		t.Errorf("Add() the access token is not encrypted")
+	}
+
+	tests := []struct {
+		name    string
+		id      string
+		want    SessionData
+		wantErr error
+	}{
+		{
+			name: "found",
+			id:   id,
+			want: data,
+		},
+		{
+			name:    "notfound",
+			id:      "INVALID",
+			wantErr: sql.ErrNoRows,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.Get(context.TODO(), tt.id)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Get() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Get() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedis_Update(t *testing.T) {
+	db, server := newTestRedis(t, nil)
+	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
+	oldData := SessionData{Subject: "subject_to_update", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: validDate}
+
+	id, err := db.Add(context.TODO(), oldData)
+	if err != nil {
+		t.Fatalf("Add() reading added data, fatal error = %v, ", err)
+		return
+	}
+
+	newValidDate := time.Now().Add(10 * time.Minute).Round(time.Second)
+	newData := SessionData{Subject: "subject_to_update", AccessToken: "at_1111", RefreshToken: "rt_1111", IDToken: "it_1111", ExpiresAt: newValidDate}
+	newDataInvalidSubject := SessionData{Subject: "wrong_ubject", AccessToken: "at_1111", RefreshToken: "rt_1111", IDToken: "it_1111", ExpiresAt: newValidDate}
+
+	type args struct {
+		id string
+		s  SessionData
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			args: args{id: id, s: newData},
+		},
+		{
+			name:    "invalid_id",
+			args:    args{id: "NOT_VALID_ID", s: newData},
+			wantErr: true,
+		},
+		{
+			name:    "invalid_subject",
+			args:    args{id: id, s: newDataInvalidSubject},
+			wantErr: true,
+		},
+		{
+			name:    "stale_version",
+			args:    args{id: id, s: newData},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Consume part of the ttl, to verify that it's reset by the update
+			server.FastForward(10 * time.Minute)
+
+			if err := db.Update(context.TODO(), tt.args.id, tt.args.s); (err != nil) != tt.wantErr {
+				t.Errorf("Update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr {
+				verify, err := db.Get(context.TODO(), id)
+				if err != nil {
+					t.Fatalf("Update() reading updated data, fatal error = %v, ", err)
+					return
+				}
+
+				want := tt.args.s
+				want.Version++
+
+				if verify != want {
+					t.Errorf("Update() error = %v, want %v", verify, want)
+					return
+				}
+
+				if ttl := server.TTL(redisKey(id)); ttl != 30*time.Minute {
+					t.Errorf("Update() ttl = %v, want %v", ttl, 30*time.Minute)
+				}
+			}
+
+			if server.Exists(redisKey("NOT_VALID_ID")) {
+				t.Errorf("Update() created a new session for an invalid id")
+			}
+		})
+	}
+}
+
+func TestRedis_Expiration(t *testing.T) {
+	db, server := newTestRedis(t, nil)
+
+	id, err := db.Add(context.TODO(), SessionData{Subject: "exp_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Add() reading added data, fatal error = %v, ", err)
+		return
+	}
+
+	if err = db.Purge(context.TODO()); err != nil {
+		t.Errorf("Purge() error = %v", err)
+	}
+
+	if _, err = db.Get(context.TODO(), id); err != nil {
+		t.Errorf("Get() the session should not be purged before the ttl, error = %v", err)
+	}
+
+	server.FastForward(31 * time.Minute)
+
+	if _, err = db.Get(context.TODO(), id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Get() the session should be expired, error = %v", err)
+	}
+}
+
+func TestRedis_ConcurrentUpdates(t *testing.T) {
+	db, _ := newTestRedis(t, nil)
+	testConcurrentUpdates(t, db)
+}
+
+func TestRedis_DeleteBy(t *testing.T) {
+	testDeleteBy(t, func(t *testing.T) SessionImpl {
+		db, _ := newTestRedis(t, nil)
+		return db
+	})
+}
+
+func TestRedis_ListCount(t *testing.T) {
+	db, server := newTestRedis(t, nil)
+	testListCount(t, db)
+
+	sessions, err := db.ListBySubject(context.TODO(), "user_01")
+	if err != nil {
+		t.Fatalf("ListBySubject() error = %v", err)
+	}
+
+	// The subject index can still reference a session expired by the TTL
+	server.Del(redisKey(sessions[0].ID))
+
+	got, err := db.ListBySubject(context.TODO(), "user_01")
+	if err != nil {
+		t.Fatalf("ListBySubject() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(got, sessions[1:]) {
+		t.Errorf("ListBySubject() got = %v, want %v", got, sessions[1:])
+	}
+}
+
+func TestRedis_Touch(t *testing.T) {
+	db, _ := newTestRedis(t, nil)
+	testTouch(t, db)
+}
+
+func TestRedis_TouchIndexes(t *testing.T) {
+	tests := []struct {
+		name     string
+		deleteBy func(db *redisStore) (int64, error)
+	}{
+		{
+			name:     "subject",
+			deleteBy: func(db *redisStore) (int64, error) { return db.DeleteBySubject(context.TODO(), "touch_01") },
+		},
+		{
+			name:     "sid",
+			deleteBy: func(db *redisStore) (int64, error) { return db.DeleteBySID(context.TODO(), "sid_touch_01") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, server := newTestRedis(t, nil)
+
+			id, err := db.Add(context.TODO(), SessionData{Subject: "touch_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: time.Now().Add(time.Hour), SID: "sid_touch_01"})
+			if err != nil {
+				t.Fatalf("Add() fatal error = %v, ", err)
+			}
+
+			// The session is kept alive only by Touch, beyond the ttl of the
+			// indexes created by Add
+			for i := 0; i < 3; i++ {
+				server.FastForward(20 * time.Minute)
+
+				if err = db.Touch(context.TODO(), id, time.Now().Add(30*time.Minute)); err != nil {
+					t.Fatalf("Touch() error = %v", err)
+				}
+			}
+
+			got, err := tt.deleteBy(db)
+			if err != nil {
+				t.Fatalf("DeleteBy() error = %v", err)
+			}
+
+			if got != 1 {
+				t.Errorf("DeleteBy() got = %d, want %d", got, 1)
+			}
+
+			if _, err = db.Get(context.TODO(), id); !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("Get() the session should be deleted, error = %v", err)
+			}
+		})
+	}
+}
+
+func TestRedis_AbsoluteExpiration(t *testing.T) {
+	db, server := newTestRedis(t, nil)
+
+	id, err := db.Add(context.TODO(), SessionData{Subject: "abs_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: time.Now(), AbsoluteExpiresAt: time.Now().Add(10 * time.Minute)})
+	if err != nil {
+		t.Fatalf("Add() fatal error = %v, ", err)
+	}
+
+	// The ttl is reset, but it never exceeds the maximum lifetime
+	if err = db.Touch(context.TODO(), id, time.Now().Add(30*time.Minute)); err != nil {
+		t.Fatalf("Touch() error = %v", err)
+	}
+
+	if ttl := server.TTL(redisKey(id)); ttl > 10*time.Minute {
+		t.Errorf("Touch() ttl = %v, want at most %v", ttl, 10*time.Minute)
+	}
+
+	server.FastForward(11 * time.Minute)
+
+	if _, err = db.Get(context.TODO(), id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Get() the session should be expired, error = %v", err)
+	}
+}
+
+func TestRedis_CopySessions(t *testing.T) {
+	t.Run("import", func(t *testing.T) {
+		target, _ := newTestRedis(t, nil)
+		testCopySessions(t, newTestMemory(t, nil), target)
+	})
+
+	t.Run("export", func(t *testing.T) {
+		source, _ := newTestRedis(t, nil)
+		testCopySessions(t, source, newTestMemory(t, nil))
+	})
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"sync"
 	"time"
 
 	"github.com/gandalfmagic/go-token-handler/opentelemetry"
@@ -26,11 +25,33 @@ const (
 		expires_at INTEGER NOT NULL);
 		CREATE INDEX IF NOT EXISTS session_subject ON sessions (subject);
 		CREATE INDEX IF NOT EXISTS session_expires_at ON sessions (expires_at);`
-	querySQLiteDelete = `DELETE FROM sessions WHERE session_id = ?`
-	querySQLiteInsert = `INSERT INTO sessions (session_id, subject, access_token, refresh_token, id_token, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
-	querySQLiteSelect = `SELECT subject, access_token, refresh_token, id_token, expires_at FROM sessions WHERE session_id = ?`
-	querySQLiteUpdate = `UPDATE sessions SET subject = ?, access_token = ?, refresh_token = ?, id_token = ?, expires_at = ? WHERE session_id = ?`
-	querySQLitePurge  = `DELETE FROM sessions WHERE expires_at < ?`
+	querySQLiteAddSIDVersion = `ALTER TABLE sessions ADD COLUMN sid TEXT NOT NULL DEFAULT '';
+		ALTER TABLE sessions ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
+		CREATE INDEX IF NOT EXISTS session_sid ON sessions (sid);`
+	querySQLiteRenameExpiresAt = `ALTER TABLE sessions RENAME COLUMN expires_at TO token_expires_at;
+		DROP INDEX IF EXISTS session_expires_at;`
+	querySQLiteAddExpirations = `ALTER TABLE sessions ADD COLUMN session_expires_at INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE sessions ADD COLUMN absolute_expires_at INTEGER NOT NULL DEFAULT 0;
+		CREATE INDEX IF NOT EXISTS session_session_expires_at ON sessions (session_expires_at);`
+	querySQLiteInitSession         = `UPDATE sessions SET session_expires_at = ? WHERE session_expires_at = 0`
+	querySQLiteCreateSchemaVersion = `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER NOT NULL PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at INTEGER NOT NULL)`
+	querySQLiteSchemaVersion    = `SELECT COALESCE(MAX(version), 0) FROM schema_version`
+	querySQLiteSetSchemaVersion = `INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)`
+	querySQLiteDelete           = `DELETE FROM sessions WHERE session_id = ?`
+	querySQLiteDeleteSubject    = `DELETE FROM sessions WHERE subject = ?`
+	querySQLiteDeleteSID        = `DELETE FROM sessions WHERE sid = ?`
+	querySQLiteInsert           = `INSERT INTO sessions (session_id, subject, access_token, refresh_token, id_token, token_expires_at, sid, session_expires_at, absolute_expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	querySQLiteSelect           = `SELECT subject, access_token, refresh_token, id_token, token_expires_at, sid, version, session_expires_at, absolute_expires_at FROM sessions WHERE session_id = ?`
+	querySQLiteUpdate           = `UPDATE sessions SET subject = ?, access_token = ?, refresh_token = ?, id_token = ?, token_expires_at = ?, sid = ?, version = version + 1 WHERE session_id = ? AND version = ?`
+	querySQLiteTouch            = `UPDATE sessions SET session_expires_at = ? WHERE session_id = ?`
+	querySQLitePurge            = `DELETE FROM sessions WHERE (session_expires_at > 0 AND session_expires_at < ?) OR (absolute_expires_at > 0 AND absolute_expires_at < ?)`
+	querySQLiteListSubject      = `SELECT session_id, subject, sid, CASE WHEN absolute_expires_at > 0 AND (session_expires_at = 0 OR absolute_expires_at < session_expires_at) THEN absolute_expires_at ELSE session_expires_at END AS expires_at FROM sessions WHERE subject = ? AND (session_expires_at = 0 OR session_expires_at >= ?) AND (absolute_expires_at = 0 OR absolute_expires_at >= ?) ORDER BY expires_at, session_id`
+	querySQLiteCount            = `SELECT COUNT(*) FROM sessions WHERE (session_expires_at = 0 OR session_expires_at >= ?) AND (absolute_expires_at = 0 OR absolute_expires_at >= ?)`
+	querySQLiteExport           = `SELECT session_id, subject, access_token, refresh_token, id_token, token_expires_at, sid, version, session_expires_at, absolute_expires_at FROM sessions WHERE (session_expires_at = 0 OR session_expires_at >= ?) AND (absolute_expires_at = 0 OR absolute_expires_at >= ?)`
+	querySQLiteImport           = `INSERT OR REPLACE INTO sessions (session_id, subject, access_token, refresh_token, id_token, token_expires_at, sid, version, session_expires_at, absolute_expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 )
 
 type sqlite struct {
@@ -38,33 +59,90 @@ type sqlite struct {
 	cipher encryption.HexCipher
 }
 
-var (
-	sqliteInstance *sqlite
-	sqliteOnce     sync.Once
-)
+// NewSQLiteSessionImpl opens the SQLite database, and applies the migrations of
+// its schema. Every call returns a new instance, with its own connections, that
+// must be closed by the caller.
+func NewSQLiteSessionImpl(ctx context.Context, cipher encryption.HexCipher, database string) (SessionImpl, error) {
+	// The transactions are immediate, to lock the database while the
+	// migrations are applied
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_txlock=immediate", database))
+	if err != nil {
+		return nil, err
+	}
 
-func NewSQLiteSessionImpl(_ context.Context, cipher encryption.HexCipher, database string) (SessionImpl, error) {
-	var db *sql.DB
-	var err error
+	if _, err = migrateSQLite(ctx, db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
 
-	sqliteOnce.Do(func() {
-		db, err = sql.Open("sqlite3", fmt.Sprintf("file:%s", database))
-		if err != nil {
-			return
-		}
+	return &sqlite{db: db, cipher: cipher}, nil
+}
 
-		_, err = db.Exec(querySQLiteCreate)
-		if err != nil {
-			return
-		}
+// sqliteMigrations are the migrations of the SQLite schema, sorted by version.
+var sqliteMigrations = []migration{
+	{version: 1, description: "create the sessions table", up: execMigration(querySQLiteCreate)},
+	{version: 2, description: "add the sid and version columns", up: execMigration(querySQLiteAddSIDVersion)},
+	{version: 3, description: "rename the expiration of the access token to token_expires_at", up: execMigration(querySQLiteRenameExpiresAt)},
+	{version: 4, description: "add the session and absolute expirations", up: sqliteAddExpirations},
+}
+
+// sqliteMigrationTx applies the migrations in an immediate transaction, that
+// locks the database for writing until it's committed.
+type sqliteMigrationTx struct {
+	tx *sql.Tx
+}
+
+func (t sqliteMigrationTx) exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := t.tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (t sqliteMigrationTx) queryInt(ctx context.Context, query string, args ...interface{}) (int, error) {
+	var value int
+	err := t.tx.QueryRowContext(ctx, query, args...).Scan(&value)
+	return value, err
+}
+
+func (t sqliteMigrationTx) schemaVersion(ctx context.Context) (int, error) {
+	if err := t.exec(ctx, querySQLiteCreateSchemaVersion); err != nil {
+		return 0, err
+	}
 
-		sqliteInstance = &sqlite{db: db, cipher: cipher}
-	})
+	return t.queryInt(ctx, querySQLiteSchemaVersion)
+}
+
+func (t sqliteMigrationTx) setSchemaVersion(ctx context.Context, m migration) error {
+	return t.exec(ctx, querySQLiteSetSchemaVersion, m.version, m.description, time.Now().Unix())
+}
+
+// migrateSQLite applies the migrations of the schema, and returns the schema
+// version of the database.
+func migrateSQLite(ctx context.Context, db *sql.DB) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
 
-	return sqliteInstance, err
+	version, err := applyMigrations(ctx, sqliteMigrationTx{tx: tx}, sqliteMigrations)
+	if err != nil {
+		return version, err
+	}
+
+	return version, tx.Commit()
+}
+
+// sqliteAddExpirations adds the session and absolute expirations, the sessions
+// saved without an expiration get a new idle timeout, instead of being purged
+// together with their access token.
+func sqliteAddExpirations(ctx context.Context, tx migrationTx) error {
+	if err := tx.exec(ctx, querySQLiteAddExpirations); err != nil {
+		return err
+	}
+
+	return tx.exec(ctx, querySQLiteInitSession, time.Now().Add(legacySessionTimeout).Unix())
 }
 
 func (db *sqlite) CloseConnection(_ context.Context) error {
@@ -84,7 +162,7 @@ func (db *sqlite) Add(ctx context.Context, s SessionData) (string, error) {
 			attribute.String("db.table", "sessions"),
 			attribute.String("db.table.id", id),
 			attribute.String("db.table.subject", s.Subject),
-			attribute.String("db.table.expires_at", s.ExpiresAt.String()))
+			attribute.String("db.table.token_expires_at", s.ExpiresAt.String()))
 	}
 
 	enc, err := encryptArgs(db.cipher, s)
@@ -97,7 +175,7 @@ func (db *sqlite) Add(ctx context.Context, s SessionData) (string, error) {
 		return "", err
 	}
 
-	if _, err := db.db.Exec(querySQLiteInsert, id, enc.Subject, enc.AccessToken, enc.RefreshToken, enc.IDToken, enc.ExpiresAt.Unix()); err != nil {
+	if _, err := db.db.Exec(querySQLiteInsert, id, enc.Subject, enc.AccessToken, enc.RefreshToken, enc.IDToken, enc.ExpiresAt.Unix(), enc.SID, toUnix(enc.SessionExpiresAt), toUnix(enc.AbsoluteExpiresAt)); err != nil {
 		if span != nil {
 			span.SetStatus(codes.Error, "session.sqlite: INSERT -> db.db.Exec")
 			span.SetAttributes(attribute.String("error.message", err.Error()))
@@ -143,9 +221,9 @@ func (db *sqlite) Get(ctx context.Context, id string) (SessionData, error) {
 	}
 
 	s := SessionData{}
-	var expiresAt int64
+	var expiresAt, sessionExpiresAt, absoluteExpiresAt int64
 
-	if err := db.db.QueryRow(querySQLiteSelect, id).Scan(&s.Subject, &s.AccessToken, &s.RefreshToken, &s.IDToken, &expiresAt); err != nil {
+	if err := db.db.QueryRow(querySQLiteSelect, id).Scan(&s.Subject, &s.AccessToken, &s.RefreshToken, &s.IDToken, &expiresAt, &s.SID, &s.Version, &sessionExpiresAt, &absoluteExpiresAt); err != nil {
 		if span != nil {
 			span.SetStatus(codes.Error, "session.sqlite: INSERT -> db.conn.QueryRow")
 			span.SetAttributes(attribute.String("error.message", err.Error()))
@@ -155,6 +233,8 @@ func (db *sqlite) Get(ctx context.Context, id string) (SessionData, error) {
 	}
 
 	s.ExpiresAt = time.Unix(expiresAt, 0)
+	s.SessionExpiresAt = fromUnix(sessionExpiresAt)
+	s.AbsoluteExpiresAt = fromUnix(absoluteExpiresAt)
 
 	return decryptArgs(db.cipher, s)
 }
@@ -168,7 +248,7 @@ func (db *sqlite) Update(ctx context.Context, id string, s SessionData) error {
 			attribute.String("db.table", "sessions"),
 			attribute.String("db.table.id", id),
 			attribute.String("db.table.subject", s.Subject),
-			attribute.String("db.table.expires_at", s.ExpiresAt.String()))
+			attribute.String("db.table.token_expires_at", s.ExpiresAt.String()))
 	}
 
 	oldSession, err := db.Get(context.TODO(), id)
@@ -199,7 +279,7 @@ func (db *sqlite) Update(ctx context.Context, id string, s SessionData) error {
 		return err
 	}
 
-	_, err = db.db.Exec(querySQLiteUpdate, enc.Subject, enc.AccessToken, enc.RefreshToken, enc.IDToken, enc.ExpiresAt.Unix(), id)
+	result, err := db.db.Exec(querySQLiteUpdate, enc.Subject, enc.AccessToken, enc.RefreshToken, enc.IDToken, enc.ExpiresAt.Unix(), enc.SID, id, s.Version)
 	if err != nil {
 		if span != nil {
 			span.SetStatus(codes.Error, "session.sqlite: UPDATE -> db.conn.Exec")
@@ -209,13 +289,273 @@ func (db *sqlite) Update(ctx context.Context, id string, s SessionData) error {
 		return err
 	}
 
+	// The session exists, so the version was changed by another update
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.sqlite: version conflict")
+		}
+
+		return ErrVersionConflict
+	}
+
+	return nil
+}
+
+func (db *sqlite) Touch(ctx context.Context, id string, sessionExpiresAt time.Time) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.sqlite: UPDATE")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table", "sessions"),
+			attribute.String("db.table.id", id),
+			attribute.String("db.table.session_expires_at", sessionExpiresAt.String()))
+	}
+
+	result, err := db.db.ExecContext(ctx, querySQLiteTouch, toUnix(sessionExpiresAt), id)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.sqlite: UPDATE -> db.db.ExecContext")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+
 	return nil
 }
 
 func (db *sqlite) Purge(_ context.Context) error {
 	now := time.Now().Unix()
 
-	if _, err := db.db.Exec(querySQLitePurge, now); err != nil {
+	if _, err := db.db.Exec(querySQLitePurge, now, now); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *sqlite) DeleteBySubject(ctx context.Context, subject string) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.sqlite: DELETE")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table", "sessions"),
+			attribute.String("db.table.subject", subject))
+	}
+
+	result, err := db.db.Exec(querySQLiteDeleteSubject, subject)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.sqlite: DELETE -> db.db.Exec")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (db *sqlite) DeleteBySID(ctx context.Context, sid string) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.sqlite: DELETE")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table", "sessions"),
+			attribute.String("db.table.sid", sid))
+	}
+
+	// An empty sid is saved for the sessions without a sid claim
+	if sid == "" {
+		return 0, nil
+	}
+
+	result, err := db.db.Exec(querySQLiteDeleteSID, sid)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.sqlite: DELETE -> db.db.Exec")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (db *sqlite) ListBySubject(ctx context.Context, subject string) ([]SessionInfo, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.sqlite: SELECT")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table", "sessions"),
+			attribute.String("db.table.subject", subject))
+	}
+
+	// The expired sessions that are not purged yet are not listed
+	now := time.Now().Unix()
+
+	rows, err := db.db.QueryContext(ctx, querySQLiteListSubject, subject, now, now)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.sqlite: SELECT -> db.db.QueryContext")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]SessionInfo, 0)
+
+	for rows.Next() {
+		var s SessionInfo
+		var expiresAt int64
+
+		if err = rows.Scan(&s.ID, &s.Subject, &s.SID, &expiresAt); err != nil {
+			if span != nil {
+				span.SetStatus(codes.Error, "session.sqlite: SELECT -> rows.Scan")
+				span.SetAttributes(attribute.String("error.message", err.Error()))
+			}
+
+			return nil, err
+		}
+
+		s.ExpiresAt = fromUnix(expiresAt)
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (db *sqlite) Count(ctx context.Context) (int64, error) {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.sqlite: SELECT")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.table", "sessions"))
+	}
+
+	var count int64
+
+	// The expired sessions that are not purged yet are not counted
+	now := time.Now().Unix()
+
+	if err := db.db.QueryRowContext(ctx, querySQLiteCount, now, now).Scan(&count); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.sqlite: SELECT -> db.db.QueryRowContext")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (db *sqlite) Export(ctx context.Context, fn func(id string, s SessionData) error) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.sqlite: SELECT")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(attribute.String("db.table", "sessions"))
+	}
+
+	now := time.Now().Unix()
+
+	rows, err := db.db.QueryContext(ctx, querySQLiteExport, now, now)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.sqlite: SELECT -> db.db.QueryContext")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var enc SessionData
+		var expiresAt, sessionExpiresAt, absoluteExpiresAt int64
+
+		if err = rows.Scan(&id, &enc.Subject, &enc.AccessToken, &enc.RefreshToken, &enc.IDToken, &expiresAt, &enc.SID, &enc.Version, &sessionExpiresAt, &absoluteExpiresAt); err != nil {
+			if span != nil {
+				span.SetStatus(codes.Error, "session.sqlite: SELECT -> rows.Scan")
+				span.SetAttributes(attribute.String("error.message", err.Error()))
+			}
+
+			return err
+		}
+
+		enc.ExpiresAt = time.Unix(expiresAt, 0)
+		enc.SessionExpiresAt = fromUnix(sessionExpiresAt)
+		enc.AbsoluteExpiresAt = fromUnix(absoluteExpiresAt)
+
+		s, err := decryptArgs(db.cipher, enc)
+		if err != nil {
+			if span != nil {
+				span.SetStatus(codes.Error, "session.sqlite: SELECT -> decryptArgs")
+				span.SetAttributes(attribute.String("error.message", err.Error()))
+			}
+
+			return fmt.Errorf("cannot export the session %s: %w", id, err)
+		}
+
+		if err = fn(id, s); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *sqlite) Import(ctx context.Context, id string, s SessionData) error {
+	_, span := opentelemetry.NewSpanFromContext(ctx, "session.sqlite: INSERT")
+	if span != nil {
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("db.table", "sessions"),
+			attribute.String("db.table.id", id),
+			attribute.String("db.table.subject", s.Subject),
+			attribute.String("db.table.token_expires_at", s.ExpiresAt.String()))
+	}
+
+	enc, err := encryptArgs(db.cipher, s)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.sqlite: INSERT -> encryptArgs")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
+		return err
+	}
+
+	if _, err = db.db.ExecContext(ctx, querySQLiteImport, id, enc.Subject, enc.AccessToken, enc.RefreshToken, enc.IDToken, enc.ExpiresAt.Unix(), enc.SID, enc.Version, toUnix(enc.SessionExpiresAt), toUnix(enc.AbsoluteExpiresAt)); err != nil {
+		if span != nil {
+			span.SetStatus(codes.Error, "session.sqlite: INSERT -> db.db.ExecContext")
+			span.SetAttributes(attribute.String("error.message", err.Error()))
+		}
+
 		return err
 	}
 
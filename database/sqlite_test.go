@@ -6,7 +6,10 @@ package database
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,7 +17,7 @@ import (
 )
 
 func testSQLiteEnd() {
-	_, _ = testPostgreSQL.conn.Exec(context.TODO(), "DROP TABLE IF EXISTS sessions")
+	_, _ = testPostgreSQL.pool.Exec(context.TODO(), "DROP TABLE IF EXISTS sessions, schema_version")
 	_ = testPostgreSQL.CloseConnection(context.TODO())
 }
 
@@ -94,7 +97,7 @@ func TestDB_Add(t *testing.T) {
 }
 
 func TestDB_Delete(t *testing.T) {
-	id, err := testSQLite.Add(context.TODO(), SessionData{"subject_to_delete", "access_token", "refresh_token", "id_token", time.Now()})
+	id, err := testSQLite.Add(context.TODO(), SessionData{Subject: "subject_to_delete", AccessToken: "access_token", RefreshToken: "refresh_token", IDToken: "id_token", ExpiresAt: time.Now()})
 	if err != nil {
 		t.Fatalf("Add() reading added data, fatal error = %v, ", err)
 		return
@@ -138,7 +141,7 @@ func TestDB_Delete(t *testing.T) {
 
 func TestDB_Get(t *testing.T) {
 	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
-	data := SessionData{"subject_to_get", "at_1234", "rt_1234", "it_1234", validDate}
+	data := SessionData{Subject: "subject_to_get", AccessToken: "at_1234", RefreshToken: "rt_1234", IDToken: "it_1234", ExpiresAt: validDate}
 
 	id, err := testSQLite.Add(context.TODO(), data)
 	if err != nil {
@@ -191,7 +194,7 @@ func TestDB_Get(t *testing.T) {
 
 func TestDB_Update(t *testing.T) {
 	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
-	oldData := SessionData{"subject_to_update", "at_9999", "rt_9999", "it_9999", validDate}
+	oldData := SessionData{Subject: "subject_to_update", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: validDate}
 
 	id, err := testSQLite.Add(context.TODO(), oldData)
 	if err != nil {
@@ -200,8 +203,8 @@ func TestDB_Update(t *testing.T) {
 	}
 
 	newValidDate := time.Now().Add(10 * time.Minute).Round(time.Second)
-	newData := SessionData{"subject_to_update", "at_1111", "rt_1111", "it_1111", newValidDate}
-	newDataInvalidSubject := SessionData{"wrong_ubject", "at_1111", "rt_1111", "it_1111", newValidDate}
+	newData := SessionData{Subject: "subject_to_update", AccessToken: "at_1111", RefreshToken: "rt_1111", IDToken: "it_1111", ExpiresAt: newValidDate}
+	newDataInvalidSubject := SessionData{Subject: "wrong_ubject", AccessToken: "at_1111", RefreshToken: "rt_1111", IDToken: "it_1111", ExpiresAt: newValidDate}
 
 	type fields struct {
 		db *sql.DB
@@ -233,6 +236,12 @@ func TestDB_Update(t *testing.T) {
 			args:    args{id: id, s: newDataInvalidSubject},
 			wantErr: true,
 		},
+		{
+			name:    "stale_version",
+			fields:  fields{db: testSQLite.db},
+			args:    args{id: id, s: newData},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -250,8 +259,11 @@ func TestDB_Update(t *testing.T) {
 					return
 				}
 
-				if verify != tt.args.s {
-					t.Errorf("Add() error = %v, want %v", verify, tt.args.s)
+				want := tt.args.s
+				want.Version++
+
+				if verify != want {
+					t.Errorf("Add() error = %v, want %v", verify, want)
 					return
 				}
 			}
@@ -264,17 +276,17 @@ func TestDB_Purge(t *testing.T) {
 		now := time.Now()
 		expiredDate := now.Add(-5 * time.Minute).Round(time.Second)
 
-		_, err := testSQLite.Add(context.TODO(), SessionData{"exp_01", "at_9999", "rt_9999", "it_9999", expiredDate})
+		_, err := testSQLite.Add(context.TODO(), SessionData{Subject: "exp_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: expiredDate, SessionExpiresAt: expiredDate})
 		if err != nil {
 			t.Fatalf("Add() reading added data, fatal error = %v, ", err)
 			return
 		}
-		_, err = testSQLite.Add(context.TODO(), SessionData{"exp_02", "at_9999", "rt_9999", "it_9999", expiredDate})
+		_, err = testSQLite.Add(context.TODO(), SessionData{Subject: "exp_02", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: expiredDate, SessionExpiresAt: expiredDate})
 		if err != nil {
 			t.Fatalf("Add() reading added data, fatal error = %v, ", err)
 			return
 		}
-		_, err = testSQLite.Add(context.TODO(), SessionData{"exp_03", "at_9999", "rt_9999", "it_9999", expiredDate})
+		_, err = testSQLite.Add(context.TODO(), SessionData{Subject: "exp_03", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: expiredDate, SessionExpiresAt: expiredDate})
 		if err != nil {
 			t.Fatalf("Add() reading added data, fatal error = %v, ", err)
 			return
@@ -286,7 +298,7 @@ func TestDB_Purge(t *testing.T) {
 
 		var count int
 
-		err = db.db.QueryRow("SELECT count(*) FROM sessions WHERE expires_at < unixepoch()").Scan(&count)
+		err = db.db.QueryRow("SELECT count(*) FROM sessions WHERE session_expires_at > 0 AND session_expires_at < unixepoch()").Scan(&count)
 		if err != nil {
 			t.Fatalf("Purge() getting expired sissions, fatal error = %v, ", err)
 			return
@@ -300,7 +312,7 @@ func TestDB_Purge(t *testing.T) {
 			t.Errorf("Purge() error = %v", err)
 		}
 
-		err = db.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE expires_at < unixepoch()").Scan(&count)
+		err = db.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE session_expires_at > 0 AND session_expires_at < unixepoch()").Scan(&count)
 		if err != nil {
 			t.Fatalf("Purge() getting expired sissions, fatal error = %v, ", err)
 			return
@@ -311,3 +323,249 @@ func TestDB_Purge(t *testing.T) {
 		}
 	})
 }
+
+func TestDB_DeleteBy(t *testing.T) {
+	testDeleteBy(t, func(t *testing.T) SessionImpl {
+		if _, err := testSQLite.db.Exec("DELETE FROM sessions"); err != nil {
+			t.Fatalf("cannot empty the sessions table: %v", err)
+		}
+
+		return testSQLite
+	})
+}
+
+func TestDB_ListCount(t *testing.T) {
+	if _, err := testSQLite.db.Exec("DELETE FROM sessions"); err != nil {
+		t.Fatalf("cannot empty the sessions table: %v", err)
+	}
+
+	testListCount(t, testSQLite)
+}
+
+func TestDB_ConcurrentUpdates(t *testing.T) {
+	testConcurrentUpdates(t, testSQLite)
+}
+
+func TestDB_Touch(t *testing.T) {
+	testTouch(t, testSQLite)
+}
+
+func TestDB_PurgeSessionExpiration(t *testing.T) {
+	now := time.Now()
+	sessions := map[string]SessionData{
+		"idle":     {Subject: "idle_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: now.Add(5 * time.Minute), SessionExpiresAt: now.Add(-time.Minute)},
+		"absolute": {Subject: "abs_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: now.Add(5 * time.Minute), AbsoluteExpiresAt: now.Add(-time.Minute)},
+		"valid":    {Subject: "valid_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: now.Add(5 * time.Minute), SessionExpiresAt: now.Add(time.Minute), AbsoluteExpiresAt: now.Add(time.Hour)},
+		// The access token is refreshed by the next request
+		"token_expired": {Subject: "token_01", AccessToken: "at_9999", RefreshToken: "rt_9999", IDToken: "it_9999", ExpiresAt: now.Add(-5 * time.Minute), SessionExpiresAt: now.Add(time.Minute)},
+	}
+	wantPurged := map[string]bool{"idle": true, "absolute": true, "valid": false, "token_expired": false}
+
+	ids := make(map[string]string)
+	for name, s := range sessions {
+		id, err := testSQLite.Add(context.TODO(), s)
+		if err != nil {
+			t.Fatalf("Add() fatal error = %v, ", err)
+		}
+
+		ids[name] = id
+	}
+
+	if err := testSQLite.Purge(context.TODO()); err != nil {
+		t.Errorf("Purge() error = %v", err)
+	}
+
+	for name, id := range ids {
+		_, err := testSQLite.Get(context.TODO(), id)
+		if purged := err == sql.ErrNoRows; purged != wantPurged[name] {
+			t.Errorf("Purge() session %s purged = %v, error = %v", name, purged, err)
+		}
+	}
+}
+
+func TestDB_MigrateLegacySchema(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "legacy.sqlite"))
+	if err != nil {
+		t.Fatalf("cannot open the database: %v", err)
+	}
+	defer db.Close()
+
+	// The schema created by the first versions, the expiration of the
+	// access token was used as the expiration of the session
+	tokenExpiresAt := time.Now().Add(-5 * time.Minute).Unix()
+	for _, query := range []string{
+		`CREATE TABLE sessions (
+			session_id TEXT NOT NULL PRIMARY KEY,
+			subject TEXT NOT NULL CHECK(subject != ''),
+			access_token TEXT NOT NULL CHECK(access_token != ''),
+			refresh_token TEXT NOT NULL CHECK(refresh_token != ''),
+			id_token TEXT NOT NULL CHECK(id_token != ''),
+			expires_at INTEGER NOT NULL);
+			CREATE INDEX session_subject ON sessions (subject);
+			CREATE INDEX session_expires_at ON sessions (expires_at);`,
+		fmt.Sprintf(`INSERT INTO sessions VALUES ('legacy_01', 'sub_01', 'at_9999', 'rt_9999', 'it_9999', %d)`, tokenExpiresAt),
+	} {
+		if _, err = db.Exec(query); err != nil {
+			t.Fatalf("cannot create the legacy schema: %v", err)
+		}
+	}
+
+	// The migration must be idempotent
+	for i := 0; i < 2; i++ {
+		version, err := migrateSQLite(context.TODO(), db)
+		if err != nil {
+			t.Fatalf("migrateSQLite() error = %v", err)
+		}
+
+		if version != len(sqliteMigrations) {
+			t.Errorf("migrateSQLite() got = %d, want %d", version, len(sqliteMigrations))
+		}
+	}
+
+	legacy := &sqlite{db: db}
+
+	got, err := legacy.Get(context.TODO(), "legacy_01")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	if got.ExpiresAt.Unix() != tokenExpiresAt {
+		t.Errorf("Get() ExpiresAt = %v, want %v", got.ExpiresAt, time.Unix(tokenExpiresAt, 0))
+	}
+
+	if until := time.Until(got.SessionExpiresAt); until <= 0 || until > legacySessionTimeout {
+		t.Errorf("Get() SessionExpiresAt in %v, want within %v", until, legacySessionTimeout)
+	}
+
+	// The session with an expired access token is not purged
+	if err = legacy.Purge(context.TODO()); err != nil {
+		t.Errorf("Purge() error = %v", err)
+	}
+
+	if _, err = legacy.Get(context.TODO(), "legacy_01"); err != nil {
+		t.Errorf("Purge() the legacy session was removed, error = %v", err)
+	}
+}
+
+func TestDB_MigrateConcurrently(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "concurrent.sqlite") + "?_txlock=immediate"
+
+	// Every instance of the service applies the migrations at startup, the
+	// immediate transaction allows only one of them to apply each version
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			db, err := sql.Open("sqlite3", dsn)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer db.Close()
+
+			_, err = migrateSQLite(context.TODO(), db)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("migrateSQLite() error = %v", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("cannot open the database: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&count); err != nil {
+		t.Fatalf("cannot read the schema version: %v", err)
+	}
+
+	if count != len(sqliteMigrations) {
+		t.Errorf("migrateSQLite() applied %d migrations, want %d", count, len(sqliteMigrations))
+	}
+}
+
+func TestDB_IndependentInstances(t *testing.T) {
+	dir := t.TempDir()
+	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
+	session := SessionData{Subject: "user", ExpiresAt: validDate, IDToken: "id_token", RefreshToken: "refresh_token", AccessToken: "access_token"}
+
+	first, err := NewSQLiteSessionImpl(context.TODO(), nil, filepath.Join(dir, "first.sqlite"))
+	if err != nil {
+		t.Fatalf("NewSQLiteSessionImpl() error = %v", err)
+	}
+
+	second, err := NewSQLiteSessionImpl(context.TODO(), nil, filepath.Join(dir, "second.sqlite"))
+	if err != nil {
+		t.Fatalf("NewSQLiteSessionImpl() error = %v", err)
+	}
+	defer second.CloseConnection(context.TODO())
+
+	if first == second {
+		t.Fatalf("NewSQLiteSessionImpl() returned the same instance for different databases")
+	}
+
+	id, err := first.Add(context.TODO(), session)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// The session is saved only in the first database
+	if _, err = second.Get(context.TODO(), id); err != sql.ErrNoRows {
+		t.Errorf("Get() error = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	// Closing an instance doesn't affect the others
+	if err = first.CloseConnection(context.TODO()); err != nil {
+		t.Fatalf("CloseConnection() error = %v", err)
+	}
+
+	if _, err = first.Get(context.TODO(), id); err == nil {
+		t.Errorf("Get() on a closed instance error = %v, wantErr true", err)
+	}
+
+	secondID, err := second.Add(context.TODO(), session)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	if _, err = second.Get(context.TODO(), secondID); err != nil {
+		t.Errorf("Get() error = %v", err)
+	}
+
+	// A new instance opens the database again
+	reopened, err := NewSQLiteSessionImpl(context.TODO(), nil, filepath.Join(dir, "first.sqlite"))
+	if err != nil {
+		t.Fatalf("NewSQLiteSessionImpl() error = %v", err)
+	}
+	defer reopened.CloseConnection(context.TODO())
+
+	got, err := reopened.Get(context.TODO(), id)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	if got.Subject != session.Subject {
+		t.Errorf("Get() Subject = %s, want %s", got.Subject, session.Subject)
+	}
+}
+
+func TestDB_CopySessions(t *testing.T) {
+	target, err := NewSQLiteSessionImpl(context.TODO(), nil, filepath.Join(t.TempDir(), "target.sqlite"))
+	if err != nil {
+		t.Fatalf("NewSQLiteSessionImpl() error = %v", err)
+	}
+	defer target.CloseConnection(context.TODO())
+
+	testCopySessions(t, testSQLite, target)
+}
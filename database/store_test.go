@@ -0,0 +1,406 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConcurrentUpdates verifies the Get and Update methods of a SessionImpl
+// called by many goroutines, like the concurrent requests of the users. The
+// updates of the same session are serialized by the optimistic locking.
+func testConcurrentUpdates(t *testing.T, db SessionImpl) {
+	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
+
+	sharedID, err := db.Add(context.TODO(), SessionData{Subject: "shared", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate})
+	if err != nil {
+		t.Fatalf("Add() fatal error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var sharedUpdates int64
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Every goroutine updates its own session without conflicts
+			subject := fmt.Sprintf("concurrent_%d", i)
+
+			id, err := db.Add(context.TODO(), SessionData{Subject: subject, AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate})
+			if err != nil {
+				t.Errorf("Add() error = %v", err)
+				return
+			}
+
+			for j := 0; j < 10; j++ {
+				s, err := db.Get(context.TODO(), id)
+				if err != nil {
+					t.Errorf("Get() error = %v", err)
+					return
+				}
+
+				s.AccessToken = fmt.Sprintf("at_%d", j)
+				if err = db.Update(context.TODO(), id, s); err != nil {
+					t.Errorf("Update() error = %v", err)
+					return
+				}
+			}
+
+			s, err := db.Get(context.TODO(), id)
+			if err != nil || s.Version != 10 || s.AccessToken != "at_9" {
+				t.Errorf("Get() got = %+v, error = %v, want version 10", s, err)
+			}
+
+			// The updates of the shared session can conflict
+			s, err = db.Get(context.TODO(), sharedID)
+			if err != nil {
+				t.Errorf("Get() error = %v", err)
+				return
+			}
+
+			err = db.Update(context.TODO(), sharedID, s)
+			if err != nil && !errors.Is(err, ErrVersionConflict) {
+				t.Errorf("Update() error = %v, want nil or %v", err, ErrVersionConflict)
+			}
+
+			if err == nil {
+				mu.Lock()
+				sharedUpdates++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s, err := db.Get(context.TODO(), sharedID)
+	if err != nil {
+		t.Fatalf("Get() fatal error = %v", err)
+	}
+
+	if sharedUpdates == 0 || s.Version != sharedUpdates {
+		t.Errorf("Get() version = %d, want %d successful updates", s.Version, sharedUpdates)
+	}
+}
+
+// testDeleteBy verifies the DeleteBySubject and DeleteBySID methods of a
+// SessionImpl, newDB must return an empty database.
+func testDeleteBy(t *testing.T, newDB func(t *testing.T) SessionImpl) {
+	validDate := time.Now().Add(5 * time.Minute).Round(time.Second)
+	sessions := []SessionData{
+		{Subject: "user_01", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate, SID: "sid_01"},
+		{Subject: "user_01", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate, SID: "sid_01"},
+		{Subject: "user_01", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate, SID: "sid_02"},
+		{Subject: "user_02", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate, SID: "sid_03"},
+		{Subject: "user_02", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate},
+	}
+
+	tests := []struct {
+		name      string
+		delete    func(db SessionImpl) (int64, error)
+		wantCount int64
+		wantLeft  []int
+	}{
+		{
+			name:      "by_subject",
+			delete:    func(db SessionImpl) (int64, error) { return db.DeleteBySubject(context.TODO(), "user_01") },
+			wantCount: 3,
+			wantLeft:  []int{3, 4},
+		},
+		{
+			name:      "by_sid",
+			delete:    func(db SessionImpl) (int64, error) { return db.DeleteBySID(context.TODO(), "sid_01") },
+			wantCount: 2,
+			wantLeft:  []int{2, 3, 4},
+		},
+		{
+			name:      "by_empty_sid",
+			delete:    func(db SessionImpl) (int64, error) { return db.DeleteBySID(context.TODO(), "") },
+			wantCount: 0,
+			wantLeft:  []int{0, 1, 2, 3, 4},
+		},
+		{
+			name:      "not_found",
+			delete:    func(db SessionImpl) (int64, error) { return db.DeleteBySubject(context.TODO(), "user_03") },
+			wantCount: 0,
+			wantLeft:  []int{0, 1, 2, 3, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newDB(t)
+
+			ids := make([]string, 0, len(sessions))
+			for _, s := range sessions {
+				id, err := db.Add(context.TODO(), s)
+				if err != nil {
+					t.Fatalf("Add() fatal error = %v, ", err)
+				}
+
+				ids = append(ids, id)
+			}
+
+			count, err := tt.delete(db)
+			if err != nil {
+				t.Fatalf("delete error = %v", err)
+			}
+
+			if count != tt.wantCount {
+				t.Errorf("delete count = %d, want %d", count, tt.wantCount)
+			}
+
+			left := make([]int, 0, len(ids))
+			for i, id := range ids {
+				if _, err := db.Get(context.TODO(), id); err == nil {
+					left = append(left, i)
+				}
+			}
+
+			if !reflect.DeepEqual(left, tt.wantLeft) {
+				t.Errorf("sessions left = %v, want %v", left, tt.wantLeft)
+			}
+		})
+	}
+}
+
+// testListCount verifies the ListBySubject and Count methods of a SessionImpl,
+// db must be an empty database.
+func testListCount(t *testing.T, db SessionImpl) {
+	now := time.Now().Round(time.Second)
+	validDate := now.Add(5 * time.Minute)
+
+	// The sessions are listed with the expiration of the session, not of the
+	// access token
+	sessions := []SessionData{
+		{Subject: "user_01", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate, SID: "sid_01",
+			SessionExpiresAt: now.Add(30 * time.Minute)},
+		{Subject: "user_01", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate.Add(time.Minute),
+			SessionExpiresAt: now.Add(20 * time.Minute), AbsoluteExpiresAt: now.Add(10 * time.Minute)},
+		{Subject: "user_02", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate, SID: "sid_02",
+			AbsoluteExpiresAt: now.Add(time.Hour)},
+		// The expired sessions that are not purged yet are not listed and
+		// not counted
+		{Subject: "user_01", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate,
+			SessionExpiresAt: now.Add(-time.Minute)},
+		{Subject: "user_02", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: validDate,
+			SessionExpiresAt: now.Add(30 * time.Minute), AbsoluteExpiresAt: now.Add(-time.Minute)},
+	}
+
+	ids := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		id, err := db.Add(context.TODO(), s)
+		if err != nil {
+			t.Fatalf("Add() fatal error = %v, ", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	count, err := db.Count(context.TODO())
+	if err != nil {
+		t.Fatalf("Count() error = %v", err)
+	}
+
+	if count != 3 {
+		t.Errorf("Count() got = %d, want %d", count, 3)
+	}
+
+	tests := []struct {
+		name    string
+		subject string
+		want    []SessionInfo
+	}{
+		{
+			name:    "sorted_by_expiration",
+			subject: "user_01",
+			want: []SessionInfo{
+				{ID: ids[1], Subject: "user_01", ExpiresAt: now.Add(10 * time.Minute)},
+				{ID: ids[0], Subject: "user_01", SID: "sid_01", ExpiresAt: now.Add(30 * time.Minute)},
+			},
+		},
+		{
+			name:    "absolute_expiration",
+			subject: "user_02",
+			want:    []SessionInfo{{ID: ids[2], Subject: "user_02", SID: "sid_02", ExpiresAt: now.Add(time.Hour)}},
+		},
+		{
+			name:    "not_found",
+			subject: "user_03",
+			want:    []SessionInfo{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.ListBySubject(context.TODO(), tt.subject)
+			if err != nil {
+				t.Fatalf("ListBySubject() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListBySubject() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testTouch verifies that the idle expiration is only changed by Touch, and
+// the absolute expiration is never changed, it's used by all the backends.
+func testTouch(t *testing.T, db SessionImpl) {
+	now := time.Now().Round(time.Second)
+	s := SessionData{
+		Subject:           "touch_01",
+		AccessToken:       "at",
+		RefreshToken:      "rt",
+		IDToken:           "it",
+		ExpiresAt:         now.Add(5 * time.Minute),
+		SessionExpiresAt:  now.Add(30 * time.Minute),
+		AbsoluteExpiresAt: now.Add(12 * time.Hour),
+	}
+
+	id, err := db.Add(context.TODO(), s)
+	if err != nil {
+		t.Fatalf("Add() fatal error = %v", err)
+	}
+
+	got, err := db.Get(context.TODO(), id)
+	if err != nil {
+		t.Fatalf("Get() fatal error = %v", err)
+	}
+
+	if !got.SessionExpiresAt.Equal(s.SessionExpiresAt) || !got.AbsoluteExpiresAt.Equal(s.AbsoluteExpiresAt) {
+		t.Errorf("Get() got = %v, %v, want %v, %v", got.SessionExpiresAt, got.AbsoluteExpiresAt, s.SessionExpiresAt, s.AbsoluteExpiresAt)
+	}
+
+	sessionExpiresAt := now.Add(40 * time.Minute)
+	if err = db.Touch(context.TODO(), id, sessionExpiresAt); err != nil {
+		t.Fatalf("Touch() error = %v", err)
+	}
+
+	// The update doesn't change the expirations of the session
+	update := got
+	update.AccessToken = "at_new"
+	update.SessionExpiresAt = time.Time{}
+	update.AbsoluteExpiresAt = time.Time{}
+
+	if err = db.Update(context.TODO(), id, update); err != nil {
+		t.Fatalf("Update() the version should not be changed by Touch, error = %v", err)
+	}
+
+	got, err = db.Get(context.TODO(), id)
+	if err != nil {
+		t.Fatalf("Get() fatal error = %v", err)
+	}
+
+	if !got.SessionExpiresAt.Equal(sessionExpiresAt) || !got.AbsoluteExpiresAt.Equal(s.AbsoluteExpiresAt) {
+		t.Errorf("Touch() got = %v, %v, want %v, %v", got.SessionExpiresAt, got.AbsoluteExpiresAt, sessionExpiresAt, s.AbsoluteExpiresAt)
+	}
+
+	if got.AccessToken != "at_new" {
+		t.Errorf("Update() got = %s, want %s", got.AccessToken, "at_new")
+	}
+
+	if err = db.Touch(context.TODO(), "not_found", sessionExpiresAt); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Touch() error = %v, wantErr %v", err, sql.ErrNoRows)
+	}
+}
+
+// testCopySessions copies the sessions from the source to an empty target,
+// and verifies that the sessions that are not expired are saved unchanged,
+// with the same ids. It returns the ids of the sessions copied, it's used by
+// all the backends.
+func testCopySessions(t *testing.T, source, target SessionImpl) []string {
+	// The sessions are removed from the shared databases
+	t.Cleanup(func() {
+		for _, subject := range []string{"copy_01", "copy_02", "copy_03", "stale"} {
+			_, _ = source.DeleteBySubject(context.TODO(), subject)
+			_, _ = target.DeleteBySubject(context.TODO(), subject)
+		}
+	})
+
+	now := time.Now().Round(time.Second)
+	sessions := []SessionData{
+		{Subject: "copy_01", AccessToken: "at_01", RefreshToken: "rt_01", IDToken: "it_01", ExpiresAt: now.Add(5 * time.Minute), SID: "sid_copy_01",
+			SessionExpiresAt: now.Add(30 * time.Minute), AbsoluteExpiresAt: now.Add(12 * time.Hour)},
+		{Subject: "copy_01", AccessToken: "at_02", RefreshToken: "rt_02", IDToken: "it_02", ExpiresAt: now.Add(-5 * time.Minute),
+			SessionExpiresAt: now.Add(30 * time.Minute)},
+		{Subject: "copy_02", AccessToken: "at_03", RefreshToken: "rt_03", IDToken: "it_03", ExpiresAt: now.Add(5 * time.Minute)},
+	}
+
+	ids := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		id, err := source.Add(context.TODO(), s)
+		if err != nil {
+			t.Fatalf("Add() fatal error = %v", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	// The version of the updated session is kept
+	updated := sessions[0]
+	updated.AccessToken = "at_01_new"
+	if err := source.Update(context.TODO(), ids[0], updated); err != nil {
+		t.Fatalf("Update() fatal error = %v", err)
+	}
+
+	expiredID, err := source.Add(context.TODO(), SessionData{Subject: "copy_03", AccessToken: "at_04", RefreshToken: "rt_04", IDToken: "it_04",
+		ExpiresAt: now.Add(-time.Hour), SessionExpiresAt: now.Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("Add() fatal error = %v", err)
+	}
+
+	// A session with the same id is replaced
+	if err = target.Import(context.TODO(), ids[2], SessionData{Subject: "stale", AccessToken: "at", RefreshToken: "rt", IDToken: "it", ExpiresAt: now}); err != nil {
+		t.Fatalf("Import() fatal error = %v", err)
+	}
+
+	count, err := CopySessions(context.TODO(), source, target)
+	if err != nil {
+		t.Fatalf("CopySessions() error = %v", err)
+	}
+
+	if count < int64(len(ids)) {
+		t.Errorf("CopySessions() got = %d, want at least %d", count, len(ids))
+	}
+
+	for _, id := range ids {
+		want, err := source.Get(context.TODO(), id)
+		if err != nil {
+			t.Fatalf("Get() fatal error = %v", err)
+		}
+
+		got, err := target.Get(context.TODO(), id)
+		if err != nil {
+			t.Fatalf("Get() the session %s was not copied, error = %v", id, err)
+		}
+
+		if got.Subject != want.Subject || got.AccessToken != want.AccessToken || got.RefreshToken != want.RefreshToken || got.IDToken != want.IDToken ||
+			got.SID != want.SID || got.Version != want.Version || !got.ExpiresAt.Equal(want.ExpiresAt) ||
+			!got.SessionExpiresAt.Equal(want.SessionExpiresAt) || !got.AbsoluteExpiresAt.Equal(want.AbsoluteExpiresAt) {
+			t.Errorf("CopySessions() got = %+v, want %+v", got, want)
+		}
+	}
+
+	if _, err = target.Get(context.TODO(), expiredID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("CopySessions() the expired session was copied, error = %v", err)
+	}
+
+	// The copied sessions can be found by subject
+	list, err := target.ListBySubject(context.TODO(), "copy_01")
+	if err != nil {
+		t.Fatalf("ListBySubject() fatal error = %v", err)
+	}
+
+	if len(list) != 2 {
+		t.Errorf("ListBySubject() got %d sessions, want %d", len(list), 2)
+	}
+
+	return ids
+}
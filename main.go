@@ -2,16 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
+	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/gandalfmagic/go-token-handler/admin"
+	"github.com/gandalfmagic/go-token-handler/authorization"
 	"github.com/gandalfmagic/go-token-handler/config"
+	"github.com/gandalfmagic/go-token-handler/cors"
 	"github.com/gandalfmagic/go-token-handler/database"
 	"github.com/gandalfmagic/go-token-handler/oidc"
 	"github.com/gandalfmagic/go-token-handler/opentelemetry"
@@ -59,13 +65,7 @@ func main() {
 	}
 
 	// Connect to the database
-	var sessionImpl database.SessionImpl
-	switch c.DBType {
-	case "sqlite":
-		sessionImpl, err = database.NewSQLiteSessionImpl(ctx, cipher, c.DBName)
-	case "postgresql":
-		sessionImpl, err = database.NewPostgresqlSessionImpl(ctx, cipher, c.DBHost, c.DBName, c.DBUsername, c.DBPassword)
-	}
+	sessionImpl, err := newSessionImpl(ctx, c, cipher)
 	if err != nil {
 		zlog.Fatal("error creating a database connection", zap.Error(err))
 	}
@@ -75,6 +75,22 @@ func main() {
 		}
 	}()
 
+	// The migrations of the schema are applied by the database connection
+	if c.MigrateOnly {
+		zlog.Info("the database schema is up to date", zap.String("db-type", c.DBType))
+		return
+	}
+
+	if c.Command == config.CommandMigrateSessions {
+		count, err := migrateSessions(ctx, c, sessionImpl)
+		if err != nil {
+			zlog.Fatal("error migrating the sessions", zap.Int64("sessions", count), zap.Error(err))
+		}
+
+		zlog.Info("the sessions have been migrated", zap.Int64("sessions", count))
+		return
+	}
+
 	oidcConfig, err := oidc.NewConfiguration(c.OidcClientID, c.OidcClientSecret, c.OidcIssuer, c.OidcRedirectURL)
 	if err != nil {
 		zlog.Fatal("error creating a new oidc configuration", zap.Error(err))
@@ -90,11 +106,20 @@ func main() {
 			Authentication: c.SessionOldAuthSecret,
 			Encryption:     c.SessionOldEncSecret,
 		},
-		CookieName:     c.CookieName,
-		CookieDomain:   c.CookieDomain,
-		LoginTimeout:   5 * time.Minute,
-		SessionTimeout: 30 * time.Minute,
-		SessionImpl:    sessionImpl,
+		CookieName:         c.CookieName,
+		CookieDomain:       c.CookieDomain,
+		CookiePath:         c.CookiePath,
+		CookieSameSite:     c.CookieSameSiteMode(),
+		CookieInsecure:     !c.CookieSecure,
+		LoginTimeout:       c.LoginTimeout,
+		SessionTimeout:     c.SessionTimeout,
+		SessionMaxLifetime: c.SessionMaxLifetime,
+		SessionImpl:        sessionImpl,
+
+		RefreshSkew:               c.TokenRefreshSkew,
+		BackgroundRefreshInterval: c.BackgroundRefreshInterval,
+		BackgroundRefreshWindow:   c.BackgroundRefreshWindow,
+		CSRFProtection:            c.CSRFProtection,
 	}
 	sessionManager, err := sessions.NewManager(ctx, mc)
 	if err != nil {
@@ -102,14 +127,24 @@ func main() {
 	}
 	defer sessionManager.WaitSessionCleaner(ctx)
 
+	go sessionManager.RunBackgroundRefresher(ctx, oidcConfig)
+
 	mux := http.NewServeMux()
 
 	// Set up the HTTP routes
-	// TODO: add CORS, all the endpoints use the SPA as origin, the login callback uses Keycloak
-	mux.Handle("/login", opentelemetry.Middleware(sessionManager.LoginHandlerOidc(oidcConfig), "gitlab.oitech.it/devops/token-handler", "GET /login"))
+	// The endpoints called by the SPA use the CORS policy, the login callback
+	// and the back-channel logout are called by the auth server
+	corsPolicy, err := newCORSPolicy(c.CORS())
+	if err != nil {
+		zlog.Fatal("cannot create the CORS policy", zap.Error(err))
+	}
+
+	mux.Handle("/login", opentelemetry.Middleware(corsPolicy.Middleware(sessionManager.LoginHandlerOidc(oidcConfig)), "gitlab.oitech.it/devops/token-handler", "GET /login"))
 	mux.Handle("/callback", opentelemetry.Middleware(sessionManager.CallbackHandlerOidc(oidcConfig, c.OidcPostLoginRedirectURL), "gitlab.oitech.it/devops/token-handler", "GET /callback"))
-	mux.Handle("/logout", opentelemetry.Middleware(sessionManager.LogoutHandlerOidc(oidcConfig, c.OidcPostLogoutRedirectURL), "gitlab.oitech.it/devops/token-handler", "GET /logout"))
-	mux.Handle("/userinfo", opentelemetry.Middleware(sessionManager.UserInfoHandlerOidc(oidcConfig), "gitlab.oitech.it/devops/token-handler", "GET /userinfo"))
+	mux.Handle("/logout", opentelemetry.Middleware(corsPolicy.Middleware(sessionManager.LogoutHandlerOidc(oidcConfig, c.OidcPostLogoutRedirectURL)), "gitlab.oitech.it/devops/token-handler", "GET /logout"))
+	mux.Handle("/backchannel-logout", opentelemetry.Middleware(sessionManager.BackChannelLogoutHandlerOidc(oidcConfig), "gitlab.oitech.it/devops/token-handler", "POST /backchannel-logout"))
+	mux.Handle("/userinfo", opentelemetry.Middleware(corsPolicy.Middleware(sessionManager.UserInfoHandlerOidc(oidcConfig)), "gitlab.oitech.it/devops/token-handler", "GET /userinfo"))
+	mux.Handle("/csrf-token", opentelemetry.Middleware(corsPolicy.Middleware(sessionManager.CSRFTokenHandlerOidc(oidcConfig)), "gitlab.oitech.it/devops/token-handler", "GET /csrf-token"))
 
 	if c.ProxyConfig != "" {
 		proxyConfigs, err := c.ReadProxyConfig()
@@ -118,18 +153,62 @@ func main() {
 		}
 
 		for _, proxyConfig := range proxyConfigs.Proxies {
-			zlog.Info(fmt.Sprintf("creating proxy for service %s on %s", proxyConfig.Target, proxyConfig.Endpoint))
-			proxy, err := NewProxy(ctx, proxyConfig.Target, ProxyConfig{
-				IdleConnTimeout: proxyConfig.Parameters.IdleConnTimeout,
-				MaxIdleConns:    proxyConfig.Parameters.MaxIdleConns,
-				KeepAlive:       proxyConfig.Parameters.DialKeepAlive,
-				Timeout:         proxyConfig.Parameters.DialTimeout,
+			targets := proxyConfig.TargetURLs()
+			zlog.Info(fmt.Sprintf("creating proxy for service %s on %s", strings.Join(targets, ", "), proxyConfig.Endpoint))
+			proxy, err := NewProxy(ctx, targets, ProxyConfig{
+				IdleConnTimeout:     proxyConfig.Parameters.IdleConnTimeout,
+				MaxIdleConns:        proxyConfig.Parameters.MaxIdleConns,
+				KeepAlive:           proxyConfig.Parameters.DialKeepAlive,
+				Timeout:             proxyConfig.Parameters.DialTimeout,
+				StripPrefix:         proxyConfig.StripPrefix,
+				RewriteMatch:        proxyConfig.Rewrite.Match,
+				RewriteReplace:      proxyConfig.Rewrite.Replace,
+				LoadBalancing:       proxyConfig.LoadBalancing,
+				HealthCheckPath:     proxyConfig.HealthCheck.Path,
+				HealthCheckInterval: proxyConfig.HealthCheck.Interval,
+				HealthCheckTimeout:  proxyConfig.HealthCheck.Timeout,
+				MaxFailures:         proxyConfig.PassiveHealthCheck.MaxFailures,
+				EjectionTime:        proxyConfig.PassiveHealthCheck.EjectionTime,
+				TLSHandshakeTimeout: proxyConfig.Parameters.TLSHandshakeTimeout,
+				ResponseTimeout:     proxyConfig.Parameters.ResponseTimeout,
+				RequestTimeout:      proxyConfig.Parameters.RequestTimeout,
+				RetryAttempts:       proxyConfig.Retry.Attempts,
+				RetryBackoff:        proxyConfig.Retry.Backoff,
+				TLS: ProxyTLSConfig{
+					CAFile:             proxyConfig.TLS.CAFile,
+					CertFile:           proxyConfig.TLS.CertFile,
+					KeyFile:            proxyConfig.TLS.KeyFile,
+					ServerName:         proxyConfig.TLS.ServerName,
+					MinVersion:         proxyConfig.TLS.MinVersion,
+					InsecureSkipVerify: proxyConfig.TLS.InsecureSkipVerify,
+				},
 			})
 			if err != nil {
-				zlog.Fatal(fmt.Sprintf("error creating proxy service for %s on %s", proxyConfig.Target, proxyConfig.Endpoint), zap.Error(err))
+				zlog.Fatal(fmt.Sprintf("error creating proxy service for %s on %s", strings.Join(targets, ", "), proxyConfig.Endpoint), zap.Error(err))
+			}
+
+			claimMatchers, err := authorization.ParseClaimMatchers(proxyConfig.Authorization.Claims)
+			if err != nil {
+				zlog.Fatal(fmt.Sprintf("error reading the authorization rules for %s", proxyConfig.Endpoint), zap.Error(err))
+			}
+
+			rules := authorization.Rules{
+				RolesClaim:  proxyConfig.Authorization.RolesClaim,
+				GroupsClaim: proxyConfig.Authorization.GroupsClaim,
+				Roles:       proxyConfig.Authorization.Roles,
+				Groups:      proxyConfig.Authorization.Groups,
+				Scopes:      proxyConfig.Authorization.Scopes,
+				Claims:      claimMatchers,
+			}
+
+			// The preflight requests are answered before the authentication,
+			// the browsers never send the cookies with them
+			proxyCORSPolicy, err := newCORSPolicy(c.CORS().Override(proxyConfig.CORS))
+			if err != nil {
+				zlog.Fatal(fmt.Sprintf("error creating the CORS policy for %s", proxyConfig.Endpoint), zap.Error(err))
 			}
 
-			mux.Handle(proxyConfig.Endpoint, opentelemetry.Middleware(sessionManager.AuthenticationMiddleware(oidcConfig, http.HandlerFunc(ProxyRequestHandler(proxy))), "gitlab.oitech.it/devops/token-handler", "GET /proxy"))
+			mux.Handle(proxyConfig.Endpoint, opentelemetry.Middleware(proxyCORSPolicy.Middleware(sessionManager.AuthenticationMiddleware(oidcConfig, authorization.Middleware(oidcConfig, rules, http.HandlerFunc(ProxyRequestHandler(proxy))))), "gitlab.oitech.it/devops/token-handler", "GET /proxy"))
 		}
 	}
 
@@ -139,21 +218,198 @@ func main() {
 
 	mux.Handle("/", opentelemetry.Middleware(http.HandlerFunc(rootHandler), "gitlab.oitech.it/devops/token-handler", "GET /"))
 
-	// Start the HTTP server
+	// Start the HTTP server, HTTP/2 is enabled when it uses TLS
+	server := &http.Server{
+		Addr:              c.ListenAddr,
+		Handler:           zlog.Middleware(mux),
+		ReadTimeout:       c.ServerReadTimeout,
+		ReadHeaderTimeout: c.ServerReadHeaderTimeout,
+		WriteTimeout:      c.ServerWriteTimeout,
+		IdleTimeout:       c.ServerIdleTimeout,
+	}
+
+	if c.TLSCertFile != "" {
+		if server.TLSConfig, err = newServerTLSConfig(ctx, c); err != nil {
+			zlog.Fatal("error loading the tls configuration", zap.Error(err))
+		}
+	}
+
 	zlog.Info(fmt.Sprintf("main service is listening on %s", c.ListenAddr))
 	go func() {
-		if err = http.ListenAndServe(c.ListenAddr, zlog.Middleware(mux)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if server.TLSConfig != nil {
+			// The certificate is returned by the GetCertificate function
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			zlog.Fatal("error starting the api server", zap.Error(err))
 			stop()
 		}
 	}()
 
+	// Start the admin HTTP server, on a separate listener
+	var adminServer *http.Server
+	if c.AdminListenAddr != "" {
+		adminServer = &http.Server{
+			Addr:              c.AdminListenAddr,
+			Handler:           zlog.Middleware(admin.TokenMiddleware(c.AdminToken, admin.NewHandler(sessionImpl))),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		if c.AdminTLSClientCAFile != "" {
+			if adminServer.TLSConfig, err = admin.ClientCertTLSConfig(c.AdminTLSClientCAFile); err != nil {
+				zlog.Fatal("error reading the admin api client CA", zap.Error(err))
+			}
+		}
+
+		zlog.Info(fmt.Sprintf("admin service is listening on %s", c.AdminListenAddr))
+		go func() {
+			var err error
+			if c.AdminTLSCertFile != "" {
+				err = adminServer.ListenAndServeTLS(c.AdminTLSCertFile, c.AdminTLSKeyFile)
+			} else {
+				err = adminServer.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				zlog.Fatal("error starting the admin server", zap.Error(err))
+				stop()
+			}
+		}()
+	}
+
 	// Listen for the interrupt signal.
 	<-ctx.Done()
 
 	// Restore default behavior on the interrupt signal and notify user of shutdown.
 	zlog.Info("shutting down gracefully, press Ctrl+C again to force")
 	stop()
+
+	// Wait for the requests in progress
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		zlog.Error("error shutting down the api server", zap.Error(err))
+	}
+
+	if adminServer != nil {
+		if err = adminServer.Shutdown(shutdownCtx); err != nil {
+			zlog.Error("error shutting down the admin server", zap.Error(err))
+		}
+	}
+}
+
+// newServerTLSConfig returns the TLS configuration of the main service, the
+// certificate is reloaded when its files change, until the context is done.
+func newServerTLSConfig(ctx context.Context, c config.Config) (*tls.Config, error) {
+	reloader, err := newCertificateReloader(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}
+
+	// The client certificates are optional, unless the require mode is used,
+	// but they are always verified when they are sent
+	if c.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(c.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the client CA: %w", err)
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("the client CA file doesn't contain a valid certificate: %s", c.TLSClientCAFile)
+		}
+
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.TLSClientAuth == config.TLSClientAuthRequire {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	go reloader.watch(ctx, defaultCertificateReloadInterval)
+
+	return tlsConfig, nil
+}
+
+// newSessionImpl connects to the database configured by the db-* parameters.
+func newSessionImpl(ctx context.Context, c config.Config, cipher encryption.HexCipher) (database.SessionImpl, error) {
+	switch c.DBType {
+	case "sqlite":
+		return database.NewSQLiteSessionImpl(ctx, cipher, c.DBName)
+	case "postgresql":
+		return database.NewPostgresqlSessionImpl(ctx, cipher, database.PostgresqlConfig{
+			DSN:               c.DBDSN,
+			Host:              c.DBHost,
+			Port:              c.DBPort,
+			Database:          c.DBName,
+			Username:          c.DBUsername,
+			Password:          c.DBPassword,
+			SSLMode:           c.DBSSLMode,
+			SSLRootCert:       c.DBSSLRootCert,
+			SSLCert:           c.DBSSLCert,
+			SSLKey:            c.DBSSLKey,
+			SearchPath:        c.DBSearchPath,
+			ApplicationName:   c.DBApplicationName,
+			MinConns:          c.DBMinConns,
+			MaxConns:          c.DBMaxConns,
+			HealthCheckPeriod: c.DBHealthCheckPeriod,
+			ConnectTimeout:    c.DBConnectTimeout,
+		})
+	case "redis":
+		return database.NewRedisSessionImpl(ctx, cipher, c.DBHost, c.DBUsername, c.DBPassword, c.RedisDatabase(), c.SessionTimeout)
+	default:
+		return database.NewMemorySessionImpl(ctx, cipher, c.SessionTimeout)
+	}
+}
+
+// migrateSessions copies the sessions to the target database of the
+// migrate-sessions command, encrypting the tokens with the key of the target.
+// It returns the number of sessions copied.
+func migrateSessions(ctx context.Context, c config.Config, source database.SessionImpl) (int64, error) {
+	t, err := c.LoadMigrateTargetConfig()
+	if err != nil {
+		return 0, err
+	}
+
+	cipher, err := encryption.NewXChaCha20Cipher(t.SessionDBKey, "")
+	if err != nil && !errors.Is(err, encryption.ErrNoEncryptionKeys) {
+		return 0, fmt.Errorf("cannot initialize the encryption of the target database: %w", err)
+	}
+
+	target, err := newSessionImpl(ctx, t, cipher)
+	if err != nil {
+		return 0, fmt.Errorf("cannot connect to the target database: %w", err)
+	}
+	defer func() {
+		_ = target.CloseConnection(ctx)
+	}()
+
+	return database.CopySessions(ctx, source, target)
+}
+
+// newCORSPolicy creates the CORS policy from the configuration, the policy is
+// nil if no origin is allowed.
+func newCORSPolicy(data config.CORSConfigData) (*cors.Policy, error) {
+	options := cors.Options{
+		AllowedOrigins: data.AllowedOrigins,
+		AllowedMethods: data.AllowedMethods,
+		AllowedHeaders: data.AllowedHeaders,
+		ExposedHeaders: data.ExposedHeaders,
+	}
+
+	if data.AllowCredentials != nil {
+		options.AllowCredentials = *data.AllowCredentials
+	}
+
+	if data.MaxAge != nil {
+		options.MaxAge = *data.MaxAge
+	}
+
+	return cors.NewPolicy(options)
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
@@ -161,7 +417,7 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // ProxyRequestHandler handles the http request using proxy
-func ProxyRequestHandler(proxy *httputil.ReverseProxy) func(http.ResponseWriter, *http.Request) {
+func ProxyRequestHandler(proxy http.Handler) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		proxy.ServeHTTP(w, r)
 	}
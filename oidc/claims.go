@@ -0,0 +1,81 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gandalfmagic/go-token-handler/opentelemetry"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// Claims contains the decoded claims of one or more JWT tokens.
+type Claims map[string]interface{}
+
+// Lookup returns the value of a claim, the path can be used to navigate inside
+// nested objects using a dot as separator (e.g. `realm_access.roles`).
+func (c Claims) Lookup(path string) (interface{}, bool) {
+	var value interface{} = map[string]interface{}(c)
+
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// GetClaims verifies the id-token and the access-token of a session, and returns
+// their claims merged together. When the same claim is present in both tokens,
+// the value contained in the access-token is used.
+//
+// The expiration of the id-token is not verified, because the validity of the
+// session is already enforced by the session manager. An access-token that is
+// not a JWT (an opaque token) is ignored.
+func (c *Config) GetClaims(ctx context.Context, rawIDToken, accessToken string) (Claims, error) {
+	_, span := opentelemetry.TracerFromContext(ctx).Start(ctx, "oidc: verify and decode the the token claims")
+	defer span.End()
+
+	claims := Claims{}
+
+	idTokenVerifier := c.provider.Verifier(&oidc.Config{ClientID: c.ClientID, SkipExpiryCheck: true})
+
+	idToken, err := idTokenVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify the id-token (1002)")
+	}
+
+	if err = idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode the id-token claims: %w", err)
+	}
+
+	if strings.Count(accessToken, ".") != 2 {
+		return claims, nil
+	}
+
+	// The audience of the access token depends on the auth server configuration
+	accessTokenVerifier := c.provider.Verifier(&oidc.Config{SkipClientIDCheck: true})
+
+	token, err := accessTokenVerifier.Verify(ctx, accessToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify the access-token (1002)")
+	}
+
+	accessTokenClaims := Claims{}
+	if err = token.Claims(&accessTokenClaims); err != nil {
+		return nil, fmt.Errorf("failed to decode the access-token claims: %w", err)
+	}
+
+	for k, v := range accessTokenClaims {
+		claims[k] = v
+	}
+
+	return claims, nil
+}
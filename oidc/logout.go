@@ -0,0 +1,67 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gandalfmagic/go-token-handler/opentelemetry"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+const (
+	backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+)
+
+var (
+	ErrInvalidLogoutToken = errors.New("the logout token is not valid")
+)
+
+// LogoutToken contains the claims of a logout token, at least one between the
+// Subject and the SID is not empty.
+type LogoutToken struct {
+	Subject string
+	SID     string
+}
+
+// VerifyLogoutToken verifies and decodes a logout token, sent by the auth server
+// to the back-channel logout endpoint, following the rules of the OpenID Connect
+// Back-Channel Logout 1.0 specification.
+func (c *Config) VerifyLogoutToken(ctx context.Context, rawToken string) (*LogoutToken, error) {
+	_, span := opentelemetry.TracerFromContext(ctx).Start(ctx, "oidc: verify and decode the the logout-token")
+	defer span.End()
+
+	verifier := c.provider.Verifier(&oidc.Config{ClientID: c.ClientID})
+
+	token, err := verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidLogoutToken, err)
+	}
+
+	var claims struct {
+		SID    string                     `json:"sid"`
+		Nonce  *string                    `json:"nonce"`
+		Events map[string]json.RawMessage `json:"events"`
+	}
+
+	if err = token.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidLogoutToken, err)
+	}
+
+	if _, ok := claims.Events[backChannelLogoutEvent]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidLogoutToken, "missing the back-channel logout event")
+	}
+
+	// The nonce is prohibited, to avoid confusion with an id-token
+	if claims.Nonce != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidLogoutToken, "the nonce claim is not allowed")
+	}
+
+	if token.Subject == "" && claims.SID == "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidLogoutToken, "missing both the sub and the sid claims")
+	}
+
+	return &LogoutToken{Subject: token.Subject, SID: claims.SID}, nil
+}
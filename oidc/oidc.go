@@ -2,6 +2,8 @@ package oidc
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 
 	"github.com/gandalfmagic/go-token-handler/opentelemetry"
@@ -10,9 +12,14 @@ import (
 	"golang.org/x/oauth2"
 )
 
+var (
+	ErrNonceMismatch = errors.New("the id-token nonce doesn't match the expected value")
+)
+
 type Config struct {
 	oauth2.Config
 	issuer        string
+	provider      *oidc.Provider
 	OidcEndpoints Endpoints
 }
 
@@ -22,6 +29,11 @@ func NewConfiguration(clientID, clientSecret, issuer, redirectURL string) (*Conf
 		return nil, err
 	}
 
+	provider, err := oidc.NewProvider(context.Background(), issuer)
+	if err != nil {
+		return nil, err
+	}
+
 	// Configure the OAuth2 client
 	oauthConfig := oauth2.Config{
 		ClientID:     clientID,
@@ -34,7 +46,7 @@ func NewConfiguration(clientID, clientSecret, issuer, redirectURL string) (*Conf
 		RedirectURL: redirectURL,
 	}
 
-	return &Config{oauthConfig, issuer, oidcEndpoints}, nil
+	return &Config{oauthConfig, issuer, provider, oidcEndpoints}, nil
 }
 
 type IDToken struct {
@@ -42,7 +54,9 @@ type IDToken struct {
 	RawToken string
 }
 
-func (c *Config) GetIdToken(ctx context.Context, token *oauth2.Token) (*IDToken, error) {
+// GetIdToken verifies and decodes the id-token contained in the oauth2 token.
+// If the nonce is not empty, it must match the nonce claim of the id-token.
+func (c *Config) GetIdToken(ctx context.Context, token *oauth2.Token, nonce string) (*IDToken, error) {
 	_, span := opentelemetry.TracerFromContext(ctx).Start(ctx, "oidc: verify and decode the the id-token")
 	defer span.End()
 
@@ -65,6 +79,10 @@ func (c *Config) GetIdToken(ctx context.Context, token *oauth2.Token) (*IDToken,
 		return nil, fmt.Errorf("failed to verify the id-token (1002)")
 	}
 
+	if nonce != "" && subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, ErrNonceMismatch
+	}
+
 	return &IDToken{Token: idToken, RawToken: rawIDToken}, nil
 }
 
@@ -0,0 +1,89 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gandalfmagic/go-token-handler/opentelemetry"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+
+	revocationTimeout = 5 * time.Second
+)
+
+var (
+	ErrRevocationNotSupported = errors.New("the auth server doesn't expose a revocation endpoint")
+	ErrUnsupportedTokenType   = errors.New("the auth server doesn't support the revocation of the token type")
+	ErrRevocationFailed       = errors.New("the auth server refused the token revocation")
+)
+
+// RevokeToken revokes a token using the revocation endpoint of the auth server,
+// following RFC 7009. The tokenTypeHint should be one of TokenTypeHintAccessToken
+// or TokenTypeHintRefreshToken.
+//
+// An auth server that doesn't support the revocation of access tokens returns
+// the ErrUnsupportedTokenType error.
+func (c *Config) RevokeToken(ctx context.Context, token, tokenTypeHint string) error {
+	ctx, span := opentelemetry.TracerFromContext(ctx).Start(ctx, "oidc: revoke the "+tokenTypeHint)
+	defer span.End()
+
+	if c.OidcEndpoints.RevocationEndpoint == "" {
+		return ErrRevocationNotSupported
+	}
+
+	// The revocation must not delay the logout for too long
+	ctx, cancel := context.WithTimeout(ctx, revocationTimeout)
+	defer cancel()
+
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", tokenTypeHint)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.OidcEndpoints.RevocationEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+
+	client := http.DefaultClient
+	if hc, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		client = hc
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The auth server responds with 200 also when the token is already
+	// invalid, see RFC 7009 section 2.2
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body)
+
+	if body.Error == "unsupported_token_type" {
+		return fmt.Errorf("%w: %s", ErrUnsupportedTokenType, tokenTypeHint)
+	}
+
+	return fmt.Errorf("%w: status %d, error %q", ErrRevocationFailed, resp.StatusCode, body.Error)
+}
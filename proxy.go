@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/gandalfmagic/go-token-handler/sessions"
@@ -21,17 +27,289 @@ type ProxyConfig struct {
 	KeepAlive       time.Duration
 	MaxIdleConns    int
 	IdleConnTimeout time.Duration
+	// StripPrefix is removed from the path of the requests, before the
+	// rewrite
+	StripPrefix string
+	// RewriteMatch is a regular expression matched against the path of the
+	// requests, the matches are replaced with RewriteReplace, that can
+	// reference the groups using $1 or ${name}
+	RewriteMatch   string
+	RewriteReplace string
+	// LoadBalancing selects the target of every request, round-robin or
+	// least-connections
+	LoadBalancing string
+	// HealthCheckPath is requested to every target each HealthCheckInterval,
+	// the active health checks are disabled if it's empty
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	// MaxFailures is the number of consecutive transport errors or 5xx
+	// responses that ejects a target for the EjectionTime, the passive
+	// ejection is disabled if it's 0
+	MaxFailures  int
+	EjectionTime time.Duration
+	// TLSHandshakeTimeout is the maximum time to wait for the TLS handshake
+	// with a target, the default is 10s
+	TLSHandshakeTimeout time.Duration
+	// ResponseTimeout is the maximum time to wait for the response headers of
+	// a target, after the request is sent
+	ResponseTimeout time.Duration
+	// RequestTimeout is the maximum duration of a request, including the
+	// retries and the copy of the response body
+	RequestTimeout time.Duration
+	// RetryAttempts is the number of retries of the idempotent requests
+	// without a body, after a transport error or a 502, 503 or 504 response;
+	// the retries are disabled if it's 0
+	RetryAttempts int
+	// RetryBackoff is the wait before the first retry, it's doubled at every
+	// retry, the default is 100ms
+	RetryBackoff time.Duration
+	TLS          ProxyTLSConfig
 }
 
-func NewProxy(ctx context.Context, targetHost string, config ProxyConfig) (*httputil.ReverseProxy, error) {
-	targetURL, err := url.Parse(targetHost)
+// ProxyTLSConfig configures the TLS connections to the targets.
+type ProxyTLSConfig struct {
+	// CAFile contains the CAs used to verify the certificates of the targets,
+	// instead of the system CAs
+	CAFile string
+	// CertFile and KeyFile are the client certificate sent to the targets
+	CertFile string
+	KeyFile  string
+	// ServerName is used to verify the certificates of the targets, and it's
+	// sent in the SNI extension, instead of the host of the target
+	ServerName string
+	// MinVersion is 1.2 or 1.3, the default is 1.2
+	MinVersion string
+	// InsecureSkipVerify disables the verification of the certificates of the
+	// targets, it must not be used in production
+	InsecureSkipVerify bool
+}
+
+// tlsVersions are the values of the minimum TLS version.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig returns the TLS configuration of the transport, it fails if the
+// certificates cannot be loaded.
+func (c ProxyTLSConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("the tls min version must be a value from: 1.2, 1.3")
+		}
+
+		config.MinVersion = version
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the tls ca file: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("the tls ca file doesn't contain a valid certificate: %s", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load the tls client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+const (
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultRetryBackoff        = 100 * time.Millisecond
+)
+
+// errRetryResponse is returned by ModifyResponse to discard a response that
+// will be retried.
+var errRetryResponse = errors.New("the target responded with a retryable status")
+
+// Proxy forwards the requests of a route to its targets.
+type Proxy struct {
+	proxy          *httputil.ReverseProxy
+	upstream       *upstreamPool
+	requestTimeout time.Duration
+	retryAttempts  int
+	retryBackoff   time.Duration
+}
+
+// proxyRequestKey is the context key of the state of a proxied request.
+type proxyRequestKey struct{}
+
+// proxyRequest is the state of a proxied request, shared by the handlers of
+// the reverse proxy.
+type proxyRequest struct {
+	upstream *upstream
+	failed   bool
+	// retry is true if the request can be retried after a failure, in that
+	// case the error handler saves the error in err, without responding
+	retry bool
+	err   error
+}
+
+// isRetryable returns true for the requests with an idempotent method and
+// without a body, that can be sent again to a target.
+func isRetryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return r.ContentLength == 0 && (r.Body == nil || r.Body == http.NoBody)
+	default:
+		return false
+	}
+}
+
+// isRetryableStatus returns true for the statuses of a target that can be
+// temporarily unavailable.
+func isRetryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// isTimeout returns true if the error is caused by a timeout of the request,
+// or of the connection with the target.
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// pathRewriter computes the path of the upstream request from the path of the
+// incoming request, the paths are escaped.
+type pathRewriter struct {
+	stripPrefix string
+	match       *regexp.Regexp
+	replace     string
+}
+
+// rewrite strips the prefix from the path, and applies the rewrite.
+func (p pathRewriter) rewrite(path string) string {
+	// The prefix is removed only if it matches whole path segments
+	if prefix := strings.TrimSuffix(p.stripPrefix, "/"); prefix != "" {
+		if path == prefix {
+			path = ""
+		} else if strings.HasPrefix(path, prefix+"/") {
+			path = path[len(prefix):]
+		}
+	}
+
+	if p.match != nil {
+		path = p.match.ReplaceAllString(path, p.replace)
+	}
+
+	return path
+}
+
+// joinPath appends a path to the path of the target, with a single slash
+// between them. An empty path is the path of the target.
+func joinPath(base, path string) string {
+	if path == "" {
+		return base
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return strings.TrimSuffix(base, "/") + path
+}
+
+// joinQuery appends the query of the request to the query of the target.
+func joinQuery(base, query string) string {
+	if base == "" || query == "" {
+		return base + query
+	}
+
+	return base + "&" + query
+}
+
+// NewProxy creates the proxy of a route, that balances the requests between
+// the targets. The active health checks run until the context is done.
+func NewProxy(ctx context.Context, targets []string, config ProxyConfig) (*Proxy, error) {
+	pool, err := newUpstreamPool(targets, config)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.StripPrefix != "" && !strings.HasPrefix(config.StripPrefix, "/") {
+		return nil, fmt.Errorf("the strip prefix must start with a slash: %s", config.StripPrefix)
+	}
+
+	rewriter := pathRewriter{stripPrefix: config.StripPrefix, replace: config.RewriteReplace}
+	if config.RewriteMatch != "" {
+		if rewriter.match, err = regexp.Compile(config.RewriteMatch); err != nil {
+			return nil, fmt.Errorf("cannot compile the rewrite expression: %w", err)
+		}
+	}
+
+	if config.TLSHandshakeTimeout < 0 || config.ResponseTimeout < 0 || config.RequestTimeout < 0 {
+		return nil, fmt.Errorf("the proxy timeouts must not be negative")
+	}
+
+	if config.TLSHandshakeTimeout == 0 {
+		config.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+
+	if config.RetryAttempts < 0 || config.RetryBackoff < 0 {
+		return nil, fmt.Errorf("the retry attempts and the retry backoff must not be negative")
+	}
+
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+
+	tlsConfig, err := config.TLS.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   config.Timeout,
+			KeepAlive: config.KeepAlive,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          config.MaxIdleConns,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseTimeout,
+	}
+
 	proxy := &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
-			r.URL = targetURL
+			// The URL of the target is shared by all the requests, only its
+			// parts are copied
+			targetURL := r.Context().Value(proxyRequestKey{}).(*proxyRequest).upstream.url
+			path := joinPath(targetURL.EscapedPath(), rewriter.rewrite(r.URL.EscapedPath()))
+			r.URL.Scheme = targetURL.Scheme
+			r.URL.Host = targetURL.Host
+			r.URL.RawQuery = joinQuery(targetURL.RawQuery, r.URL.RawQuery)
+
+			// An invalid escape produced by the rewrite is escaped again
+			if unescaped, err := url.PathUnescape(path); err == nil {
+				r.URL.Path, r.URL.RawPath = unescaped, path
+			} else {
+				r.URL.Path, r.URL.RawPath = path, ""
+			}
+
 			r.Host = targetURL.Host
 			rCtx := r.Context()
 
@@ -46,23 +324,117 @@ func NewProxy(ctx context.Context, targetHost string, config ProxyConfig) (*http
 			r.Header.Add("X-Forwarded-For", r.RemoteAddr)
 			otel.GetTextMapPropagator().Inject(rCtx, propagation.HeaderCarrier(r.Header))
 		},
-		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-			zlogger.FromContext(ctx).JsonError(w, http.StatusBadGateway, "reverse proxy error", err)
+		ModifyResponse: func(resp *http.Response) error {
+			state := resp.Request.Context().Value(proxyRequestKey{}).(*proxyRequest)
+			if resp.StatusCode >= http.StatusInternalServerError {
+				state.failed = true
+			}
+
+			// The response is discarded only if the request can be retried,
+			// the last attempt is always returned to the client
+			if state.retry && isRetryableStatus(resp.StatusCode) {
+				return errRetryResponse
+			}
+
+			return nil
 		},
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   config.Timeout,
-				KeepAlive: config.KeepAlive,
-			}).DialContext,
-			ForceAttemptHTTP2: true,
-			MaxIdleConns:      config.MaxIdleConns,
-			IdleConnTimeout:   config.IdleConnTimeout,
-			//TLSHandshakeTimeout:   10 * time.Second,
-			//ExpectContinueTimeout: 1 * time.Second,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			state := r.Context().Value(proxyRequestKey{}).(*proxyRequest)
+			state.failed = true
+
+			if state.retry && r.Context().Err() == nil {
+				state.err = err
+				return
+			}
+
+			if isTimeout(err) {
+				zlogger.FromContext(r.Context()).JsonError(w, http.StatusGatewayTimeout, "the target did not respond in time", err)
+				return
+			}
+
+			zlogger.FromContext(r.Context()).JsonError(w, http.StatusBadGateway, "reverse proxy error", err)
 		},
+		Transport:     transport,
 		FlushInterval: -1,
 	}
 
-	return proxy, nil
+	if config.HealthCheckPath != "" {
+		if config.HealthCheckInterval < 0 || config.HealthCheckTimeout < 0 {
+			return nil, fmt.Errorf("the health check interval and timeout must not be negative")
+		}
+
+		if config.HealthCheckInterval == 0 {
+			config.HealthCheckInterval = defaultHealthCheckInterval
+		}
+
+		if config.HealthCheckTimeout == 0 {
+			config.HealthCheckTimeout = defaultHealthCheckTimeout
+		}
+
+		client := &http.Client{Transport: transport, Timeout: config.HealthCheckTimeout}
+		go pool.runHealthChecks(ctx, client, config.HealthCheckPath, config.HealthCheckInterval)
+	}
+
+	return &Proxy{
+		proxy:          proxy,
+		upstream:       pool,
+		requestTimeout: config.RequestTimeout,
+		retryAttempts:  config.RetryAttempts,
+		retryBackoff:   config.RetryBackoff,
+	}, nil
+}
+
+// ServeHTTP forwards the request to one of the available targets, it responds
+// with 503 if no target is available. The retries can be sent to a different
+// target.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if p.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.requestTimeout)
+		defer cancel()
+	}
+
+	retries := 0
+	if isRetryable(r) {
+		retries = p.retryAttempts
+	}
+
+	backoff := p.retryBackoff
+	for attempt := 0; ; attempt++ {
+		if !p.forward(w, r.WithContext(ctx), attempt < retries) {
+			return
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			zlogger.FromContext(r.Context()).JsonError(w, http.StatusGatewayTimeout, "the target did not respond in time", ctx.Err())
+			return
+		case <-timer.C:
+		}
+
+		backoff *= 2
+	}
+}
+
+// forward sends the request to one of the available targets, it returns true
+// if the request failed and must be retried, without responding to the
+// client.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, retry bool) bool {
+	u := p.upstream.pick()
+	if u == nil {
+		zlogger.FromContext(r.Context()).JsonError(w, http.StatusServiceUnavailable, "no healthy target available", nil)
+		return false
+	}
+
+	state := &proxyRequest{upstream: u, retry: retry}
+	defer func() {
+		p.upstream.done(u, state.failed)
+	}()
+
+	p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyRequestKey{}, state)))
+
+	return state.err != nil
 }
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gandalfmagic/go-token-handler/zlogger"
+)
+
+// newTestContext returns a context with a logger, used by the proxy.
+func newTestContext(t *testing.T) context.Context {
+	t.Helper()
+
+	zlog, err := zlogger.NewLogger("fatal", false)
+	if err != nil {
+		t.Fatalf("NewLogger() fatal error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(zlogger.NewContext(context.Background(), zlog))
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+// newTestRequest returns a request with the logger of newTestContext, like the
+// requests wrapped by the zlogger Middleware.
+func newTestRequest(t *testing.T, method, target string, body io.Reader) *http.Request {
+	t.Helper()
+
+	return httptest.NewRequest(method, target, body).WithContext(newTestContext(t))
+}
+
+// newTestBackend starts a backend that responds with the status returned by
+// the status function, and with its name in the X-Backend header.
+func newTestBackend(t *testing.T, name string, status func(r *http.Request) int) *httptest.Server {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", name)
+		w.WriteHeader(status(r))
+	}))
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+func statusOK(_ *http.Request) int {
+	return http.StatusOK
+}
+
+func statusOKHandler(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestNewProxy_Path(t *testing.T) {
+	// The backend returns the path and the query of the upstream request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.EscapedPath())
+		w.Header().Set("X-Query", r.URL.RawQuery)
+		w.Header().Set("X-Host", r.Host)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name      string
+		target    string
+		config    ProxyConfig
+		request   string
+		wantPath  string
+		wantQuery string
+	}{
+		{name: "root_target", target: backend.URL, request: "/proxy/users/42?x=1", wantPath: "/proxy/users/42", wantQuery: "x=1"},
+		{name: "target_path", target: backend.URL + "/api", request: "/proxy/users/42?x=1", wantPath: "/api/proxy/users/42", wantQuery: "x=1"},
+		{name: "target_path_slash", target: backend.URL + "/api/", request: "/proxy/users/42", wantPath: "/api/proxy/users/42"},
+		{name: "target_query", target: backend.URL + "/api?key=abc", request: "/proxy/users?x=1&y=2", wantPath: "/api/proxy/users", wantQuery: "key=abc&x=1&y=2"},
+		{name: "strip_prefix", target: backend.URL + "/api", config: ProxyConfig{StripPrefix: "/proxy"}, request: "/proxy/users/42?x=1", wantPath: "/api/users/42", wantQuery: "x=1"},
+		{name: "strip_prefix_slash", target: backend.URL + "/api", config: ProxyConfig{StripPrefix: "/proxy/"}, request: "/proxy/users/42", wantPath: "/api/users/42"},
+		{name: "strip_prefix_whole_path", target: backend.URL + "/api", config: ProxyConfig{StripPrefix: "/proxy"}, request: "/proxy", wantPath: "/api"},
+		{name: "strip_prefix_root_target", target: backend.URL, config: ProxyConfig{StripPrefix: "/proxy"}, request: "/proxy/users", wantPath: "/users"},
+		{name: "strip_prefix_partial_segment", target: backend.URL, config: ProxyConfig{StripPrefix: "/proxy"}, request: "/proxyfoo/users", wantPath: "/proxyfoo/users"},
+		{name: "escaped_path", target: backend.URL + "/api", config: ProxyConfig{StripPrefix: "/proxy"}, request: "/proxy/files/a%2Fb%20c", wantPath: "/api/files/a%2Fb%20c"},
+		{
+			name:     "rewrite",
+			target:   backend.URL + "/api",
+			config:   ProxyConfig{StripPrefix: "/proxy", RewriteMatch: `^/users/(\d+)$`, RewriteReplace: "/v2/user/$1"},
+			request:  "/proxy/users/42?x=1",
+			wantPath: "/api/v2/user/42", wantQuery: "x=1",
+		},
+		{
+			name:     "rewrite_no_match",
+			target:   backend.URL + "/api",
+			config:   ProxyConfig{StripPrefix: "/proxy", RewriteMatch: `^/users/(\d+)$`, RewriteReplace: "/v2/user/$1"},
+			request:  "/proxy/groups/42",
+			wantPath: "/api/groups/42",
+		},
+		{
+			name:     "rewrite_named_group",
+			target:   backend.URL,
+			config:   ProxyConfig{RewriteMatch: `^/legacy/(?P<rest>.*)$`, RewriteReplace: "${rest}"},
+			request:  "/legacy/orders/7",
+			wantPath: "/orders/7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := NewProxy(context.TODO(), []string{tt.target}, tt.config)
+			if err != nil {
+				t.Fatalf("NewProxy() fatal error = %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, newTestRequest(t, http.MethodGet, tt.request, nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("ServeHTTP() status = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			if got := w.Header().Get("X-Path"); got != tt.wantPath {
+				t.Errorf("ServeHTTP() path = %s, want %s", got, tt.wantPath)
+			}
+
+			if got := w.Header().Get("X-Query"); got != tt.wantQuery {
+				t.Errorf("ServeHTTP() query = %s, want %s", got, tt.wantQuery)
+			}
+
+			if got, want := w.Header().Get("X-Host"), backend.Listener.Addr().String(); got != want {
+				t.Errorf("ServeHTTP() host = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestNewProxy_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+		config  ProxyConfig
+	}{
+		{name: "no_targets"},
+		{name: "invalid_target", targets: []string{"http://127.0.0.1", "http://[::1"}},
+		{name: "relative_target", targets: []string{"127.0.0.1:8080"}},
+		{name: "relative_strip_prefix", targets: []string{"http://127.0.0.1"}, config: ProxyConfig{StripPrefix: "proxy"}},
+		{name: "invalid_rewrite", targets: []string{"http://127.0.0.1"}, config: ProxyConfig{RewriteMatch: "^/users/(\\d+$"}},
+		{name: "invalid_load_balancing", targets: []string{"http://127.0.0.1"}, config: ProxyConfig{LoadBalancing: "random"}},
+		{name: "negative_max_failures", targets: []string{"http://127.0.0.1"}, config: ProxyConfig{MaxFailures: -1}},
+		{name: "negative_response_timeout", targets: []string{"http://127.0.0.1"}, config: ProxyConfig{ResponseTimeout: -time.Second}},
+		{name: "negative_retry_attempts", targets: []string{"http://127.0.0.1"}, config: ProxyConfig{RetryAttempts: -1}},
+		{name: "invalid_tls_min_version", targets: []string{"https://127.0.0.1"}, config: ProxyConfig{TLS: ProxyTLSConfig{MinVersion: "1.1"}}},
+		{name: "missing_tls_ca_file", targets: []string{"https://127.0.0.1"}, config: ProxyConfig{TLS: ProxyTLSConfig{CAFile: "/nonexistent/ca.pem"}}},
+		{name: "missing_tls_client_certificate", targets: []string{"https://127.0.0.1"}, config: ProxyConfig{TLS: ProxyTLSConfig{CertFile: "/nonexistent/client.pem", KeyFile: "/nonexistent/client.key"}}},
+		{name: "negative_health_check_interval", targets: []string{"http://127.0.0.1"}, config: ProxyConfig{HealthCheckPath: "/health", HealthCheckInterval: -time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewProxy(context.TODO(), tt.targets, tt.config); err == nil {
+				t.Errorf("NewProxy() error = %v, wantErr true", err)
+			}
+		})
+	}
+}
+
+func TestNewProxy_LoadBalancing(t *testing.T) {
+	first := newTestBackend(t, "first", statusOK)
+	second := newTestBackend(t, "second", statusOK)
+	third := newTestBackend(t, "third", statusOK)
+
+	tests := []struct {
+		name          string
+		loadBalancing string
+		requests      int
+		want          map[string]int
+	}{
+		{name: "default", requests: 6, want: map[string]int{"first": 2, "second": 2, "third": 2}},
+		{name: "round_robin", loadBalancing: LoadBalancingRoundRobin, requests: 9, want: map[string]int{"first": 3, "second": 3, "third": 3}},
+		{name: "least_connections", loadBalancing: LoadBalancingLeastConnections, requests: 6, want: map[string]int{"first": 2, "second": 2, "third": 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := NewProxy(newTestContext(t), []string{first.URL, second.URL, third.URL}, ProxyConfig{LoadBalancing: tt.loadBalancing})
+			if err != nil {
+				t.Fatalf("NewProxy() fatal error = %v", err)
+			}
+
+			got := make(map[string]int)
+			for i := 0; i < tt.requests; i++ {
+				w := httptest.NewRecorder()
+				proxy.ServeHTTP(w, newTestRequest(t, http.MethodGet, "/", nil))
+				got[w.Header().Get("X-Backend")]++
+			}
+
+			for backend, want := range tt.want {
+				if got[backend] != want {
+					t.Errorf("ServeHTTP() backend %s got %d requests, want %d", backend, got[backend], want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewProxy_LeastConnections(t *testing.T) {
+	release := make(chan struct{})
+	slow := newTestBackend(t, "slow", func(r *http.Request) int {
+		<-release
+		return http.StatusOK
+	})
+	fast := newTestBackend(t, "fast", statusOK)
+
+	proxy, err := NewProxy(newTestContext(t), []string{slow.URL, fast.URL}, ProxyConfig{LoadBalancing: LoadBalancingLeastConnections})
+	if err != nil {
+		t.Fatalf("NewProxy() fatal error = %v", err)
+	}
+
+	// The first request is still in progress on the slow backend
+	done := make(chan struct{})
+	r := newTestRequest(t, http.MethodGet, "/", nil)
+	go func() {
+		defer close(done)
+		proxy.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+
+	for proxy.upstream.upstreams[0].active.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newTestRequest(t, http.MethodGet, "/", nil))
+
+		if got := w.Header().Get("X-Backend"); got != "fast" {
+			t.Errorf("ServeHTTP() backend = %s, want %s", got, "fast")
+		}
+	}
+
+	close(release)
+	<-done
+}
+
+func TestNewProxy_PassiveEjection(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+
+	broken := newTestBackend(t, "broken", func(r *http.Request) int {
+		if failing.Load() {
+			return http.StatusInternalServerError
+		}
+
+		return http.StatusOK
+	})
+	healthy := newTestBackend(t, "healthy", statusOK)
+
+	// A target that refuses the connections
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	proxy, err := NewProxy(newTestContext(t), []string{broken.URL, closed.URL, healthy.URL}, ProxyConfig{MaxFailures: 2, EjectionTime: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewProxy() fatal error = %v", err)
+	}
+
+	// Every target receives two requests, the failing targets are ejected
+	// after the second failure
+	statuses := make(map[int]int)
+	for i := 0; i < 6; i++ {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newTestRequest(t, http.MethodGet, "/", nil))
+		statuses[w.Code]++
+	}
+
+	if statuses[http.StatusInternalServerError] != 2 || statuses[http.StatusBadGateway] != 2 || statuses[http.StatusOK] != 2 {
+		t.Errorf("ServeHTTP() statuses = %v, want 2 of 500, 502 and 200", statuses)
+	}
+
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newTestRequest(t, http.MethodGet, "/", nil))
+
+		if got := w.Header().Get("X-Backend"); got != "healthy" {
+			t.Errorf("ServeHTTP() backend = %s, want %s", got, "healthy")
+		}
+	}
+
+	// The ejected targets are used again after the ejection time
+	failing.Store(false)
+	time.Sleep(150 * time.Millisecond)
+
+	got := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newTestRequest(t, http.MethodGet, "/", nil))
+		got[w.Header().Get("X-Backend")]++
+	}
+
+	if got["broken"] == 0 {
+		t.Errorf("ServeHTTP() the target was not used after the ejection time, got %v", got)
+	}
+}
+
+func TestNewProxy_NoAvailableTarget(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	proxy, err := NewProxy(newTestContext(t), []string{closed.URL}, ProxyConfig{MaxFailures: 1})
+	if err != nil {
+		t.Fatalf("NewProxy() fatal error = %v", err)
+	}
+
+	for _, want := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newTestRequest(t, http.MethodGet, "/", nil))
+
+		if w.Code != want {
+			t.Errorf("ServeHTTP() status = %d, want %d", w.Code, want)
+		}
+	}
+}
+
+func TestNewProxy_Timeouts(t *testing.T) {
+	slow := newTestBackend(t, "slow", func(r *http.Request) int {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		return http.StatusOK
+	})
+
+	tests := []struct {
+		name       string
+		config     ProxyConfig
+		wantStatus int
+	}{
+		{name: "no_timeouts", wantStatus: http.StatusOK},
+		{name: "response_timeout", config: ProxyConfig{ResponseTimeout: 50 * time.Millisecond}, wantStatus: http.StatusGatewayTimeout},
+		{name: "request_timeout", config: ProxyConfig{RequestTimeout: 50 * time.Millisecond}, wantStatus: http.StatusGatewayTimeout},
+		{
+			name:       "request_timeout_retries",
+			config:     ProxyConfig{ResponseTimeout: 20 * time.Millisecond, RequestTimeout: 50 * time.Millisecond, RetryAttempts: 10, RetryBackoff: time.Millisecond},
+			wantStatus: http.StatusGatewayTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := NewProxy(newTestContext(t), []string{slow.URL}, tt.config)
+			if err != nil {
+				t.Fatalf("NewProxy() fatal error = %v", err)
+			}
+
+			start := time.Now()
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, newTestRequest(t, http.MethodGet, "/", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			if tt.config.RequestTimeout > 0 && time.Since(start) > 150*time.Millisecond {
+				t.Errorf("ServeHTTP() took %s, want less than the request timeout", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestNewProxy_Retry(t *testing.T) {
+	// A target that refuses the connections
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name         string
+		method       string
+		body         string
+		failures     int64
+		closedTarget bool
+		attempts     int
+		wantStatus   int
+		wantRequests int64
+	}{
+		{name: "disabled", method: http.MethodGet, failures: 1, wantStatus: http.StatusServiceUnavailable, wantRequests: 1},
+		{name: "recovered", method: http.MethodGet, failures: 2, attempts: 2, wantStatus: http.StatusOK, wantRequests: 3},
+		{name: "exhausted", method: http.MethodGet, failures: 3, attempts: 2, wantStatus: http.StatusServiceUnavailable, wantRequests: 3},
+		{name: "idempotent_method", method: http.MethodDelete, failures: 1, attempts: 1, wantStatus: http.StatusOK, wantRequests: 2},
+		{name: "not_idempotent_method", method: http.MethodPost, failures: 1, attempts: 2, wantStatus: http.StatusServiceUnavailable, wantRequests: 1},
+		{name: "request_body", method: http.MethodPut, body: "{}", failures: 1, attempts: 2, wantStatus: http.StatusServiceUnavailable, wantRequests: 1},
+		{name: "connection_error", method: http.MethodGet, closedTarget: true, attempts: 1, wantStatus: http.StatusOK, wantRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			backend := newTestBackend(t, "backend", func(r *http.Request) int {
+				if requests.Add(1) <= tt.failures {
+					return http.StatusServiceUnavailable
+				}
+
+				return http.StatusOK
+			})
+
+			// The closed target is selected first by the round-robin
+			targets := []string{backend.URL}
+			if tt.closedTarget {
+				targets = []string{closed.URL, backend.URL}
+			}
+
+			proxy, err := NewProxy(newTestContext(t), targets, ProxyConfig{RetryAttempts: tt.attempts, RetryBackoff: time.Millisecond})
+			if err != nil {
+				t.Fatalf("NewProxy() fatal error = %v", err)
+			}
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, newTestRequest(t, tt.method, "/", body))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("ServeHTTP() requests = %d, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for the common name,
+// and its key, to temporary files.
+func writeTestCertificate(t *testing.T, commonName string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() fatal error = %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() fatal error = %v", err)
+	}
+
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() fatal error = %v", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey() fatal error = %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "cert.key")
+	writeTestPEM(t, certFile, "CERTIFICATE", der)
+	writeTestPEM(t, keyFile, "PRIVATE KEY", keyDER)
+
+	return certFile, keyFile, cert
+}
+
+func writeTestPEM(t *testing.T, name, blockType string, der []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile() fatal error = %v", err)
+	}
+}
+
+func TestNewProxy_TLS(t *testing.T) {
+	certFile, keyFile, clientCert := writeTestCertificate(t, "token-handler")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	// The certificate of the backends is valid for example.com and 127.0.0.1
+	backend := httptest.NewTLSServer(http.HandlerFunc(statusOKHandler))
+	t.Cleanup(backend.Close)
+
+	mtlsBackend := httptest.NewUnstartedServer(http.HandlerFunc(statusOKHandler))
+	mtlsBackend.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	mtlsBackend.StartTLS()
+	t.Cleanup(mtlsBackend.Close)
+
+	tls12Backend := httptest.NewUnstartedServer(http.HandlerFunc(statusOKHandler))
+	tls12Backend.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	tls12Backend.StartTLS()
+	t.Cleanup(tls12Backend.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeTestPEM(t, caFile, "CERTIFICATE", backend.Certificate().Raw)
+
+	tests := []struct {
+		name       string
+		target     string
+		config     ProxyTLSConfig
+		wantStatus int
+	}{
+		{name: "unknown_ca", target: backend.URL, wantStatus: http.StatusBadGateway},
+		{name: "ca_file", target: backend.URL, config: ProxyTLSConfig{CAFile: caFile}, wantStatus: http.StatusOK},
+		{name: "server_name", target: backend.URL, config: ProxyTLSConfig{CAFile: caFile, ServerName: "example.com"}, wantStatus: http.StatusOK},
+		{name: "wrong_server_name", target: backend.URL, config: ProxyTLSConfig{CAFile: caFile, ServerName: "backend.internal"}, wantStatus: http.StatusBadGateway},
+		{name: "insecure_skip_verify", target: backend.URL, config: ProxyTLSConfig{InsecureSkipVerify: true}, wantStatus: http.StatusOK},
+		{name: "missing_client_certificate", target: mtlsBackend.URL, config: ProxyTLSConfig{CAFile: caFile}, wantStatus: http.StatusBadGateway},
+		{name: "client_certificate", target: mtlsBackend.URL, config: ProxyTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, wantStatus: http.StatusOK},
+		{name: "min_version_1.2", target: tls12Backend.URL, config: ProxyTLSConfig{CAFile: caFile, MinVersion: "1.2"}, wantStatus: http.StatusOK},
+		{name: "min_version_1.3", target: tls12Backend.URL, config: ProxyTLSConfig{CAFile: caFile, MinVersion: "1.3"}, wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := NewProxy(newTestContext(t), []string{tt.target}, ProxyConfig{TLS: tt.config})
+			if err != nil {
+				t.Fatalf("NewProxy() fatal error = %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, newTestRequest(t, http.MethodGet, "/", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
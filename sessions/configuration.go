@@ -3,9 +3,13 @@ package sessions
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gandalfmagic/go-token-handler/database"
+
+	"github.com/gorilla/sessions"
 )
 
 type KeyPair struct {
@@ -14,20 +18,89 @@ type KeyPair struct {
 }
 
 type Configuration struct {
-	CookieName     string
-	CookieDomain   string
+	CookieName   string
+	CookieDomain string
+	// CookiePath is the path of the session cookie, "/" if empty
+	CookiePath string
+	// CookieSameSite is the SameSite attribute of the session cookie, Strict
+	// if not set
+	CookieSameSite http.SameSite
+	// CookieInsecure removes the Secure attribute from the session cookie, it
+	// should only be used for the local development over plain http
+	CookieInsecure bool
 	NewKeyPair     KeyPair
 	OldKeyPair     KeyPair
-	LoginTimeout   time.Duration
+	// LoginTimeout is the time available to the user to complete the login
+	LoginTimeout time.Duration
+	// SessionTimeout is the idle timeout of the sessions, it's extended by every
+	// authenticated request
 	SessionTimeout time.Duration
-	SessionImpl    database.SessionImpl
+	// SessionMaxLifetime is the maximum lifetime of the sessions, regardless of
+	// the activity of the user, no limit if 0
+	SessionMaxLifetime time.Duration
+	SessionImpl        database.SessionImpl
+	// RefreshSkew is the time before the expiration of the access token, when
+	// the token is already considered expired and refreshed
+	RefreshSkew time.Duration
+	// BackgroundRefreshInterval enables the background refresh of the tokens,
+	// for the sessions used in the last BackgroundRefreshWindow
+	BackgroundRefreshInterval time.Duration
+	BackgroundRefreshWindow   time.Duration
+	// CSRFProtection requires a valid CSRF token in the X-CSRF-Token header of
+	// the authenticated requests using an unsafe method
+	CSRFProtection bool
 }
 
 var (
 	ErrWrongAuthSecretSize = errors.New("the session authentication key should have a size of 32 or 64 bytes")
 	ErrWrongEncSecretSize  = errors.New("the session encryption key should have a size of 16, 24 or 32 bytes")
+	ErrInvalidCookieOption = errors.New("the session cookie options are not valid")
+)
+
+const (
+	cookieHostPrefix   = "__Host-"
+	cookieSecurePrefix = "__Secure-"
 )
 
+// cookieOptions validates the options of the session cookie, following the
+// rules enforced by the browsers.
+func (mc Configuration) cookieOptions() (*sessions.Options, error) {
+	options := &sessions.Options{
+		HttpOnly: true,
+		MaxAge:   0,
+		Secure:   !mc.CookieInsecure,
+		SameSite: mc.CookieSameSite,
+		Path:     mc.CookiePath,
+		Domain:   mc.CookieDomain,
+	}
+
+	if options.Path == "" {
+		options.Path = "/"
+	}
+
+	if options.SameSite == 0 {
+		options.SameSite = http.SameSiteStrictMode
+	}
+
+	if !strings.HasPrefix(options.Path, "/") {
+		return nil, fmt.Errorf("%w: the path must start with '/'", ErrInvalidCookieOption)
+	}
+
+	if options.SameSite == http.SameSiteNoneMode && !options.Secure {
+		return nil, fmt.Errorf("%w: SameSite=None requires a secure cookie", ErrInvalidCookieOption)
+	}
+
+	if strings.HasPrefix(mc.CookieName, cookieSecurePrefix) && !options.Secure {
+		return nil, fmt.Errorf("%w: the %s prefix requires a secure cookie", ErrInvalidCookieOption, cookieSecurePrefix)
+	}
+
+	if strings.HasPrefix(mc.CookieName, cookieHostPrefix) && (!options.Secure || options.Domain != "" || options.Path != "/") {
+		return nil, fmt.Errorf("%w: the %s prefix requires a secure cookie, without a domain and with the path '/'", ErrInvalidCookieOption, cookieHostPrefix)
+	}
+
+	return options, nil
+}
+
 func (mc Configuration) keyPairsAsSlice() ([][]byte, error) {
 	if mc.NewKeyPair.Authentication == "" {
 		return [][]byte{}, nil
@@ -0,0 +1,86 @@
+package sessions
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestConfiguration_cookieOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		c            Configuration
+		wantPath     string
+		wantSameSite http.SameSite
+		wantSecure   bool
+		wantErr      error
+	}{
+		{
+			name:         "defaults",
+			c:            Configuration{CookieName: "session", CookieDomain: "localhost"},
+			wantPath:     "/",
+			wantSameSite: http.SameSiteStrictMode,
+			wantSecure:   true,
+		},
+		{
+			name:         "lax_insecure",
+			c:            Configuration{CookieName: "session", CookieDomain: "localhost", CookiePath: "/app", CookieSameSite: http.SameSiteLaxMode, CookieInsecure: true},
+			wantPath:     "/app",
+			wantSameSite: http.SameSiteLaxMode,
+			wantSecure:   false,
+		},
+		{
+			name:         "host_prefix",
+			c:            Configuration{CookieName: "__Host-session"},
+			wantPath:     "/",
+			wantSameSite: http.SameSiteStrictMode,
+			wantSecure:   true,
+		},
+		{
+			name:    "host_prefix_with_domain",
+			c:       Configuration{CookieName: "__Host-session", CookieDomain: "example.com"},
+			wantErr: ErrInvalidCookieOption,
+		},
+		{
+			name:    "host_prefix_with_path",
+			c:       Configuration{CookieName: "__Host-session", CookiePath: "/app"},
+			wantErr: ErrInvalidCookieOption,
+		},
+		{
+			name:    "host_prefix_insecure",
+			c:       Configuration{CookieName: "__Host-session", CookieInsecure: true},
+			wantErr: ErrInvalidCookieOption,
+		},
+		{
+			name:    "secure_prefix_insecure",
+			c:       Configuration{CookieName: "__Secure-session", CookieDomain: "example.com", CookieInsecure: true},
+			wantErr: ErrInvalidCookieOption,
+		},
+		{
+			name:    "same_site_none_insecure",
+			c:       Configuration{CookieName: "session", CookieDomain: "localhost", CookieSameSite: http.SameSiteNoneMode, CookieInsecure: true},
+			wantErr: ErrInvalidCookieOption,
+		},
+		{
+			name:    "relative_path",
+			c:       Configuration{CookieName: "session", CookieDomain: "localhost", CookiePath: "app"},
+			wantErr: ErrInvalidCookieOption,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.c.cookieOptions()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("cookieOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			if got.Path != tt.wantPath || got.SameSite != tt.wantSameSite || got.Secure != tt.wantSecure || !got.HttpOnly {
+				t.Errorf("cookieOptions() = %+v, want path %s, same-site %v, secure %v", got, tt.wantPath, tt.wantSameSite, tt.wantSecure)
+			}
+		})
+	}
+}
@@ -1,12 +1,16 @@
 package sessions
 
 const (
-	sessionIdName    = "session_id"
-	sessionStateName = "state"
+	sessionIdName           = "session_id"
+	sessionStateName        = "state"
+	sessionCodeVerifierName = "code_verifier"
+	sessionNonceName        = "nonce"
 )
 
 type contextKey int
 
 const (
 	ContextKeyAccessTokenName contextKey = iota
+	ContextKeyIDTokenName
+	ContextKeyCSRFTokenName
 )
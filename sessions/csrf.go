@@ -0,0 +1,104 @@
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gandalfmagic/go-token-handler/oidc"
+	"github.com/gandalfmagic/go-token-handler/zlogger"
+)
+
+const (
+	// CSRFHeaderName is the request header that must contain the CSRF token,
+	// for all the requests using an unsafe method
+	CSRFHeaderName = "X-CSRF-Token"
+
+	csrfKeyLabel = "token-handler csrf"
+)
+
+var (
+	ErrMissingCSRFKey = errors.New("the csrf protection requires the session authentication key")
+)
+
+// csrfKeys derives the keys used to sign the CSRF tokens from the session
+// authentication keys, the old key is only used to verify the tokens.
+func (mc Configuration) csrfKeys() [][]byte {
+	keys := make([][]byte, 0, 2)
+
+	for _, kp := range []KeyPair{mc.NewKeyPair, mc.OldKeyPair} {
+		if kp.Authentication == "" {
+			continue
+		}
+
+		mac := hmac.New(sha256.New, []byte(kp.Authentication))
+		mac.Write([]byte(csrfKeyLabel))
+		keys = append(keys, mac.Sum(nil))
+	}
+
+	return keys
+}
+
+// csrfToken returns the CSRF token bound to the session id.
+func (m *Manager) csrfToken(id string) string {
+	return base64.RawURLEncoding.EncodeToString(csrfMAC(m.csrfKeys[0], id))
+}
+
+// validCSRFToken verifies the CSRF token sent with a request.
+func (m *Manager) validCSRFToken(id, token string) bool {
+	mac, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || token == "" {
+		return false
+	}
+
+	for _, key := range m.csrfKeys {
+		if hmac.Equal(mac, csrfMAC(key, id)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func csrfMAC(key []byte, id string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+
+	return mac.Sum(nil)
+}
+
+// isSafeMethod reports if the method cannot change the state of the server,
+// the requests using a safe method don't require a CSRF token.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+// CSRFTokenHandlerOidc returns the CSRF token of the current session, the SPA
+// must send it in the X-CSRF-Token header of the state-changing requests.
+func (m *Manager) CSRFTokenHandlerOidc(config *oidc.Config) http.Handler {
+	return m.AuthenticationMiddleware(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zlog := zlogger.FromContext(r.Context())
+
+		token, ok := r.Context().Value(ContextKeyCSRFTokenName).(string)
+		if !ok {
+			zlog.JsonError(w, http.StatusInternalServerError, "cannot retrieve the csrf token from the context", nil)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		if err := json.NewEncoder(w).Encode(map[string]string{"csrf_token": token, "header_name": CSRFHeaderName}); err != nil {
+			zlog.SetError("cannot write the csrf token response: ", err)
+		}
+	}))
+}
@@ -1,16 +1,21 @@
 package sessions
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 
+	"github.com/gandalfmagic/go-token-handler/database"
 	"github.com/gandalfmagic/go-token-handler/oidc"
 	"github.com/gandalfmagic/go-token-handler/zlogger"
 
+	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 )
 
@@ -22,6 +27,32 @@ func generateOAuthState() string {
 	return state
 }
 
+func generateOAuthNonce() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+
+	return nonce
+}
+
+// generatePKCE returns a new random code verifier, and the corresponding code
+// challenge computed using the S256 method (RFC 7636)
+func generatePKCE() (string, string) {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	codeVerifier := base64.RawURLEncoding.EncodeToString(b)
+
+	return codeVerifier, s256CodeChallenge(codeVerifier)
+}
+
+// s256CodeChallenge returns the code challenge of the verifier, computed using
+// the S256 method: BASE64URL-ENCODE(SHA256(ASCII(code_verifier)))
+func s256CodeChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
 func (m *Manager) LoginHandlerOidc(config *oidc.Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		zlog := zlogger.FromContext(r.Context())
@@ -33,13 +64,18 @@ func (m *Manager) LoginHandlerOidc(config *oidc.Config) http.Handler {
 		}
 
 		state := generateOAuthState()
-		if err = session.saveState(w, r, state, m.loginTimeout); err != nil {
+		nonce := generateOAuthNonce()
+		codeVerifier, codeChallenge := generatePKCE()
+		if err = session.saveState(w, r, state, codeVerifier, nonce, m.loginTimeout); err != nil {
 			zlog.JsonError(w, http.StatusInternalServerError, "cannot save the oauth state in the session", err)
 			return
 		}
 
 		// Redirect the user to the login URL
-		loginURL := config.AuthCodeURL(state, oauth2.AccessTypeOnline)
+		loginURL := config.AuthCodeURL(state, oauth2.AccessTypeOnline,
+			oauth2.SetAuthURLParam("nonce", nonce),
+			oauth2.SetAuthURLParam("code_challenge", codeChallenge),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"))
 		http.Redirect(w, r, loginURL, http.StatusFound)
 	})
 }
@@ -62,8 +98,21 @@ func (m *Manager) CallbackHandlerOidc(config *oidc.Config, postLoginRedirectURI
 			return
 		}
 
-		// Complete the authentication using the "code" field
-		token, err := config.Exchange(r.Context(), r.FormValue("code"))
+		// The nonce saved in the session must match the one in the id-token
+		nonce := session.getNonce(r)
+		if nonce == "" {
+			zlog.JsonError(w, http.StatusUnauthorized, "cannot retrieve the nonce for oidc callback", nil)
+			return
+		}
+
+		// Complete the authentication using the "code" field, and the PKCE code verifier
+		codeVerifier := session.getCodeVerifier(r)
+		if codeVerifier == "" {
+			zlog.JsonError(w, http.StatusUnauthorized, "cannot retrieve the pkce code verifier for oidc callback", nil)
+			return
+		}
+
+		token, err := config.Exchange(r.Context(), r.FormValue("code"), oauth2.SetAuthURLParam("code_verifier", codeVerifier))
 		if err != nil {
 			zlog.JsonError(w, http.StatusUnauthorized, "cannot validate oauth code for oidc callback", err)
 			return
@@ -77,7 +126,12 @@ func (m *Manager) CallbackHandlerOidc(config *oidc.Config, postLoginRedirectURI
 		}
 
 		// Save the session in the database and in the cookie
-		if err = newSession.Save(w, r, token); err != nil {
+		if err = newSession.Save(w, r, token, nonce); err != nil {
+			if errors.Is(err, oidc.ErrNonceMismatch) {
+				zlog.JsonError(w, http.StatusUnauthorized, "cannot validate nonce value for oidc callback", err)
+				return
+			}
+
 			zlog.JsonError(w, http.StatusInternalServerError, "cannot save the new session for oidc callback", err)
 			return
 		}
@@ -104,6 +158,9 @@ func (m *Manager) LogoutHandlerOidc(config *oidc.Config, postLogoutRedirectURI s
 			return
 		}
 
+		// Revoke the tokens on the auth server, the errors must not block the logout
+		m.revokeTokens(r.Context(), config, session.data)
+
 		// Redirect the user to the home page
 		query := fmt.Sprintf("id_token_hint=%s&post_logout_redirect_uri=%s", url.QueryEscape(session.data.IDToken), url.QueryEscape(postLogoutRedirectURI))
 		logoutUrl := fmt.Sprintf("%s?%s", config.OidcEndpoints.EndSessionEndpoint, query)
@@ -151,3 +208,72 @@ func (m *Manager) UserInfoHandlerOidc(config *oidc.Config) http.Handler {
 		}
 	}))
 }
+
+// BackChannelLogoutHandlerOidc implements the OpenID Connect Back-Channel Logout
+// 1.0 endpoint: the auth server sends a signed logout token, and all the sessions
+// matching its sid (or its subject, if the sid is missing) are deleted.
+func (m *Manager) BackChannelLogoutHandlerOidc(config *oidc.Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		zlog := zlogger.FromContext(ctx)
+
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method != http.MethodPost {
+			zlog.JsonError(w, http.StatusMethodNotAllowed, "the back-channel logout only accepts POST requests", nil)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			zlog.JsonError(w, http.StatusBadRequest, "cannot parse the back-channel logout request", err)
+			return
+		}
+
+		rawToken := r.PostForm.Get("logout_token")
+		if rawToken == "" {
+			zlog.JsonError(w, http.StatusBadRequest, "missing the logout token for back-channel logout", nil)
+			return
+		}
+
+		logoutToken, err := config.VerifyLogoutToken(ctx, rawToken)
+		if err != nil {
+			zlog.JsonError(w, http.StatusBadRequest, "cannot validate the logout token for back-channel logout", err)
+			return
+		}
+
+		if logoutToken.SID != "" {
+			_, err = m.sessionImpl.DeleteBySID(ctx, logoutToken.SID)
+		} else {
+			_, err = m.sessionImpl.DeleteBySubject(ctx, logoutToken.Subject)
+		}
+		if err != nil {
+			zlog.JsonError(w, http.StatusInternalServerError, "cannot delete the sessions for back-channel logout", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// revokeTokens revokes the refresh token and the access token of a session on
+// the auth server, the errors are only logged.
+func (m *Manager) revokeTokens(ctx context.Context, config *oidc.Config, data database.SessionData) {
+	zlog := zlogger.FromContext(ctx)
+
+	if data.RefreshToken != "" {
+		if err := config.RevokeToken(ctx, data.RefreshToken, oidc.TokenTypeHintRefreshToken); err != nil {
+			zlog.Warn("cannot revoke the refresh token on logout", zap.Error(err))
+		}
+	}
+
+	if data.AccessToken != "" {
+		err := config.RevokeToken(ctx, data.AccessToken, oidc.TokenTypeHintAccessToken)
+		switch {
+		case err == nil:
+		case errors.Is(err, oidc.ErrUnsupportedTokenType), errors.Is(err, oidc.ErrRevocationNotSupported):
+			zlog.Debug("cannot revoke the access token on logout", zap.Error(err))
+		default:
+			zlog.Warn("cannot revoke the access token on logout", zap.Error(err))
+		}
+	}
+}
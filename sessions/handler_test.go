@@ -0,0 +1,141 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGeneratePKCE(t *testing.T) {
+	verifiers := make(map[string]bool)
+	challenges := make(map[string]bool)
+
+	for i := 0; i < 10; i++ {
+		codeVerifier, codeChallenge := generatePKCE()
+
+		// 32 random bytes, encoded without padding
+		if len(codeVerifier) != 43 {
+			t.Errorf("generatePKCE() verifier length = %d, want %d", len(codeVerifier), 43)
+		}
+
+		if want := s256CodeChallenge(codeVerifier); codeChallenge != want {
+			t.Errorf("generatePKCE() challenge = %s, want %s", codeChallenge, want)
+		}
+
+		if verifiers[codeVerifier] {
+			t.Errorf("generatePKCE() verifier %s was already generated", codeVerifier)
+		}
+		verifiers[codeVerifier] = true
+
+		if challenges[codeChallenge] {
+			t.Errorf("generatePKCE() challenge %s was already generated", codeChallenge)
+		}
+		challenges[codeChallenge] = true
+	}
+}
+
+func TestS256CodeChallenge(t *testing.T) {
+	tests := []struct {
+		name          string
+		codeVerifier  string
+		codeChallenge string
+	}{
+		// Example of the RFC 7636, Appendix B
+		{
+			name:          "rfc7636_appendix_b",
+			codeVerifier:  "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk",
+			codeChallenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		},
+		{
+			name:          "empty",
+			codeVerifier:  "",
+			codeChallenge: "47DEQpj8HBSa-_TImW-5JCeuQeRkm5NMpJWZG3hSuFU",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s256CodeChallenge(tt.codeVerifier); got != tt.codeChallenge {
+				t.Errorf("s256CodeChallenge() = %s, want %s", got, tt.codeChallenge)
+			}
+		})
+	}
+}
+
+// clearNonce removes the nonce from the state saved in the session cookie.
+func (e *testEnv) clearNonce(t *testing.T) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range e.cookies {
+		r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+
+	session, err := e.manager.store.Get(r, testCookieName)
+	if err != nil {
+		t.Fatalf("cannot decode the session cookie: %v", err)
+	}
+
+	delete(session.Values, sessionNonceName)
+
+	w := httptest.NewRecorder()
+	if err = e.manager.store.Save(r, w, session); err != nil {
+		t.Fatalf("cannot encode the session cookie: %v", err)
+	}
+
+	for _, cookie := range w.Result().Cookies() {
+		e.cookies[cookie.Name] = cookie
+	}
+}
+
+func TestCallbackHandlerOidc_Nonce(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, e *testEnv)
+		wantStatus int
+	}{
+		{
+			name:       "valid_nonce",
+			setup:      func(t *testing.T, e *testEnv) {},
+			wantStatus: http.StatusFound,
+		},
+		{
+			name:       "wrong_nonce",
+			setup:      func(t *testing.T, e *testEnv) { e.provider.wrongNonce = true },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing_nonce_in_id_token",
+			setup:      func(t *testing.T, e *testEnv) { e.provider.omitNonce = true },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing_nonce_in_session",
+			setup:      func(t *testing.T, e *testEnv) { e.clearNonce(t) },
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+
+			w := e.do(e.manager.LoginHandlerOidc(e.config), http.MethodGet, "/login")
+			if w.Code != http.StatusFound {
+				t.Fatalf("LoginHandlerOidc() status = %d, want %d", w.Code, http.StatusFound)
+			}
+
+			tt.setup(t, e)
+
+			callbackURL := e.provider.authorize(t, w.Header().Get("Location"))
+
+			w = e.do(e.manager.CallbackHandlerOidc(e.config, testPostLoginRedirectURL), http.MethodGet, callbackURL)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("CallbackHandlerOidc() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			// A session must be created only when the nonce is valid
+			if gotID := e.sessionID(t); (gotID != "") != (tt.wantStatus == http.StatusFound) {
+				t.Errorf("CallbackHandlerOidc() session id = %q, want a session %v", gotID, tt.wantStatus == http.StatusFound)
+			}
+		})
+	}
+}
@@ -15,15 +15,26 @@ import (
 
 	"github.com/gorilla/sessions"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
 type Manager struct {
 	cookieName     string
 	loginTimeout   int
 	sessionTimeout time.Duration
+	maxLifetime    time.Duration
 	store          *sessions.CookieStore
 	sessionImpl    database.SessionImpl
 	done           chan struct{}
+	refreshGroup   singleflight.Group
+	refreshSkew    time.Duration
+	csrfProtection bool
+	csrfKeys       [][]byte
+
+	backgroundRefreshInterval time.Duration
+	backgroundRefreshWindow   time.Duration
+	activityMu                sync.Mutex
+	activity                  map[string]time.Time
 }
 
 var (
@@ -51,29 +62,45 @@ func NewManager(ctx context.Context, c Configuration) (*Manager, error) {
 		return nil, err
 	}
 
-	store := sessions.NewCookieStore(kpSlice...)
-	store.Options = &sessions.Options{
-		HttpOnly: true,
-		MaxAge:   0,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/",
-		Domain:   c.CookieDomain,
+	csrfKeys := c.csrfKeys()
+	if c.CSRFProtection && len(csrfKeys) == 0 {
+		return nil, ErrMissingCSRFKey
 	}
 
+	cookieOptions, err := c.cookieOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	store := sessions.NewCookieStore(kpSlice...)
+	store.Options = cookieOptions
+
 	done := make(chan struct{})
 	go once.Do(func() {
 		expiredSessionsCleaner(ctx, c.SessionImpl, done)
 	})
 
-	return &Manager{
-		cookieName:     c.CookieName,
-		loginTimeout:   int(c.LoginTimeout / time.Second),
-		sessionTimeout: c.SessionTimeout,
-		store:          store,
-		sessionImpl:    c.SessionImpl,
-		done:           done,
-	}, nil
+	m := &Manager{
+		cookieName:                c.CookieName,
+		loginTimeout:              int(c.LoginTimeout / time.Second),
+		sessionTimeout:            c.SessionTimeout,
+		maxLifetime:               c.SessionMaxLifetime,
+		store:                     store,
+		sessionImpl:               c.SessionImpl,
+		done:                      done,
+		refreshSkew:               c.RefreshSkew,
+		csrfProtection:            c.CSRFProtection,
+		csrfKeys:                  csrfKeys,
+		backgroundRefreshInterval: c.BackgroundRefreshInterval,
+		backgroundRefreshWindow:   c.BackgroundRefreshWindow,
+	}
+
+	// The activity is tracked only for the background refresher
+	if c.BackgroundRefreshInterval > 0 {
+		m.activity = make(map[string]time.Time)
+	}
+
+	return m, nil
 }
 
 func expiredSessionsCleaner(ctx context.Context, db database.SessionImpl, done chan<- struct{}) {
@@ -110,7 +137,7 @@ func (m *Manager) NewSession(r *http.Request, config *oidc.Config) (*Session, er
 		return nil, fmt.Errorf("%w '%s': %s", ErrCannotCreateCookie, m.cookieName, err.Error())
 	}
 
-	return &Session{session: session, sessionImpl: m.sessionImpl, timeout: m.sessionTimeout, oidcConfig: config}, nil
+	return &Session{session: session, sessionImpl: m.sessionImpl, timeout: m.sessionTimeout, maxLifetime: m.maxLifetime, oidcConfig: config}, nil
 }
 
 func (m *Manager) GetSession(r *http.Request, config *oidc.Config) (*Session, error) {
@@ -121,7 +148,7 @@ func (m *Manager) GetSession(r *http.Request, config *oidc.Config) (*Session, er
 	if err != nil {
 		return nil, fmt.Errorf("%w '%s': %s", ErrCannotGetCookie, m.cookieName, err)
 	}
-	s := &Session{session: session, sessionImpl: m.sessionImpl, timeout: m.sessionTimeout, oidcConfig: config}
+	s := &Session{session: session, sessionImpl: m.sessionImpl, timeout: m.sessionTimeout, maxLifetime: m.maxLifetime, oidcConfig: config}
 
 	// If the session already exists, and contains a state, we are in the login callback,
 	// the actual session still doesn't exist, so we don't load the data from the DB
@@ -133,5 +160,44 @@ func (m *Manager) GetSession(r *http.Request, config *oidc.Config) (*Session, er
 		return nil, err
 	}
 
+	// The session is in the database until the next purge, but it's no more
+	// valid after its idle timeout or its maximum lifetime
+	if s.data.IsSessionExpired() {
+		if id, ok := s.session.Values[sessionIdName].(string); ok {
+			if err = m.sessionImpl.Delete(ctx, id); err != nil {
+				zlogger.FromContext(ctx).Warn("cannot delete the expired session", zap.Error(err))
+			}
+		}
+
+		return nil, ErrSessionExpired
+	}
+
 	return s, nil
 }
+
+// extendSession extends the idle timeout of the session, it returns true if
+// the session was updated, and the cookie must be saved again. To limit the
+// writes on the database, the idle timeout is extended at most once every
+// tenth of the timeout.
+func (m *Manager) extendSession(ctx context.Context, session *Session, id string) (bool, error) {
+	if m.sessionTimeout <= 0 || id == "" {
+		return false, nil
+	}
+
+	sessionExpiresAt := time.Now().Add(m.sessionTimeout)
+	if absolute := session.data.AbsoluteExpiresAt; !absolute.IsZero() && sessionExpiresAt.After(absolute) {
+		sessionExpiresAt = absolute
+	}
+
+	if !session.data.SessionExpiresAt.IsZero() && sessionExpiresAt.Sub(session.data.SessionExpiresAt) < m.sessionTimeout/10 {
+		return false, nil
+	}
+
+	if err := m.sessionImpl.Touch(ctx, id, sessionExpiresAt); err != nil {
+		return false, err
+	}
+
+	session.data.SessionExpiresAt = sessionExpiresAt
+
+	return true, nil
+}
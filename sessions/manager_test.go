@@ -0,0 +1,794 @@
+package sessions
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gandalfmagic/go-token-handler/database"
+	"github.com/gandalfmagic/go-token-handler/oidc"
+	"github.com/gandalfmagic/go-token-handler/opentelemetry"
+	"github.com/gandalfmagic/go-token-handler/zlogger"
+
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	testCookieName            = "session"
+	testRedirectURL           = "https://token-handler.local/callback"
+	testPostLoginRedirectURL  = "https://spa.local/"
+	testPostLogoutRedirectURL = "https://spa.local/logout"
+)
+
+// testEnv contains a session manager backed by the in-memory database, and
+// connected to an in-process auth server. It keeps the cookies like a browser.
+type testEnv struct {
+	provider    *testProvider
+	manager     *Manager
+	config      *oidc.Config
+	sessionImpl database.SessionImpl
+	zlog        *zlogger.Logger
+	cookies     map[string]*http.Cookie
+}
+
+// newTestEnv creates the test environment, the options can change the
+// configuration of the session manager.
+func newTestEnv(t *testing.T, options ...func(*Configuration)) *testEnv {
+	t.Helper()
+
+	zlog, err := zlogger.NewLogger("fatal", false)
+	if err != nil {
+		t.Fatalf("NewLogger() fatal error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(zlogger.NewContext(context.Background(), zlog))
+	t.Cleanup(cancel)
+
+	provider := newTestProvider(t)
+
+	config, err := oidc.NewConfiguration(testClientID, testClientSecret, provider.server.URL, testRedirectURL)
+	if err != nil {
+		t.Fatalf("NewConfiguration() fatal error = %v", err)
+	}
+
+	sessionImpl, err := database.NewMemorySessionImpl(ctx, nil, 30*time.Minute)
+	if err != nil {
+		t.Fatalf("NewMemorySessionImpl() fatal error = %v", err)
+	}
+
+	c := Configuration{
+		CookieName:     testCookieName,
+		CookieDomain:   "localhost",
+		NewKeyPair:     KeyPair{Authentication: "0123456789abcdef0123456789abcdef"},
+		LoginTimeout:   5 * time.Minute,
+		SessionTimeout: 30 * time.Minute,
+		SessionImpl:    sessionImpl,
+	}
+	for _, option := range options {
+		option(&c)
+	}
+
+	manager, err := NewManager(ctx, c)
+	if err != nil {
+		t.Fatalf("NewManager() fatal error = %v", err)
+	}
+
+	return &testEnv{
+		provider:    provider,
+		manager:     manager,
+		config:      config,
+		sessionImpl: sessionImpl,
+		zlog:        zlog,
+		cookies:     make(map[string]*http.Cookie),
+	}
+}
+
+// do executes the request on the handler, wrapped by the same middlewares used
+// in the main service, and saves the cookies returned in the response.
+func (e *testEnv) do(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	return e.doRequest(h, httptest.NewRequest(method, target, nil))
+}
+
+func (e *testEnv) doRequest(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	for _, cookie := range e.cookies {
+		r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+
+	w := httptest.NewRecorder()
+	e.zlog.Middleware(opentelemetry.Middleware(h, "test", "test")).ServeHTTP(w, r)
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(e.cookies, cookie.Name)
+			continue
+		}
+
+		e.cookies[cookie.Name] = cookie
+	}
+
+	return w
+}
+
+// login executes the whole login workflow, and returns the response of the
+// callback endpoint.
+func (e *testEnv) login(t *testing.T) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := e.do(e.manager.LoginHandlerOidc(e.config), http.MethodGet, "/login")
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: unexpected status code %d", w.Code)
+	}
+
+	callbackURL := e.provider.authorize(t, w.Header().Get("Location"))
+
+	return e.do(e.manager.CallbackHandlerOidc(e.config, testPostLoginRedirectURL), http.MethodGet, callbackURL)
+}
+
+// sessionID returns the id of the session saved in the cookie.
+func (e *testEnv) sessionID(t *testing.T) string {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range e.cookies {
+		r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+
+	session, err := e.manager.store.Get(r, testCookieName)
+	if err != nil {
+		t.Fatalf("cannot decode the session cookie: %v", err)
+	}
+
+	id, _ := session.Values[sessionIdName].(string)
+
+	return id
+}
+
+func TestManager_Login(t *testing.T) {
+	e := newTestEnv(t)
+
+	w := e.do(e.manager.LoginHandlerOidc(e.config), http.MethodGet, "/login")
+	if w.Code != http.StatusFound {
+		t.Fatalf("LoginHandlerOidc() status = %d, want %d", w.Code, http.StatusFound)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("LoginHandlerOidc() invalid location: %v", err)
+	}
+
+	if !strings.HasPrefix(location.String(), e.provider.server.URL+"/auth") {
+		t.Errorf("LoginHandlerOidc() location = %s, want the authorization endpoint", location)
+	}
+
+	for _, param := range []string{"state", "nonce", "code_challenge", "code_challenge_method"} {
+		if location.Query().Get(param) == "" {
+			t.Errorf("LoginHandlerOidc() missing the %s parameter", param)
+		}
+	}
+
+	w = e.do(e.manager.CallbackHandlerOidc(e.config, testPostLoginRedirectURL), http.MethodGet, e.provider.authorize(t, location.String()))
+	if w.Code != http.StatusFound {
+		t.Fatalf("CallbackHandlerOidc() status = %d, want %d", w.Code, http.StatusFound)
+	}
+
+	if got := w.Header().Get("Location"); got != testPostLoginRedirectURL {
+		t.Errorf("CallbackHandlerOidc() location = %s, want %s", got, testPostLoginRedirectURL)
+	}
+
+	data, err := e.sessionImpl.Get(context.TODO(), e.sessionID(t))
+	if err != nil {
+		t.Fatalf("CallbackHandlerOidc() the session was not saved: %v", err)
+	}
+
+	if data.Subject != testSubject {
+		t.Errorf("CallbackHandlerOidc() subject = %s, want %s", data.Subject, testSubject)
+	}
+}
+
+func TestManager_CallbackErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		callback   func(callbackURL string) string
+		wantStatus int
+	}{
+		{
+			name:       "wrong_state",
+			callback:   func(callbackURL string) string { return strings.Replace(callbackURL, "state=", "state=x", 1) },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong_code",
+			callback:   func(callbackURL string) string { return strings.Replace(callbackURL, "code=", "code=x", 1) },
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+
+			w := e.do(e.manager.LoginHandlerOidc(e.config), http.MethodGet, "/login")
+			callbackURL := tt.callback(e.provider.authorize(t, w.Header().Get("Location")))
+
+			w = e.do(e.manager.CallbackHandlerOidc(e.config, testPostLoginRedirectURL), http.MethodGet, callbackURL)
+			if w.Code != tt.wantStatus {
+				t.Errorf("CallbackHandlerOidc() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestManager_UserInfo(t *testing.T) {
+	e := newTestEnv(t)
+
+	w := e.do(e.manager.UserInfoHandlerOidc(e.config), http.MethodGet, "/userinfo")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("UserInfoHandlerOidc() without session, status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	e.login(t)
+
+	w = e.do(e.manager.UserInfoHandlerOidc(e.config), http.MethodGet, "/userinfo")
+	if w.Code != http.StatusOK {
+		t.Fatalf("UserInfoHandlerOidc() status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if !strings.Contains(w.Body.String(), testSubject) {
+		t.Errorf("UserInfoHandlerOidc() body = %s, want the subject %s", w.Body.String(), testSubject)
+	}
+}
+
+func TestManager_Logout(t *testing.T) {
+	e := newTestEnv(t)
+	e.login(t)
+
+	id := e.sessionID(t)
+
+	w := e.do(e.manager.LogoutHandlerOidc(e.config, testPostLogoutRedirectURL), http.MethodGet, "/logout")
+	if w.Code != http.StatusFound {
+		t.Fatalf("LogoutHandlerOidc() status = %d, want %d", w.Code, http.StatusFound)
+	}
+
+	if !strings.HasPrefix(w.Header().Get("Location"), e.provider.server.URL+"/logout") {
+		t.Errorf("LogoutHandlerOidc() location = %s, want the end session endpoint", w.Header().Get("Location"))
+	}
+
+	if _, err := e.sessionImpl.Get(context.TODO(), id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("LogoutHandlerOidc() the session was not deleted, error = %v", err)
+	}
+
+	if _, ok := e.cookies[testCookieName]; ok {
+		t.Errorf("LogoutHandlerOidc() the session cookie was not deleted")
+	}
+}
+
+func TestManager_LogoutRevocation(t *testing.T) {
+	tests := []struct {
+		name           string
+		revocationDown bool
+		wantRevoked    bool
+	}{
+		{
+			name:        "revoked",
+			wantRevoked: true,
+		},
+		{
+			name:           "revocation_failed",
+			revocationDown: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.login(t)
+
+			data, err := e.sessionImpl.Get(context.TODO(), e.sessionID(t))
+			if err != nil {
+				t.Fatalf("Get() fatal error = %v", err)
+			}
+
+			e.provider.mu.Lock()
+			e.provider.revocationDown = tt.revocationDown
+			e.provider.mu.Unlock()
+
+			// A failed revocation must not block the logout
+			w := e.do(e.manager.LogoutHandlerOidc(e.config, testPostLogoutRedirectURL), http.MethodGet, "/logout")
+			if w.Code != http.StatusFound {
+				t.Fatalf("LogoutHandlerOidc() status = %d, want %d", w.Code, http.StatusFound)
+			}
+
+			e.provider.mu.Lock()
+			defer e.provider.mu.Unlock()
+
+			if got := len(e.provider.revoked) == 1 && e.provider.revoked[0] == data.RefreshToken; got != tt.wantRevoked {
+				t.Errorf("LogoutHandlerOidc() refresh token revoked = %v, want %v", got, tt.wantRevoked)
+			}
+
+			if got := e.provider.refreshTokens[data.RefreshToken]; got == tt.wantRevoked {
+				t.Errorf("LogoutHandlerOidc() refresh token still valid = %v, want %v", got, !tt.wantRevoked)
+			}
+		})
+	}
+}
+
+func TestManager_BackChannelLogout(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		claims      map[string]interface{}
+		wantStatus  int
+		wantDeleted bool
+	}{
+		{
+			name:        "by_sid",
+			method:      http.MethodPost,
+			claims:      map[string]interface{}{"sid": testSID},
+			wantStatus:  http.StatusOK,
+			wantDeleted: true,
+		},
+		{
+			name:        "by_subject",
+			method:      http.MethodPost,
+			claims:      map[string]interface{}{"sub": testSubject},
+			wantStatus:  http.StatusOK,
+			wantDeleted: true,
+		},
+		{
+			name:       "other_sid",
+			method:     http.MethodPost,
+			claims:     map[string]interface{}{"sub": testSubject, "sid": "other-session"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "missing_sub_and_sid",
+			method:     http.MethodPost,
+			claims:     map[string]interface{}{},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing_event",
+			method:     http.MethodPost,
+			claims:     map[string]interface{}{"sid": testSID, "events": nil},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "with_nonce",
+			method:     http.MethodPost,
+			claims:     map[string]interface{}{"sid": testSID, "nonce": "nonce"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "wrong_audience",
+			method:     http.MethodPost,
+			claims:     map[string]interface{}{"sid": testSID, "aud": "other-client"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "wrong_method",
+			method:     http.MethodGet,
+			claims:     map[string]interface{}{"sid": testSID},
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+
+			// Two different browsers logged in with the same auth server session
+			var ids []string
+			for i := 0; i < 2; i++ {
+				e.cookies = make(map[string]*http.Cookie)
+				e.login(t)
+				ids = append(ids, e.sessionID(t))
+			}
+
+			form := url.Values{"logout_token": {e.provider.logoutToken(t, tt.claims)}}
+			r := httptest.NewRequest(tt.method, "/backchannel-logout", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			w := e.doRequest(e.manager.BackChannelLogoutHandlerOidc(e.config), r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("BackChannelLogoutHandlerOidc() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			for _, id := range ids {
+				_, err := e.sessionImpl.Get(context.TODO(), id)
+				if deleted := errors.Is(err, sql.ErrNoRows); deleted != tt.wantDeleted {
+					t.Errorf("BackChannelLogoutHandlerOidc() session deleted = %v, want %v", deleted, tt.wantDeleted)
+				}
+			}
+		})
+	}
+}
+
+// expireSession moves the expiration of the access token in the past.
+func (e *testEnv) expireSession(t *testing.T) database.SessionData {
+	t.Helper()
+
+	return e.setExpiration(t, time.Now().Add(-time.Minute))
+}
+
+// setExpiration changes the expiration of the access token.
+func (e *testEnv) setExpiration(t *testing.T, expiresAt time.Time) database.SessionData {
+	t.Helper()
+
+	id := e.sessionID(t)
+
+	data, err := e.sessionImpl.Get(context.TODO(), id)
+	if err != nil {
+		t.Fatalf("Get() fatal error = %v", err)
+	}
+
+	data.ExpiresAt = expiresAt
+	if err = e.sessionImpl.Update(context.TODO(), id, data); err != nil {
+		t.Fatalf("Update() fatal error = %v", err)
+	}
+
+	data.Version++
+
+	return data
+}
+
+func (e *testEnv) tokenRequests() int {
+	e.provider.mu.Lock()
+	defer e.provider.mu.Unlock()
+
+	return e.provider.tokenRequests
+}
+
+func TestManager_ConcurrentRefresh(t *testing.T) {
+	e := newTestEnv(t)
+	e.login(t)
+
+	expired := e.expireSession(t)
+	tokenRequests := e.tokenRequests()
+
+	e.provider.mu.Lock()
+	e.provider.tokenDelay = 100 * time.Millisecond
+	e.provider.mu.Unlock()
+
+	h := opentelemetry.Middleware(e.manager.AuthenticationMiddleware(e.config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})), "test", "test")
+
+	codes := make(chan int, 20)
+
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		r := httptest.NewRequest(http.MethodGet, "/proxy", nil)
+		for _, cookie := range e.cookies {
+			r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+
+		wg.Add(1)
+		go func(r *http.Request) {
+			defer wg.Done()
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r.WithContext(zlogger.NewContext(r.Context(), e.zlog)))
+			codes <- w.Code
+		}(r)
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("AuthenticationMiddleware() status = %d, want %d", code, http.StatusOK)
+		}
+	}
+
+	if got := e.tokenRequests() - tokenRequests; got != 1 {
+		t.Errorf("AuthenticationMiddleware() token requests = %d, want 1", got)
+	}
+
+	data, err := e.sessionImpl.Get(context.TODO(), e.sessionID(t))
+	if err != nil {
+		t.Fatalf("Get() fatal error = %v", err)
+	}
+
+	if data.IsExpired() || data.RefreshToken == expired.RefreshToken || data.Version != expired.Version+1 {
+		t.Errorf("AuthenticationMiddleware() the session was not refreshed: %+v", data)
+	}
+}
+
+func TestManager_RefreshedElsewhere(t *testing.T) {
+	e := newTestEnv(t)
+	e.login(t)
+	e.expireSession(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/proxy", nil)
+	for _, cookie := range e.cookies {
+		r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	r = r.WithContext(opentelemetry.NewContext(zlogger.NewContext(r.Context(), e.zlog), otel.GetTracerProvider().Tracer("test")))
+
+	// Two instances read the same expired session
+	first, err := e.manager.GetSession(r, e.config)
+	if err != nil {
+		t.Fatalf("GetSession() fatal error = %v", err)
+	}
+
+	second, err := e.manager.GetSession(r, e.config)
+	if err != nil {
+		t.Fatalf("GetSession() fatal error = %v", err)
+	}
+
+	if err = e.manager.Refresh(httptest.NewRecorder(), r, first); err != nil {
+		t.Fatalf("Refresh() fatal error = %v", err)
+	}
+
+	// The rotated refresh token is refused by the auth server, the second
+	// instance must use the session saved by the first one
+	if err = e.manager.Refresh(httptest.NewRecorder(), r, second); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+
+	if second.data != first.data {
+		t.Errorf("Refresh() got = %+v, want %+v", second.data, first.data)
+	}
+}
+
+func TestManager_RefreshSkew(t *testing.T) {
+	tests := []struct {
+		name        string
+		skew        time.Duration
+		expiresIn   time.Duration
+		wantRefresh bool
+	}{
+		{
+			name:      "valid",
+			skew:      30 * time.Second,
+			expiresIn: 5 * time.Minute,
+		},
+		{
+			name:        "expiring",
+			skew:        30 * time.Second,
+			expiresIn:   10 * time.Second,
+			wantRefresh: true,
+		},
+		{
+			name:      "expiring_without_skew",
+			expiresIn: 10 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, func(c *Configuration) {
+				c.RefreshSkew = tt.skew
+			})
+			e.login(t)
+			e.setExpiration(t, time.Now().Add(tt.expiresIn))
+
+			tokenRequests := e.tokenRequests()
+
+			w := e.do(e.manager.UserInfoHandlerOidc(e.config), http.MethodGet, "/userinfo")
+			if w.Code != http.StatusOK {
+				t.Fatalf("UserInfoHandlerOidc() status = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			if got := e.tokenRequests() > tokenRequests; got != tt.wantRefresh {
+				t.Errorf("AuthenticationMiddleware() refreshed = %v, want %v", got, tt.wantRefresh)
+			}
+		})
+	}
+}
+
+func TestManager_BackgroundRefresher(t *testing.T) {
+	e := newTestEnv(t, func(c *Configuration) {
+		c.RefreshSkew = 30 * time.Second
+		c.BackgroundRefreshInterval = 20 * time.Millisecond
+		c.BackgroundRefreshWindow = time.Minute
+	})
+	e.login(t)
+
+	ctx, cancel := context.WithCancel(zlogger.NewContext(context.Background(), e.zlog))
+	defer cancel()
+
+	go e.manager.RunBackgroundRefresher(ctx, e.config)
+
+	// A request marks the session as active
+	if w := e.do(e.manager.UserInfoHandlerOidc(e.config), http.MethodGet, "/userinfo"); w.Code != http.StatusOK {
+		t.Fatalf("UserInfoHandlerOidc() status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	expiring := e.setExpiration(t, time.Now().Add(10*time.Second))
+	id := e.sessionID(t)
+
+	// The requests share the logger with the background refresher
+	handler := e.zlog.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zlogger.FromContext(r.Context()).JsonError(w, http.StatusUnauthorized, "test", nil)
+	}))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+		data, err := e.sessionImpl.Get(context.TODO(), id)
+		if err != nil {
+			t.Fatalf("Get() fatal error = %v", err)
+		}
+
+		if data.Version > expiring.Version {
+			if data.ExpiresWithin(30 * time.Second) {
+				t.Errorf("RunBackgroundRefresher() the tokens are still expiring: %v", data.ExpiresAt)
+			}
+
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("RunBackgroundRefresher() the session was not refreshed")
+}
+
+func TestManager_CSRF(t *testing.T) {
+	e := newTestEnv(t, func(c *Configuration) {
+		c.CSRFProtection = true
+	})
+	e.login(t)
+
+	w := e.do(e.manager.CSRFTokenHandlerOidc(e.config), http.MethodGet, "/csrf-token")
+	if w.Code != http.StatusOK {
+		t.Fatalf("CSRFTokenHandlerOidc() status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var body struct {
+		CSRFToken  string `json:"csrf_token"`
+		HeaderName string `json:"header_name"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("CSRFTokenHandlerOidc() cannot decode the body: %v", err)
+	}
+
+	if body.CSRFToken == "" || body.HeaderName != CSRFHeaderName {
+		t.Fatalf("CSRFTokenHandlerOidc() body = %+v, want a token and the header %s", body, CSRFHeaderName)
+	}
+
+	// The token of another session is never valid
+	otherToken := e.manager.csrfToken("another-session-id")
+
+	tests := []struct {
+		name     string
+		method   string
+		token    string
+		wantCode int
+	}{
+		{name: "safe_method_without_token", method: http.MethodGet, wantCode: http.StatusOK},
+		{name: "unsafe_method_without_token", method: http.MethodPost, wantCode: http.StatusForbidden},
+		{name: "unsafe_method_with_token", method: http.MethodPost, token: body.CSRFToken, wantCode: http.StatusOK},
+		{name: "delete_with_token", method: http.MethodDelete, token: body.CSRFToken, wantCode: http.StatusOK},
+		{name: "invalid_token", method: http.MethodPut, token: "not-a-valid-token", wantCode: http.StatusForbidden},
+		{name: "token_of_another_session", method: http.MethodPatch, token: otherToken, wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			r := httptest.NewRequest(tt.method, "/proxy", nil)
+			if tt.token != "" {
+				r.Header.Set(CSRFHeaderName, tt.token)
+			}
+
+			w := e.doRequest(e.manager.AuthenticationMiddleware(e.config, next), r)
+			if w.Code != tt.wantCode {
+				t.Errorf("AuthenticationMiddleware() status = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestManager_CSRFKeyRotation(t *testing.T) {
+	e := newTestEnv(t, func(c *Configuration) {
+		c.CSRFProtection = true
+	})
+
+	rotated, err := NewManager(context.TODO(), Configuration{
+		CookieName:     testCookieName,
+		NewKeyPair:     KeyPair{Authentication: "fedcba9876543210fedcba9876543210"},
+		OldKeyPair:     KeyPair{Authentication: "0123456789abcdef0123456789abcdef"},
+		SessionImpl:    e.sessionImpl,
+		CSRFProtection: true,
+	})
+	if err != nil {
+		t.Fatalf("NewManager() fatal error = %v", err)
+	}
+
+	token := e.manager.csrfToken("session-id")
+	if !rotated.validCSRFToken("session-id", token) {
+		t.Errorf("validCSRFToken() the token signed with the old key is not valid")
+	}
+
+	if rotated.csrfToken("session-id") == token {
+		t.Errorf("csrfToken() the token is not signed with the new key")
+	}
+
+	if _, err = NewManager(context.TODO(), Configuration{SessionImpl: e.sessionImpl, CSRFProtection: true}); !errors.Is(err, ErrMissingCSRFKey) {
+		t.Errorf("NewManager() error = %v, wantErr %v", err, ErrMissingCSRFKey)
+	}
+}
+
+func TestManager_SessionTimeouts(t *testing.T) {
+	e := newTestEnv(t, func(c *Configuration) {
+		c.SessionMaxLifetime = time.Hour
+	})
+	e.login(t)
+
+	id := e.sessionID(t)
+
+	data, err := e.sessionImpl.Get(context.TODO(), id)
+	if err != nil {
+		t.Fatalf("Get() fatal error = %v", err)
+	}
+
+	if until := time.Until(data.SessionExpiresAt); until < 29*time.Minute || until > 30*time.Minute {
+		t.Errorf("CallbackHandlerOidc() idle timeout in %v, want %v", until, 30*time.Minute)
+	}
+
+	if until := time.Until(data.AbsoluteExpiresAt); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("CallbackHandlerOidc() maximum lifetime in %v, want %v", until, time.Hour)
+	}
+
+	// The idle timeout is extended by the authenticated requests
+	if err = e.sessionImpl.Touch(context.TODO(), id, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Touch() fatal error = %v", err)
+	}
+
+	w := e.do(e.manager.UserInfoHandlerOidc(e.config), http.MethodGet, "/userinfo")
+	if w.Code != http.StatusOK {
+		t.Fatalf("UserInfoHandlerOidc() status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if data, err = e.sessionImpl.Get(context.TODO(), id); err != nil {
+		t.Fatalf("Get() fatal error = %v", err)
+	}
+
+	if until := time.Until(data.SessionExpiresAt); until < 29*time.Minute {
+		t.Errorf("AuthenticationMiddleware() idle timeout in %v, want %v", until, 30*time.Minute)
+	}
+
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge < 29*60 {
+		t.Errorf("AuthenticationMiddleware() the session cookie was not extended: %v", cookies)
+	}
+
+	// An idle session is not valid anymore
+	if err = e.sessionImpl.Touch(context.TODO(), id, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Touch() fatal error = %v", err)
+	}
+
+	if w = e.do(e.manager.UserInfoHandlerOidc(e.config), http.MethodGet, "/userinfo"); w.Code != http.StatusUnauthorized {
+		t.Errorf("UserInfoHandlerOidc() status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	if _, err = e.sessionImpl.Get(context.TODO(), id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("AuthenticationMiddleware() the expired session was not deleted, error = %v", err)
+	}
+}
+
+func TestManager_SessionMaxLifetime(t *testing.T) {
+	e := newTestEnv(t, func(c *Configuration) {
+		c.SessionMaxLifetime = 2 * time.Second
+	})
+	e.login(t)
+
+	if w := e.do(e.manager.UserInfoHandlerOidc(e.config), http.MethodGet, "/userinfo"); w.Code != http.StatusOK {
+		t.Fatalf("UserInfoHandlerOidc() status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// The requests don't extend the session after its maximum lifetime
+	time.Sleep(2100 * time.Millisecond)
+
+	if w := e.do(e.manager.UserInfoHandlerOidc(e.config), http.MethodGet, "/userinfo"); w.Code != http.StatusUnauthorized {
+		t.Errorf("UserInfoHandlerOidc() status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"github.com/gandalfmagic/go-token-handler/oidc"
 	"github.com/gandalfmagic/go-token-handler/zlogger"
 
-	"golang.org/x/oauth2"
+	"go.uber.org/zap"
 )
 
 func (m *Manager) AuthenticationMiddleware(config *oidc.Config, next http.Handler) http.Handler {
@@ -26,35 +26,58 @@ func (m *Manager) AuthenticationMiddleware(config *oidc.Config, next http.Handle
 			case ErrSessionInvalid:
 				zlog.JsonError(w, http.StatusUnauthorized, "invalid or expired session", err)
 				return
+			case ErrSessionExpired:
+				zlog.JsonError(w, http.StatusUnauthorized, "the session is expired", err)
+				return
 			default:
 				zlog.JsonError(w, http.StatusInternalServerError, "cannot retrieve the session", err)
 				return
 			}
 		}
 
-		// Check if the access token is expired
-		if session.data.IsExpired() {
+		id, _ := session.session.Values[sessionIdName].(string)
+
+		// The state-changing requests must prove they come from the SPA, the
+		// token is checked before the refresh, to avoid any side effect
+		if m.csrfProtection && !isSafeMethod(r.Method) && (id == "" || !m.validCSRFToken(id, r.Header.Get(CSRFHeaderName))) {
+			zlog.JsonError(w, http.StatusForbidden, "missing or invalid csrf token", nil)
+			return
+		}
+
+		// Every authenticated request extends the idle timeout of the session,
+		// a failure doesn't block the request
+		extended, err := m.extendSession(r.Context(), session, id)
+		if err != nil {
+			zlog.Warn("cannot extend the idle timeout of the session", zap.Error(err))
+		}
+
+		// Check if the access token is expired, or it's going to expire soon
+		if session.data.ExpiresWithin(m.refreshSkew) {
 			// The access token is expired (but not the user session), so we can
 			// renew the access token using the refresh token we saved in the
-			// database
-
-			token, err := config.TokenSource(r.Context(), &oauth2.Token{
-				RefreshToken: session.data.RefreshToken,
-			}).Token()
-			if err != nil {
+			// database, only once for all the concurrent requests
+			if err = m.Refresh(w, r, session); err != nil {
 				zlog.JsonError(w, http.StatusUnauthorized, "cannot renew the access token", err)
 				return
 			}
-
-			// Save the session in the cookie, specify the cookie duration
-			if err = session.Update(w, r, token); err != nil {
-				zlog.JsonError(w, http.StatusInternalServerError, "cannot update the session", err)
-				return
+		} else if extended {
+			// The cookie expires together with the idle timeout
+			if err = session.saveSession(w, r, id); err != nil {
+				zlog.Warn("cannot save the session cookie", zap.Error(err))
 			}
 		}
 
-		// The token is saved in the context
+		if id != "" {
+			m.touch(id)
+		}
+
+		// The tokens are saved in the context
 		ctx := context.WithValue(r.Context(), ContextKeyAccessTokenName, session.data.AccessToken)
+		ctx = context.WithValue(ctx, ContextKeyIDTokenName, session.data.IDToken)
+
+		if id != "" && len(m.csrfKeys) > 0 {
+			ctx = context.WithValue(ctx, ContextKeyCSRFTokenName, m.csrfToken(id))
+		}
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
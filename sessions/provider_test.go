@@ -0,0 +1,311 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+const (
+	testClientID     = "token-handler"
+	testClientSecret = "secret"
+	testSubject      = "user-01"
+	testSID          = "idp-session-01"
+	testKeyID        = "test-key"
+)
+
+type testAuthorization struct {
+	nonce         string
+	codeChallenge string
+}
+
+// testProvider is an in-process OIDC auth server, implementing the subset of
+// the endpoints used by the token handler.
+type testProvider struct {
+	server *httptest.Server
+	signer jose.Signer
+	keySet jose.JSONWebKeySet
+
+	mu             sync.Mutex
+	authorizations map[string]testAuthorization
+	refreshTokens  map[string]bool
+	accessTokens   map[string]bool
+	tokenLifetime  time.Duration
+	wrongNonce     bool
+	omitNonce      bool
+	tokenRequests  int
+	revoked        []string
+	revocationDown bool
+	tokenDelay     time.Duration
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate the provider key: %v", err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", testKeyID))
+	if err != nil {
+		t.Fatalf("cannot create the provider signer: %v", err)
+	}
+
+	p := &testProvider{
+		signer:         signer,
+		keySet:         jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: testKeyID, Algorithm: string(jose.RS256), Use: "sig"}}},
+		authorizations: make(map[string]testAuthorization),
+		refreshTokens:  make(map[string]bool),
+		accessTokens:   make(map[string]bool),
+		tokenLifetime:  5 * time.Minute,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discoveryHandler)
+	mux.HandleFunc("/jwks", p.jwksHandler)
+	mux.HandleFunc("/token", p.tokenHandler)
+	mux.HandleFunc("/userinfo", p.userInfoHandler)
+	mux.HandleFunc("/revoke", p.revocationHandler)
+
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *testProvider) discoveryHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.server.URL,
+		"authorization_endpoint":                p.server.URL + "/auth",
+		"token_endpoint":                        p.server.URL + "/token",
+		"jwks_uri":                              p.server.URL + "/jwks",
+		"userinfo_endpoint":                     p.server.URL + "/userinfo",
+		"end_session_endpoint":                  p.server.URL + "/logout",
+		"revocation_endpoint":                   p.server.URL + "/revoke",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *testProvider) jwksHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.keySet)
+}
+
+// authorize simulates the login of the user on the auth server, it returns the
+// callback url the user is redirected to.
+func (p *testProvider) authorize(t *testing.T, loginURL string) string {
+	t.Helper()
+
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatalf("cannot parse the login url: %v", err)
+	}
+
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected code_challenge_method: %s", query.Get("code_challenge_method"))
+	}
+
+	code := randomString()
+
+	p.mu.Lock()
+	p.authorizations[code] = testAuthorization{nonce: query.Get("nonce"), codeChallenge: query.Get("code_challenge")}
+	p.mu.Unlock()
+
+	return fmt.Sprintf("%s?state=%s&code=%s", query.Get("redirect_uri"), url.QueryEscape(query.Get("state")), code)
+}
+
+func (p *testProvider) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	delay := p.tokenDelay
+	p.mu.Unlock()
+
+	// A slow auth server makes the concurrent requests overlap
+	time.Sleep(delay)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tokenRequests++
+
+	var nonce string
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		authorization, ok := p.authorizations[r.PostForm.Get("code")]
+		if !ok {
+			tokenError(w, "invalid_grant")
+			return
+		}
+		delete(p.authorizations, r.PostForm.Get("code"))
+
+		hash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(hash[:]) != authorization.codeChallenge {
+			tokenError(w, "invalid_grant")
+			return
+		}
+
+		nonce = authorization.nonce
+		if p.wrongNonce {
+			nonce = "wrong-nonce"
+		}
+		if p.omitNonce {
+			nonce = ""
+		}
+	case "refresh_token":
+		// The refresh tokens are rotated, every token can be used only once
+		if !p.refreshTokens[r.PostForm.Get("refresh_token")] {
+			tokenError(w, "invalid_grant")
+			return
+		}
+		delete(p.refreshTokens, r.PostForm.Get("refresh_token"))
+	default:
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": p.server.URL,
+		"sub": testSubject,
+		"sid": testSID,
+		"aud": testClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(p.tokenLifetime).Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	idToken, err := jwt.Signed(p.signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	accessToken, refreshToken := randomString(), randomString()
+	p.accessTokens[accessToken] = true
+	p.refreshTokens[refreshToken] = true
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"id_token":      idToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(p.tokenLifetime.Seconds()),
+	})
+}
+
+// logoutToken returns a signed logout token, the claims are added to the
+// standard ones, a nil value removes a claim.
+func (p *testProvider) logoutToken(t *testing.T, extraClaims map[string]interface{}) string {
+	t.Helper()
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":    p.server.URL,
+		"aud":    testClientID,
+		"iat":    now.Unix(),
+		"exp":    now.Add(2 * time.Minute).Unix(),
+		"jti":    randomString(),
+		"events": map[string]interface{}{"http://schemas.openid.net/event/backchannel-logout": map[string]interface{}{}},
+	}
+
+	for k, v := range extraClaims {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+
+		claims[k] = v
+	}
+
+	token, err := jwt.Signed(p.signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatalf("cannot sign the logout token: %v", err)
+	}
+
+	return token
+}
+
+func (p *testProvider) userInfoHandler(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	valid := p.accessTokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	p.mu.Unlock()
+
+	if !valid {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"sub": testSubject})
+}
+
+// revocationHandler implements the RFC 7009 token revocation, the access
+// tokens can't be revoked.
+func (p *testProvider) revocationHandler(w http.ResponseWriter, r *http.Request) {
+	if clientID, clientSecret, ok := r.BasicAuth(); !ok || clientID != testClientID || clientSecret != testClientSecret {
+		http.Error(w, "invalid client", http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.revocationDown {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	token := r.PostForm.Get("token")
+
+	if p.accessTokens[token] {
+		tokenError(w, "unsupported_token_type")
+		return
+	}
+
+	delete(p.refreshTokens, token)
+	p.revoked = append(p.revoked, token)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
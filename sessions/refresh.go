@@ -0,0 +1,251 @@
+package sessions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gandalfmagic/go-token-handler/database"
+	"github.com/gandalfmagic/go-token-handler/oidc"
+	"github.com/gandalfmagic/go-token-handler/opentelemetry"
+	"github.com/gandalfmagic/go-token-handler/zlogger"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+const (
+	refreshTimeout = 30 * time.Second
+)
+
+// detachedContext keeps the values of the parent context, but not its
+// cancellation: a refresh shared by many requests must not be interrupted
+// when the request that started it is canceled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// Refresh renews the expired tokens of the session using the refresh token.
+//
+// The auth server can rotate the refresh tokens, so that every refresh token
+// can be used only once: the concurrent refreshes of the same session are
+// executed only once in the process, and the version of the session is used
+// to detect the refreshes executed by the other instances.
+func (m *Manager) Refresh(w http.ResponseWriter, r *http.Request, session *Session) error {
+	ctx, span := opentelemetry.TracerFromContext(r.Context()).Start(r.Context(), "session-manager: refresh the session tokens")
+	defer span.End()
+
+	id, ok := session.session.Values[sessionIdName].(string)
+	if !ok {
+		return ErrSessionInvalid
+	}
+
+	data, err := m.refresh(ctx, id, session)
+	if err != nil {
+		return err
+	}
+
+	session.data = data
+
+	return session.saveSession(w, r.WithContext(ctx), id)
+}
+
+// refresh executes the refresh of the session, only once for all the concurrent
+// callers using the same session id.
+func (m *Manager) refresh(ctx context.Context, id string, session *Session) (database.SessionData, error) {
+	result, err, _ := m.refreshGroup.Do(id, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detachedContext{parent: ctx}, refreshTimeout)
+		defer cancel()
+
+		return session.refreshData(ctx, id)
+	})
+	if err != nil {
+		return database.SessionData{}, err
+	}
+
+	return result.(database.SessionData), nil
+}
+
+// touch records the activity of a session, used by the background refresher.
+func (m *Manager) touch(id string) {
+	if m.activity == nil {
+		return
+	}
+
+	m.activityMu.Lock()
+	m.activity[id] = time.Now()
+	m.activityMu.Unlock()
+}
+
+// activeSessions returns the ids of the sessions used in the last activity
+// window, the older sessions are forgotten.
+func (m *Manager) activeSessions() []string {
+	since := time.Now().Add(-m.backgroundRefreshWindow)
+
+	m.activityMu.Lock()
+	defer m.activityMu.Unlock()
+
+	ids := make([]string, 0, len(m.activity))
+	for id, lastSeen := range m.activity {
+		if lastSeen.Before(since) {
+			delete(m.activity, id)
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// RunBackgroundRefresher periodically renews the tokens of the recently active
+// sessions, before they expire, so that the requests never wait for a refresh.
+// It does nothing if the background refresh is not enabled in the Configuration,
+// otherwise it returns when the context is canceled.
+func (m *Manager) RunBackgroundRefresher(ctx context.Context, config *oidc.Config) {
+	if m.backgroundRefreshInterval <= 0 {
+		return
+	}
+
+	ctx = opentelemetry.NewContext(ctx, otel.GetTracerProvider().Tracer("token-handler"))
+	zlog := zlogger.FromContext(ctx)
+
+	ticker := time.NewTicker(m.backgroundRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			zlog.Debug("session manager: stopping the background token refresher")
+			return
+		case <-ticker.C:
+			for _, id := range m.activeSessions() {
+				if err := m.refreshInBackground(ctx, config, id); err != nil {
+					zlog.Warn("cannot refresh the session tokens in background", zap.Error(err))
+				}
+			}
+		}
+	}
+}
+
+// refreshInBackground refreshes a session if its tokens expire before the next
+// execution of the background refresher.
+func (m *Manager) refreshInBackground(ctx context.Context, config *oidc.Config, id string) error {
+	data, err := m.sessionImpl.Get(ctx, id)
+	if err != nil {
+		// The session was deleted, or it's expired
+		if errors.Is(err, sql.ErrNoRows) {
+			m.activityMu.Lock()
+			delete(m.activity, id)
+			m.activityMu.Unlock()
+
+			return nil
+		}
+
+		return err
+	}
+
+	// The expired sessions are not refreshed, they will be purged
+	if data.IsSessionExpired() {
+		m.activityMu.Lock()
+		delete(m.activity, id)
+		m.activityMu.Unlock()
+
+		return nil
+	}
+
+	if !data.ExpiresWithin(m.refreshSkew + m.backgroundRefreshInterval) {
+		return nil
+	}
+
+	session := &Session{sessionImpl: m.sessionImpl, timeout: m.sessionTimeout, maxLifetime: m.maxLifetime, oidcConfig: config, data: data}
+	_, err = m.refresh(ctx, id, session)
+
+	return err
+}
+
+// refreshData gets new tokens from the auth server, and saves them in the
+// database. If the session was already refreshed by another instance, the
+// data saved in the database is returned.
+func (s *Session) refreshData(ctx context.Context, id string) (database.SessionData, error) {
+	var span trace.Span
+	ctx, span = opentelemetry.TracerFromContext(ctx).Start(ctx, "session: refresh the tokens")
+	defer span.End()
+
+	token, err := s.oidcConfig.TokenSource(ctx, &oauth2.Token{
+		RefreshToken: s.data.RefreshToken,
+	}).Token()
+	if err != nil {
+		// The refresh token could have been already used by another instance
+		if data, ok := s.refreshedElsewhere(ctx, id); ok {
+			return data, nil
+		}
+
+		return database.SessionData{}, err
+	}
+
+	// The nonce is only verified during the login, a refreshed id-token
+	// is not required to contain it
+	data, err := s.newData(ctx, token, "")
+	if err != nil {
+		return database.SessionData{}, err
+	}
+
+	// A refreshed id-token could not contain the sid claim
+	if data.SID == "" {
+		data.SID = s.data.SID
+	}
+
+	data.Version = s.data.Version
+	data.SessionExpiresAt = s.data.SessionExpiresAt
+	data.AbsoluteExpiresAt = s.data.AbsoluteExpiresAt
+
+	if err = s.sessionImpl.Update(ctx, id, data); err != nil {
+		if errors.Is(err, database.ErrVersionConflict) {
+			if saved, ok := s.refreshedElsewhere(ctx, id); ok {
+				return saved, nil
+			}
+		}
+
+		return database.SessionData{}, err
+	}
+
+	data.Version++
+
+	return data, nil
+}
+
+// refreshedElsewhere returns the session saved in the database, if it was
+// updated after it was read, and its tokens are still valid.
+func (s *Session) refreshedElsewhere(ctx context.Context, id string) (database.SessionData, bool) {
+	data, err := s.sessionImpl.Get(ctx, id)
+	if err != nil {
+		return database.SessionData{}, false
+	}
+
+	if data.Version == s.data.Version || data.IsExpired() {
+		return database.SessionData{}, false
+	}
+
+	return data, true
+}
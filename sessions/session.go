@@ -23,6 +23,7 @@ var (
 	ErrSessionNotFound           = errors.New("cannot retrieve session from storage")
 	ErrCannotRetrieveSessionData = errors.New("cannot retrieve session data")
 	ErrSessionInvalid            = errors.New("cannot retrieve session id from memory")
+	ErrSessionExpired            = errors.New("the session is expired")
 )
 
 type Session struct {
@@ -31,6 +32,7 @@ type Session struct {
 	oidcConfig  *oidc.Config
 	data        database.SessionData
 	timeout     time.Duration
+	maxLifetime time.Duration
 }
 
 func (s *Session) dataFromDB(ctx context.Context) (err error) {
@@ -55,12 +57,14 @@ func (s *Session) dataFromDB(ctx context.Context) (err error) {
 	return
 }
 
-func (s *Session) saveState(w http.ResponseWriter, r *http.Request, state string, age int) error {
+func (s *Session) saveState(w http.ResponseWriter, r *http.Request, state, codeVerifier, nonce string, age int) error {
 	_, span := opentelemetry.TracerFromContext(r.Context()).Start(r.Context(), "session: save state into a cookie")
 	defer span.End()
 
 	s.session.Options.MaxAge = age
 	s.session.Values[sessionStateName] = state
+	s.session.Values[sessionCodeVerifierName] = codeVerifier
+	s.session.Values[sessionNonceName] = nonce
 
 	return s.session.Save(r, w)
 }
@@ -77,23 +81,58 @@ func (s *Session) getState(r *http.Request) string {
 	return state
 }
 
-func (s *Session) newData(ctx context.Context, token *oauth2.Token) (database.SessionData, error) {
+func (s *Session) getCodeVerifier(r *http.Request) string {
+	_, span := opentelemetry.TracerFromContext(r.Context()).Start(r.Context(), "session: get pkce code verifier from a cookie")
+	defer span.End()
+
+	codeVerifier, ok := s.session.Values[sessionCodeVerifierName].(string)
+	if !ok {
+		return ""
+	}
+
+	return codeVerifier
+}
+
+func (s *Session) getNonce(r *http.Request) string {
+	_, span := opentelemetry.TracerFromContext(r.Context()).Start(r.Context(), "session: get nonce from a cookie")
+	defer span.End()
+
+	nonce, ok := s.session.Values[sessionNonceName].(string)
+	if !ok {
+		return ""
+	}
+
+	return nonce
+}
+
+// newData verifies the id-token contained in the oauth2 token, and creates the
+// dataset to save in the database. The nonce is verified only when it's not empty.
+func (s *Session) newData(ctx context.Context, token *oauth2.Token, nonce string) (database.SessionData, error) {
 	var span trace.Span
 	ctx, span = opentelemetry.TracerFromContext(ctx).Start(ctx, "session: create a new session dataset")
 	defer span.End()
 
 	// Verify the id-token and decode it
-	idToken, err := s.oidcConfig.GetIdToken(ctx, token)
+	idToken, err := s.oidcConfig.GetIdToken(ctx, token, nonce)
 	if err != nil {
 		return database.SessionData{}, err
 	}
 
+	// The sid claim is used by the back-channel logout
+	var claims struct {
+		SID string `json:"sid"`
+	}
+	if err = idToken.Token.Claims(&claims); err != nil {
+		return database.SessionData{}, err
+	}
+
 	return database.SessionData{
 		Subject:      idToken.Token.Subject,
 		AccessToken:  token.AccessToken,
 		RefreshToken: token.RefreshToken,
 		IDToken:      idToken.RawToken,
 		ExpiresAt:    token.Expiry, // token expiration
+		SID:          claims.SID,
 	}, nil
 }
 
@@ -102,45 +141,46 @@ func (s *Session) saveSession(w http.ResponseWriter, r *http.Request, id string)
 	defer span.End()
 
 	delete(s.session.Values, sessionStateName)
+	delete(s.session.Values, sessionCodeVerifierName)
+	delete(s.session.Values, sessionNonceName)
 	s.session.Values[sessionIdName] = id
-	s.session.Options.MaxAge = int(s.timeout.Seconds())
+
+	// The cookie expires with the idle timeout, but never after the maximum
+	// lifetime of the session
+	maxAge := s.timeout
+	if !s.data.AbsoluteExpiresAt.IsZero() && time.Until(s.data.AbsoluteExpiresAt) < maxAge {
+		maxAge = time.Until(s.data.AbsoluteExpiresAt)
+	}
+	s.session.Options.MaxAge = int(maxAge.Seconds())
 
 	return s.session.Save(r, w)
 }
 
-func (s *Session) Save(w http.ResponseWriter, r *http.Request, token *oauth2.Token) error {
+func (s *Session) Save(w http.ResponseWriter, r *http.Request, token *oauth2.Token, nonce string) error {
 	ctx, span := opentelemetry.TracerFromContext(r.Context()).Start(r.Context(), "session: save")
 	defer span.End()
 
 	var err error
-	if s.data, err = s.newData(ctx, token); err != nil {
-		return err
-	}
-
-	id, err := s.sessionImpl.Add(ctx, s.data)
-	if err != nil {
+	if s.data, err = s.newData(ctx, token, nonce); err != nil {
 		return err
 	}
 
-	return s.saveSession(w, r.WithContext(ctx), id)
-}
-
-func (s *Session) Update(w http.ResponseWriter, r *http.Request, token *oauth2.Token) error {
-	ctx, span := opentelemetry.TracerFromContext(r.Context()).Start(r.Context(), "session: update")
-	defer span.End()
-
-	var err error
-	if s.data, err = s.newData(ctx, token); err != nil {
-		return err
+	// The session expires with the idle timeout, but never after the maximum
+	// lifetime, the expiration of the access token doesn't matter
+	now := time.Now()
+	if s.timeout > 0 {
+		s.data.SessionExpiresAt = now.Add(s.timeout)
 	}
 
-	id, ok := s.session.Values[sessionIdName].(string)
-	if !ok {
-		return ErrSessionInvalid
+	if s.maxLifetime > 0 {
+		s.data.AbsoluteExpiresAt = now.Add(s.maxLifetime)
+		if s.data.SessionExpiresAt.IsZero() || s.data.SessionExpiresAt.After(s.data.AbsoluteExpiresAt) {
+			s.data.SessionExpiresAt = s.data.AbsoluteExpiresAt
+		}
 	}
 
-	// Save the session in the database
-	if err := s.sessionImpl.Update(ctx, id, s.data); err != nil {
+	id, err := s.sessionImpl.Add(ctx, s.data)
+	if err != nil {
 		return err
 	}
 
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gandalfmagic/go-token-handler/zlogger"
+
+	"go.uber.org/zap"
+)
+
+const (
+	LoadBalancingRoundRobin       = "round-robin"
+	LoadBalancingLeastConnections = "least-connections"
+
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultEjectionTime        = 30 * time.Second
+)
+
+// upstream is a target of a proxy route.
+type upstream struct {
+	url *url.URL
+
+	// active is the number of requests in progress
+	active atomic.Int64
+	// healthy is the result of the last active health check, the upstreams
+	// are healthy until the first check
+	healthy atomic.Bool
+
+	mu sync.Mutex
+	// failures is the number of consecutive failed requests
+	failures int
+	// ejectedUntil is the end of the passive ejection, after max failures
+	ejectedUntil time.Time
+}
+
+// available returns true if the upstream passed the last health check, and it
+// isn't ejected.
+func (u *upstream) available(now time.Time) bool {
+	if !u.healthy.Load() {
+		return false
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return !now.Before(u.ejectedUntil)
+}
+
+// upstreamPool selects the upstream of every request, between the available
+// upstreams of a proxy route.
+type upstreamPool struct {
+	upstreams     []*upstream
+	loadBalancing string
+	next          atomic.Uint64
+
+	// maxFailures is the number of consecutive failed requests that ejects an
+	// upstream for the ejectionTime, the passive ejection is disabled if 0
+	maxFailures  int
+	ejectionTime time.Duration
+}
+
+func newUpstreamPool(targets []string, config ProxyConfig) (*upstreamPool, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("the proxy requires at least one target")
+	}
+
+	switch config.LoadBalancing {
+	case "":
+		config.LoadBalancing = LoadBalancingRoundRobin
+	case LoadBalancingRoundRobin, LoadBalancingLeastConnections:
+	default:
+		return nil, fmt.Errorf("the load balancing must be a value from: %s, %s", LoadBalancingRoundRobin, LoadBalancingLeastConnections)
+	}
+
+	if config.MaxFailures < 0 || config.EjectionTime < 0 {
+		return nil, fmt.Errorf("the max failures and the ejection time must not be negative")
+	}
+
+	if config.EjectionTime == 0 {
+		config.EjectionTime = defaultEjectionTime
+	}
+
+	pool := &upstreamPool{loadBalancing: config.LoadBalancing, maxFailures: config.MaxFailures, ejectionTime: config.EjectionTime}
+
+	for _, target := range targets {
+		targetURL, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+
+		if targetURL.Scheme == "" || targetURL.Host == "" {
+			return nil, fmt.Errorf("the target must be an absolute url: %s", target)
+		}
+
+		u := &upstream{url: targetURL}
+		u.healthy.Store(true)
+		pool.upstreams = append(pool.upstreams, u)
+	}
+
+	return pool, nil
+}
+
+// pick returns the upstream of a request, it returns nil if no upstream is
+// available. The upstream must be released calling done.
+func (p *upstreamPool) pick() *upstream {
+	now := time.Now()
+	start := int(p.next.Add(1) - 1)
+
+	var picked *upstream
+
+	// The scan starts from the next upstream, so that the upstreams with the
+	// same number of connections are used in turn
+	for i := range p.upstreams {
+		u := p.upstreams[(start+i)%len(p.upstreams)]
+		if !u.available(now) {
+			continue
+		}
+
+		if p.loadBalancing == LoadBalancingRoundRobin {
+			picked = u
+			break
+		}
+
+		if picked == nil || u.active.Load() < picked.active.Load() {
+			picked = u
+		}
+	}
+
+	if picked != nil {
+		picked.active.Add(1)
+	}
+
+	return picked
+}
+
+// done releases an upstream, a failed request is a transport error or a 5xx
+// response.
+func (p *upstreamPool) done(u *upstream, failed bool) {
+	u.active.Add(-1)
+
+	if p.maxFailures == 0 {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !failed {
+		u.failures = 0
+		return
+	}
+
+	u.failures++
+	if u.failures >= p.maxFailures {
+		u.failures = 0
+		u.ejectedUntil = time.Now().Add(p.ejectionTime)
+	}
+}
+
+// runHealthChecks checks the upstreams every interval, until the context is
+// done. An upstream is healthy if the health check path returns a 2xx or 3xx
+// status.
+func (p *upstreamPool) runHealthChecks(ctx context.Context, client *http.Client, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, u := range p.upstreams {
+			healthy := checkUpstream(ctx, client, u, path)
+
+			if u.healthy.Swap(healthy) != healthy && ctx.Err() == nil {
+				zlogger.FromContext(ctx).Info("the health of the proxy target changed", zap.String("target", u.url.Redacted()), zap.Bool("healthy", healthy))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkUpstream sends the health check request to an upstream.
+func checkUpstream(ctx context.Context, client *http.Client, u *upstream, path string) bool {
+	checkURL := url.URL{Scheme: u.url.Scheme, User: u.url.User, Host: u.url.Host, Path: path}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL.String(), nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPool_runHealthChecks(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+
+	backend := newTestBackend(t, "backend", func(r *http.Request) int {
+		if r.URL.Path != "/healthz" {
+			return http.StatusNotFound
+		}
+
+		if !healthy.Load() {
+			return http.StatusServiceUnavailable
+		}
+
+		return http.StatusOK
+	})
+
+	pool, err := newUpstreamPool([]string{backend.URL + "/api"}, ProxyConfig{})
+	if err != nil {
+		t.Fatalf("newUpstreamPool() fatal error = %v", err)
+	}
+
+	go pool.runHealthChecks(newTestContext(t), &http.Client{Timeout: time.Second}, "/healthz", 10*time.Millisecond)
+
+	tests := []struct {
+		name          string
+		healthy       bool
+		wantAvailable bool
+	}{
+		{name: "healthy", healthy: true, wantAvailable: true},
+		{name: "unhealthy", healthy: false, wantAvailable: false},
+		{name: "recovered", healthy: true, wantAvailable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthy.Store(tt.healthy)
+
+			// Wait for the next health checks
+			deadline := time.Now().Add(time.Second)
+			for pool.upstreams[0].healthy.Load() != tt.healthy && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			u := pool.pick()
+			if (u != nil) != tt.wantAvailable {
+				t.Fatalf("pick() got = %v, wantAvailable %v", u, tt.wantAvailable)
+			}
+
+			if u != nil {
+				pool.done(u, false)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/gandalfmagic/realip"
@@ -18,6 +19,17 @@ type ctxKey struct{}
 
 type Logger struct {
 	*zap.Logger
+	traceID string
+	spanID  string
+	// state is shared by the copies of the Logger returned by FromContext, the
+	// Middleware creates a new state for every request
+	state *requestState
+}
+
+// requestState contains the values used by the Middleware to add context to
+// the log entry of a request.
+type requestState struct {
+	mu                 sync.Mutex
 	lastErr            error
 	lastErrDescription string
 	traceID            string
@@ -74,29 +86,40 @@ func NewLogger(level string, production bool) (*Logger, error) {
 		log = zap.New(core, zap.AddCaller(), zap.AddCallerSkip(1), zap.AddStacktrace(zap.ErrorLevel), zap.Development())
 	}
 
-	return &Logger{Logger: log}, nil
+	return &Logger{Logger: log, state: &requestState{}}, nil
 }
 
 func NewContext(parent context.Context, z *Logger) context.Context {
 	return context.WithValue(parent, ctxKey{}, z)
 }
 
+// FromContext returns a copy of the Logger saved in the context, with the
+// trace and span ids of the context. The Logger saved in the context is never
+// modified, so FromContext can be called by concurrent goroutines.
 func FromContext(ctx context.Context) *Logger {
 	l, _ := ctx.Value(ctxKey{}).(*Logger)
+	c := *l
 
 	if traceID := trace.SpanFromContext(ctx).SpanContext().TraceID(); traceID.IsValid() {
-		l.traceID = traceID.String()
+		c.traceID = traceID.String()
 	} else {
-		l.traceID = ""
+		c.traceID = ""
 	}
 
 	if spanID := trace.SpanFromContext(ctx).SpanContext().SpanID(); spanID.IsValid() {
-		l.spanID = spanID.String()
+		c.spanID = spanID.String()
 	} else {
-		l.spanID = ""
+		c.spanID = ""
+	}
+
+	// The ids are also used by the Middleware, for the log of the request
+	if c.traceID != "" {
+		c.state.mu.Lock()
+		c.state.traceID, c.state.spanID = c.traceID, c.spanID
+		c.state.mu.Unlock()
 	}
 
-	return l
+	return &c
 }
 
 // Sync synchronize the logger output by flushing any buffered log entries.
@@ -121,8 +144,11 @@ func (l *Logger) Sync() {
 // Note: if you also need to return an error to the REST client, you should use
 // the JsonError function.
 func (l *Logger) SetError(description string, err error) {
-	l.lastErrDescription = description
-	l.lastErr = err
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+
+	l.state.lastErrDescription = description
+	l.state.lastErr = err
 }
 
 // JsonError generate the JSON data to send to the client in case of an error.
@@ -150,8 +176,7 @@ func (l *Logger) SetError(description string, err error) {
 // Note: if you need to add context to the logger, but without returning an
 // error to the REST client, you should use the SetError function.
 func (l *Logger) JsonError(w http.ResponseWriter, code int, description string, err error) {
-	l.lastErrDescription = description
-	l.lastErr = err
+	l.SetError(description, err)
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -178,18 +203,16 @@ func (l *Logger) JsonError(w http.ResponseWriter, code int, description string,
 // the meaningful details needed for an HTTP server
 func (l *Logger) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			// clean the state of the Logger
-			l.lastErrDescription = ""
-			l.lastErr = nil
-		}()
+		// the state of the request is used only by the copies of the Logger
+		// returned by FromContext during the request
+		rl := &Logger{Logger: l.Logger, state: &requestState{}}
 
 		// override the ResponseWriter to record the status code and the
 		// body size of the response
 		recorder := &StatusRecorder{ResponseWriter: w, Status: 200}
 		w = recorder
 
-		ctx := context.WithValue(r.Context(), ctxKey{}, l)
+		ctx := context.WithValue(r.Context(), ctxKey{}, rl)
 
 		// call the wrapped handler and measure the time taken to run it
 		start := time.Now()
@@ -206,12 +229,15 @@ func (l *Logger) Middleware(next http.Handler) http.Handler {
 			zap.String("host", r.RemoteAddr),
 		}
 
-		if l.traceID != "" {
-			fields = append(fields, zap.String("trace-id", l.traceID))
+		rl.state.mu.Lock()
+		defer rl.state.mu.Unlock()
+
+		if rl.state.traceID != "" {
+			fields = append(fields, zap.String("trace-id", rl.state.traceID))
 		}
 
-		if l.spanID != "" {
-			fields = append(fields, zap.String("trace-id", l.spanID))
+		if rl.state.spanID != "" {
+			fields = append(fields, zap.String("trace-id", rl.state.spanID))
 		}
 
 		// add the `referer` field only if the Header exists in the request
@@ -231,15 +257,15 @@ func (l *Logger) Middleware(next http.Handler) http.Handler {
 		)
 
 		// if the `lastErr` value is set in the Logger state, is added as a field
-		if l.lastErr != nil {
-			fields = append(fields, zap.Error(l.lastErr))
+		if rl.state.lastErr != nil {
+			fields = append(fields, zap.Error(rl.state.lastErr))
 		}
 
 		// if the `lastErrDescription` value is set in the logger state, it's used
 		// as detail for the log message
 		var message string
-		if l.lastErrDescription != "" {
-			message = fmt.Sprintf("%s: %s", http.StatusText(recorder.Status), l.lastErrDescription)
+		if rl.state.lastErrDescription != "" {
+			message = fmt.Sprintf("%s: %s", http.StatusText(recorder.Status), rl.state.lastErrDescription)
 		} else {
 			message = http.StatusText(recorder.Status)
 		}
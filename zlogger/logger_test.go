@@ -0,0 +1,113 @@
+package zlogger
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestFromContext_Concurrent(t *testing.T) {
+	l, err := NewLogger("fatal", false)
+	if err != nil {
+		t.Fatalf("NewLogger() fatal error = %v", err)
+	}
+
+	ctx := NewContext(context.Background(), l)
+
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).JsonError(w, http.StatusBadGateway, "reverse proxy error", errors.New("connection refused"))
+	}))
+
+	// The requests and a background goroutine use the same Logger
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if w.Code != http.StatusBadGateway {
+				t.Errorf("JsonError() status = %d, want %d", w.Code, http.StatusBadGateway)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			FromContext(ctx).Info("background")
+		}()
+	}
+	wg.Wait()
+
+	if got := FromContext(ctx); got == l {
+		t.Errorf("FromContext() returned the Logger saved in the context, want a copy")
+	}
+}
+
+func TestFromContext_ConcurrentTraced(t *testing.T) {
+	l, err := NewLogger("fatal", false)
+	if err != nil {
+		t.Fatalf("NewLogger() fatal error = %v", err)
+	}
+
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10},
+		SpanID:  trace.SpanID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+	})
+
+	var rl *Logger
+
+	// The goroutines started by a request use the logger of the request,
+	// with the trace ids of a traced context
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl, _ = r.Context().Value(ctxKey{}).(*Logger)
+		ctx := trace.ContextWithSpanContext(r.Context(), spanContext)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				zlog := FromContext(ctx)
+				if zlog.traceID != spanContext.TraceID().String() || zlog.spanID != spanContext.SpanID().String() {
+					t.Errorf("FromContext() ids = %s %s, want %s %s", zlog.traceID, zlog.spanID, spanContext.TraceID(), spanContext.SpanID())
+				}
+
+				zlog.SetError("refresh failed", errors.New("invalid_grant"))
+			}()
+		}
+		wg.Wait()
+
+		FromContext(r.Context()).JsonError(w, http.StatusUnauthorized, "cannot refresh the session", nil)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("JsonError() status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// The state of the request contains the ids, and the last error
+	if rl.state.traceID != spanContext.TraceID().String() {
+		t.Errorf("Middleware() trace id = %s, want %s", rl.state.traceID, spanContext.TraceID())
+	}
+
+	if rl.state.lastErrDescription != "cannot refresh the session" {
+		t.Errorf("Middleware() last error = %s, want %s", rl.state.lastErrDescription, "cannot refresh the session")
+	}
+
+	// The Logger saved in the context by NewContext is never modified
+	if l.state.traceID != "" || l.state.lastErr != nil {
+		t.Errorf("Middleware() modified the state of the server Logger")
+	}
+}